@@ -0,0 +1,93 @@
+package main
+
+import (
+	"image/color"
+	"math"
+)
+
+// AQI categories, in increasing order of severity
+const (
+	AQIGood = iota
+	AQIModerate
+	AQIUnhealthySensitive
+	AQIUnhealthy
+	AQIVeryUnhealthy
+	AQIHazardous
+)
+
+// aqiCategoryNames are the EPA names for each AQI category
+var aqiCategoryNames = []string{
+	"Good",
+	"Moderate",
+	"Unhealthy for Sensitive Groups",
+	"Unhealthy",
+	"Very Unhealthy",
+	"Hazardous",
+}
+
+// aqiCategoryColors are the EPA colors for each AQI category, in category order
+var aqiCategoryColors = []color.RGBA{
+	{0, 228, 0, 255},
+	{255, 255, 0, 255},
+	{255, 126, 0, 255},
+	{255, 0, 0, 255},
+	{143, 63, 151, 255},
+	{126, 0, 35, 255},
+}
+
+// aqiBreakpoint maps a PM2.5 concentration range onto an AQI range
+type aqiBreakpoint struct {
+	concLow, concHigh float64
+	aqiLow, aqiHigh   int
+}
+
+// pm25Breakpoints are the EPA PM2.5 breakpoints (2024 revision), in µg/m³ truncated
+// to one decimal place
+var pm25Breakpoints = []aqiBreakpoint{
+	{0.0, 9.0, 0, 50},
+	{9.1, 35.4, 51, 100},
+	{35.5, 55.4, 101, 150},
+	{55.5, 125.4, 151, 200},
+	{125.5, 225.4, 201, 300},
+	{225.5, 325.4, 301, 500},
+}
+
+// PM25AQI converts a PM2.5 concentration in µg/m³ to the US EPA AQI. Concentrations
+// above the top breakpoint are reported as 500.
+func PM25AQI(conc float64) int {
+	if conc <= 0 {
+		return 0
+	}
+	c := math.Floor(conc*10) / 10
+
+	for _, bp := range pm25Breakpoints {
+		if c <= bp.concHigh {
+			aqi := float64(bp.aqiHigh-bp.aqiLow)/(bp.concHigh-bp.concLow)*(c-bp.concLow) + float64(bp.aqiLow)
+			return int(math.Round(aqi))
+		}
+	}
+	return 500
+}
+
+// AQICategory returns the category an AQI value falls into
+func AQICategory(aqi int) int {
+	switch {
+	case aqi <= 50:
+		return AQIGood
+	case aqi <= 100:
+		return AQIModerate
+	case aqi <= 150:
+		return AQIUnhealthySensitive
+	case aqi <= 200:
+		return AQIUnhealthy
+	case aqi <= 300:
+		return AQIVeryUnhealthy
+	default:
+		return AQIHazardous
+	}
+}
+
+// AQICategoryName returns the EPA name for an AQI value's category
+func AQICategoryName(aqi int) string {
+	return aqiCategoryNames[AQICategory(aqi)]
+}
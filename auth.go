@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// API key roles. An admin key can do anything a read key can.
+const (
+	RoleRead  = "read"
+	RoleAdmin = "admin"
+)
+
+const (
+	// apiKeyPrefix starts every API key so leaked keys are easy to recognize
+	apiKeyPrefix = "aqm_"
+
+	// apiKeyTouchInterval limits how often a key's last use is written back
+	apiKeyTouchInterval = time.Minute
+
+	// authRealm is sent with 401 responses so browsers prompt for a key
+	authRealm = "Air Quality Monitor"
+)
+
+// APIKey is a stored API key. Only a SHA-256 hash of the key is kept; Prefix holds its
+// first characters so keys can be told apart in listings.
+type APIKey struct {
+	ID         int64
+	Name       string
+	Prefix     string
+	Hash       string
+	Role       string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// validRole reports whether role is a known API key role
+func validRole(role string) bool {
+	return role == RoleRead || role == RoleAdmin
+}
+
+// roleAllows reports whether a key with role may make a request needing required
+func roleAllows(role, required string) bool {
+	return role == RoleAdmin || role == required
+}
+
+// hashAPIKey returns the stored form of an API key. Keys are long random strings, so a
+// plain SHA-256 is enough; a slow password hash would only add latency to every request.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey creates a new random API key, returning the key itself and its stored form
+func generateAPIKey(name, role string) (string, *APIKey, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, fmt.Errorf("failed to generate API key: %w", err)
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	return key, &APIKey{
+		Name:      name,
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		Hash:      hashAPIKey(key),
+		Role:      role,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// requestAPIKey returns the API key sent with a request, from an "Authorization: Bearer"
+// header, an X-API-Key header, or the password of HTTP basic auth (which lets browsers
+// prompt for it)
+func requestAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+// requiredRole returns the role a request needs, or "" if it is public. Health checks
+// are public, /api/v1/admin/ needs an admin key, other reads need a read key, and anything
+// that changes state needs an admin key.
+func requiredRole(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case path == "/health" || strings.HasPrefix(path, "/health/"):
+		return ""
+	case strings.HasPrefix(path, apiPrefix+"/admin/") || strings.HasPrefix(path, legacyAPIPrefix+"/admin/"):
+		return RoleAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return RoleRead
+	default:
+		return RoleAdmin
+	}
+}
+
+// storesReading reports whether a request stores the reading it fetches from the sensor.
+// public_read does not cover it, since it would let anyone write to the database.
+func storesReading(r *http.Request) bool {
+	return r.URL.Path == "/data/json"
+}
+
+// apiKeyContextKey is the request context key for the authenticated API key
+type apiKeyContextKey struct{}
+
+// withRequestKey returns a context carrying the API key a request was authenticated with
+func withRequestKey(ctx context.Context, key *APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// requestKey returns the API key a request was authenticated with, or nil
+func requestKey(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// authenticate is router middleware that enforces API key roles when authentication is
+// enabled
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := requiredRole(r)
+		if !s.auth.Enabled || role == "" || (role == RoleRead && s.auth.PublicRead && !storesReading(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := requestAPIKey(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, authRealm))
+			writeError(w, r, http.StatusUnauthorized, errUnauthorized, "API key required")
+			return
+		}
+		if s.database == nil {
+			databaseUnavailable(w, r)
+			return
+		}
+
+		key, err := s.storage(r).GetAPIKey(hashAPIKey(token))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error looking up API key", "error", err)
+			writeError(w, r, http.StatusInternalServerError, errInternal, "Error checking API key")
+			return
+		}
+		if key == nil {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, authRealm))
+			writeError(w, r, http.StatusUnauthorized, errUnauthorized, "Invalid API key")
+			return
+		}
+		if !roleAllows(key.Role, role) {
+			writeError(w, r, http.StatusForbidden, errForbidden, "This API key is not allowed to do that")
+			return
+		}
+
+		if now := time.Now(); key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+			if err := s.storage(r).TouchAPIKey(key.ID, now); err != nil {
+				slog.WarnContext(r.Context(), "Error recording API key use", "error", err)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(withRequestKey(r.Context(), key)))
+	})
+}
+
+// corsMiddleware adds CORS headers for requests from allowed origins and answers their
+// preflight requests. "*" allows any origin; with no origins, cross-origin requests get
+// no CORS headers and browsers block them.
+func corsMiddleware(origins []string, next http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(allowed) > 0 {
+			w.Header().Add("Vary", "Origin")
+		}
+		if origin == "" || !(allowed["*"] || allowed[origin]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, X-API-Key, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// runKeysCommand manages API keys:
+//
+//	keys create -name NAME [-role read|admin]
+//	keys list
+//	keys revoke -name NAME
+func runKeysCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: keys create|list|revoke [flags]")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("keys "+action, flag.ExitOnError)
+	dbPath := fs.String("db", defaultDatabasePath(), "SQLite database path or postgres:// connection URL")
+	name := fs.String("name", "", "key name")
+	role := fs.String("role", RoleRead, "key role: read or admin")
+	fs.Parse(args[1:])
+
+	database, err := OpenStorage(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	switch action {
+	case "create":
+		if *name == "" {
+			return fmt.Errorf("-name is required")
+		}
+		if !validRole(*role) {
+			return fmt.Errorf("invalid role %q: expected %s or %s", *role, RoleRead, RoleAdmin)
+		}
+		key, stored, err := generateAPIKey(*name, *role)
+		if err != nil {
+			return err
+		}
+		if err := database.CreateAPIKey(stored); err != nil {
+			return err
+		}
+		fmt.Printf("Created %s key %q. It is shown only once, so store it now:\n\n%s\n", *role, *name, key)
+		return nil
+
+	case "list":
+		keys, err := database.ListAPIKeys()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tROLE\tKEY\tCREATED\tLAST USED")
+		for _, k := range keys {
+			lastUsed := "never"
+			if k.LastUsedAt != nil {
+				lastUsed = k.LastUsedAt.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s...\t%s\t%s\n", k.Name, k.Role, k.Prefix, k.CreatedAt.Local().Format(time.RFC3339), lastUsed)
+		}
+		return tw.Flush()
+
+	case "revoke":
+		if *name == "" {
+			return fmt.Errorf("-name is required")
+		}
+		found, err := database.DeleteAPIKey(*name)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("no API key named %q", *name)
+		}
+		fmt.Printf("Revoked key %q\n", *name)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown keys command %q: expected create, list or revoke", action)
+	}
+}
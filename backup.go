@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// backupStepPages is the number of pages copied per backup step; the source is only
+// locked while a step runs, so the collector can keep writing between steps
+const backupStepPages = 512
+
+// backupTimeFormat is used in backup file names so they sort chronologically
+const backupTimeFormat = "20060102T150405Z"
+
+// BackupConfig controls scheduled backups of the SQLite database
+type BackupConfig struct {
+	Dir      string
+	Interval time.Duration
+	Keep     int
+}
+
+// backupConfigFromEnv reads scheduled backup settings from BACKUP_DIR, BACKUP_INTERVAL
+// and BACKUP_KEEP. Backups are disabled when BACKUP_INTERVAL is unset.
+func backupConfigFromEnv() (*BackupConfig, error) {
+	intervalValue := os.Getenv("BACKUP_INTERVAL")
+	if intervalValue == "" {
+		return nil, nil
+	}
+
+	interval, err := time.ParseDuration(intervalValue)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid BACKUP_INTERVAL %q", intervalValue)
+	}
+
+	cfg := &BackupConfig{Dir: os.Getenv("BACKUP_DIR"), Interval: interval, Keep: 7}
+	if cfg.Dir == "" {
+		cfg.Dir = "backups"
+	}
+	if keep := os.Getenv("BACKUP_KEEP"); keep != "" {
+		if _, err := fmt.Sscanf(keep, "%d", &cfg.Keep); err != nil || cfg.Keep < 1 {
+			return nil, fmt.Errorf("invalid BACKUP_KEEP %q", keep)
+		}
+	}
+	return cfg, nil
+}
+
+// Backup copies the live database to destPath using SQLite's online backup API, which
+// produces a consistent snapshot even while other connections are writing
+func (d *Database) Backup(destPath string) error {
+	ctx := context.Background()
+
+	destDB, err := sql.Open("sqlite3", destPath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer destDB.Close()
+
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer destConn.Close()
+
+	srcConn, err := d.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %w", err)
+	}
+	defer srcConn.Close()
+
+	err = destConn.Raw(func(destRaw interface{}) error {
+		return srcConn.Raw(func(srcRaw interface{}) error {
+			dest, ok := destRaw.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("backup destination is not a SQLite connection")
+			}
+			src, ok := srcRaw.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("backup source is not a SQLite connection")
+			}
+
+			backup, err := dest.Backup("main", src, "main")
+			if err != nil {
+				return fmt.Errorf("failed to start backup: %w", err)
+			}
+
+			for {
+				done, err := backup.Step(backupStepPages)
+				if err != nil {
+					backup.Finish()
+					return fmt.Errorf("backup step failed: %w", err)
+				}
+				if done {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			return backup.Finish()
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// The copy takes on the live database's WAL journal mode; switching it back makes
+	// the backup a single file that opening it doesn't add -wal and -shm files next to
+	if _, err := destConn.ExecContext(ctx, "PRAGMA journal_mode = DELETE"); err != nil {
+		return fmt.Errorf("failed to set backup journal mode: %w", err)
+	}
+	return nil
+}
+
+// removeJournalFiles removes the journal files SQLite may leave next to a database file
+func removeJournalFiles(path string) {
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+}
+
+// verifyDatabaseFile runs PRAGMA integrity_check on a database file and returns its
+// schema version
+func verifyDatabaseFile(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return 0, fmt.Errorf("integrity check failed: %w", err)
+	}
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("integrity check failed: %w", err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	rows.Close()
+	if len(problems) > 0 {
+		return 0, fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	var tables int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'measurements'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, fmt.Errorf("%s does not contain a measurements table", path)
+	}
+
+	return version, nil
+}
+
+// backupPrefix returns the file name prefix used for backups of dbPath
+func backupPrefix(dbPath string) string {
+	base := filepath.Base(dbPath)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + "-"
+}
+
+// createBackup writes a timestamped, verified backup of the database into dir and
+// removes all but the newest keep backups
+func createBackup(database *Database, dir string, keep int) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	name := backupPrefix(database.path) + time.Now().UTC().Format(backupTimeFormat) + ".db"
+	path := filepath.Join(dir, name)
+	tmpPath := path + ".tmp"
+
+	defer removeJournalFiles(tmpPath)
+	if err := database.Backup(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if _, err := verifyDatabaseFile(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("backup verification failed: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to finalize backup: %w", err)
+	}
+
+	if err := rotateBackups(dir, backupPrefix(database.path), keep); err != nil {
+		slog.Warn("Failed to rotate backups", "error", err)
+	}
+	return path, nil
+}
+
+// rotateBackups deletes the oldest backups in dir so that at most keep remain
+func rotateBackups(dir, prefix string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ".db") {
+			backups = append(backups, name)
+		}
+	}
+	sort.Strings(backups)
+
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		slog.Info("Removed old backup", "file", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// restoreDatabase replaces the database at dbPath with a verified backup. The current
+// database and its journal files are kept alongside it with a .pre-restore suffix.
+func restoreDatabase(backupPath, dbPath string) error {
+	version, err := verifyDatabaseFile(backupPath)
+	if err != nil {
+		return fmt.Errorf("backup is not usable: %w", err)
+	}
+	// Older backups are migrated when the database is next opened
+	if version > len(schemaMigrations) {
+		return fmt.Errorf("backup schema version %d is newer than this build (%d)", version, len(schemaMigrations))
+	}
+
+	// Copy next to the target first so the final swap is an atomic rename
+	tmpPath := dbPath + ".restore-tmp"
+	if err := copyFile(backupPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to copy backup: %w", err)
+	}
+
+	previous := dbPath + ".pre-restore-" + time.Now().UTC().Format(backupTimeFormat)
+	if _, err := os.Stat(dbPath); err == nil {
+		if err := os.Rename(dbPath, previous); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to move current database aside: %w", err)
+		}
+		slog.Info("Previous database saved", "path", previous)
+	}
+	// Journal files belong to the database being replaced. Transactions not yet
+	// checkpointed exist only in the WAL, so it moves with the saved copy, where SQLite
+	// finds it when that copy is opened.
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if _, err := os.Stat(dbPath + suffix); err != nil {
+			continue
+		}
+		if err := os.Rename(dbPath+suffix, previous+suffix); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to move %s aside: %w", dbPath+suffix, err)
+		}
+	}
+
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return fmt.Errorf("failed to swap in restored database: %w", err)
+	}
+	return nil
+}
+
+// copyFile copies src to dst and syncs it to disk
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// runBackupCommand implements the `backup` CLI command
+func runBackupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDatabasePath(), "path to the SQLite database")
+	dir := fs.String("dir", "backups", "directory to write backups to")
+	keep := fs.Int("keep", 7, "number of backups to keep")
+	fs.Parse(args)
+
+	if isPostgresDSN(*dbPath) || isMemoryDSN(*dbPath) {
+		return fmt.Errorf("backups are only supported for SQLite databases")
+	}
+	if _, err := os.Stat(*dbPath); err != nil {
+		return fmt.Errorf("database not found: %w", err)
+	}
+
+	database, err := NewDatabase(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	path, err := createBackup(database, *dir, *keep)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backup written to %s\n", path)
+	return nil
+}
+
+// runRestoreCommand implements the `restore` CLI command. The server must not be
+// running against the database while it is restored.
+func runRestoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDatabasePath(), "path to the SQLite database to replace")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s restore [flags] backup.db\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a single backup file")
+	}
+	if isPostgresDSN(*dbPath) || isMemoryDSN(*dbPath) {
+		return fmt.Errorf("restore is only supported for SQLite databases")
+	}
+
+	if err := restoreDatabase(fs.Arg(0), *dbPath); err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %s from %s\n", *dbPath, fs.Arg(0))
+	return nil
+}
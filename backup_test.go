@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// countMeasurements returns the number of rows in a database file's measurements table
+func countMeasurements(t *testing.T, path string) int {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM measurements").Scan(&count); err != nil {
+		t.Fatalf("failed to count measurements in %s: %v", path, err)
+	}
+	return count
+}
+
+func TestRestoreKeepsUncheckpointedWrites(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	backupPath := filepath.Join(dir, "backup.db")
+	backup, err := NewDatabase(backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup.StoreMeasurement(testMeasurement("a", base, 10, 1))
+	backup.Close()
+
+	// Write to a database without checkpointing and copy its files while the connection
+	// is open, leaving a database like one whose server was stopped uncleanly
+	livePath := filepath.Join(dir, "live", "air_quality.db")
+	os.MkdirAll(filepath.Dir(livePath), 0o755)
+	live, err := NewDatabase(livePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.db.SetMaxOpenConns(1)
+	if _, err := live.db.Exec("PRAGMA wal_autocheckpoint = 0"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		live.StoreMeasurement(testMeasurement("a", base.Add(time.Duration(i)*time.Minute), 10, 1))
+	}
+	dbPath := filepath.Join(dir, "air_quality.db")
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := copyFile(livePath+suffix, dbPath+suffix); err != nil {
+			t.Fatalf("failed to copy %s: %v", livePath+suffix, err)
+		}
+	}
+	live.Close()
+
+	if err := restoreDatabase(backupPath, dbPath); err != nil {
+		t.Fatalf("restoreDatabase: %v", err)
+	}
+
+	if n := countMeasurements(t, dbPath); n != 1 {
+		t.Errorf("restored database has %d measurements, want 1", n)
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if _, err := os.Stat(dbPath + suffix); err == nil {
+			t.Errorf("%s of the replaced database was left next to the restored one", suffix)
+		}
+	}
+
+	previous, err := filepath.Glob(dbPath + ".pre-restore-*[0-9Z]")
+	if err != nil || len(previous) != 1 {
+		t.Fatalf("found saved databases %v, want one", previous)
+	}
+	if n := countMeasurements(t, previous[0]); n != 3 {
+		t.Errorf("saved database has %d measurements, want the 3 written before the restore", n)
+	}
+}
+
+func TestBackupIsSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	database, err := NewDatabase(filepath.Join(dir, "air_quality.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	database.StoreMeasurement(testMeasurement("a", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), 10, 1))
+
+	backupDir := filepath.Join(dir, "backups")
+	path, err := createBackup(database, backupDir, 7)
+	if err != nil {
+		t.Fatalf("createBackup: %v", err)
+	}
+
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(path) {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("backup directory holds %v, want only %s", names, filepath.Base(path))
+	}
+
+	// Bytes 18 and 19 of the header are 2 for WAL mode and 1 for rollback journals
+	header := make([]byte, 20)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Read(header)
+	f.Close()
+	if header[18] != 1 || header[19] != 1 {
+		t.Errorf("backup header journal bytes = %d %d, want 1 1 (not WAL)", header[18], header[19])
+	}
+	if n := countMeasurements(t, path); n != 1 {
+		t.Errorf("backup has %d measurements, want 1", n)
+	}
+}
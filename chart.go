@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// ChartPoint is one value in a chart series
+type ChartPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+// ChartSeries is a line drawn on a chart
+type ChartSeries struct {
+	Label  string
+	Color  color.RGBA
+	Points []ChartPoint
+}
+
+// ChartBand shades the plot background between two values, such as an AQI category
+type ChartBand struct {
+	Low   float64
+	High  float64
+	Color color.RGBA
+}
+
+// ChartTheme is the set of colors a chart is drawn with, apart from its series
+type ChartTheme struct {
+	Background color.RGBA
+	Grid       color.RGBA
+	Axis       color.RGBA
+	Text       color.RGBA
+}
+
+// Chart is a time-series line chart that can be rendered without a browser
+type Chart struct {
+	Title    string
+	Series   []ChartSeries
+	Bands    []ChartBand
+	Width    int
+	Height   int
+	Location *time.Location
+	Theme    *ChartTheme
+
+	// MaxGap breaks a line where consecutive points are further apart, so missing data
+	// isn't drawn as a straight line
+	MaxGap time.Duration
+}
+
+// chartPalette is the default color for each series, in order
+var chartPalette = []color.RGBA{
+	{54, 162, 235, 255},
+	{255, 99, 132, 255},
+	{255, 159, 64, 255},
+	{75, 192, 192, 255},
+	{153, 102, 255, 255},
+	{201, 203, 207, 255},
+}
+
+// Chart themes
+var (
+	chartLightTheme = &ChartTheme{
+		Background: color.RGBA{255, 255, 255, 255},
+		Grid:       color.RGBA{230, 230, 230, 255},
+		Axis:       color.RGBA{120, 120, 120, 255},
+		Text:       color.RGBA{51, 51, 51, 255},
+	}
+	chartDarkTheme = &ChartTheme{
+		Background: color.RGBA{30, 30, 36, 255},
+		Grid:       color.RGBA{60, 60, 68, 255},
+		Axis:       color.RGBA{150, 150, 160, 255},
+		Text:       color.RGBA{220, 220, 225, 255},
+	}
+)
+
+// chartThemes are the themes selectable by name
+var chartThemes = map[string]*ChartTheme{
+	"light": chartLightTheme,
+	"dark":  chartDarkTheme,
+}
+
+// chartBandOpacity is how strongly band colors show through the background
+const chartBandOpacity = 0.25
+
+// Chart layout, in pixels
+const (
+	chartMarginLeft   = 60
+	chartMarginRight  = 20
+	chartMarginTop    = 50
+	chartMarginBottom = 35
+	chartLineWidth    = 2
+)
+
+// textAnchor is the horizontal alignment of chart text relative to its position
+type textAnchor int
+
+const (
+	anchorStart textAnchor = iota
+	anchorMiddle
+	anchorEnd
+)
+
+// chartCanvas is the drawing surface a chart is rendered onto. Coordinates are in
+// pixels from the top left; text is vertically centered on y.
+type chartCanvas interface {
+	fillRect(x, y, w, h float64, c color.RGBA)
+	line(x1, y1, x2, y2 float64, c color.RGBA, width float64)
+	polyline(points [][2]float64, c color.RGBA, width float64)
+	text(x, y float64, s string, c color.RGBA, anchor textAnchor)
+}
+
+// seriesColor returns the series color, or a palette color when none is set
+func seriesColor(s ChartSeries, i int) color.RGBA {
+	if s.Color.A != 0 {
+		return s.Color
+	}
+	return chartPalette[i%len(chartPalette)]
+}
+
+// blendColor mixes c over bg with the given opacity, giving an opaque color
+func blendColor(c, bg color.RGBA, opacity float64) color.RGBA {
+	mix := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a)*opacity + float64(b)*(1-opacity)))
+	}
+	return color.RGBA{mix(c.R, bg.R), mix(c.G, bg.G), mix(c.B, bg.B), 255}
+}
+
+// hexColor formats a color as #rrggbb
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// bounds returns the time and value ranges covered by the chart's points
+func (c *Chart) bounds() (time.Time, time.Time, float64, float64, bool) {
+	var start, end time.Time
+	minV, maxV := math.Inf(1), math.Inf(-1)
+	found := false
+
+	for _, s := range c.Series {
+		for _, p := range s.Points {
+			if !found || p.Time.Before(start) {
+				start = p.Time
+			}
+			if !found || p.Time.After(end) {
+				end = p.Time
+			}
+			minV = math.Min(minV, p.Value)
+			maxV = math.Max(maxV, p.Value)
+			found = true
+		}
+	}
+	return start, end, minV, maxV, found
+}
+
+// niceTicks returns evenly spaced, round tick values covering [min, max]
+func niceTicks(min, max float64, count int) []float64 {
+	if min == max {
+		min, max = min-1, max+1
+	}
+	step := niceNumber((max - min) / float64(count))
+	first := math.Floor(min/step) * step
+	last := math.Ceil(max/step) * step
+
+	var ticks []float64
+	for v := first; v <= last+step/2; v += step {
+		ticks = append(ticks, v)
+	}
+	return ticks
+}
+
+// niceNumber rounds a step up to 1, 2, 2.5 or 5 times a power of ten
+func niceNumber(step float64) float64 {
+	magnitude := math.Pow(10, math.Floor(math.Log10(step)))
+	for _, f := range []float64{1, 2, 2.5, 5, 10} {
+		if step <= f*magnitude {
+			return f * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+// timeTickSteps are the intervals considered for time axis ticks
+var timeTickSteps = []time.Duration{
+	time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour,
+	24 * time.Hour, 2 * 24 * time.Hour, 7 * 24 * time.Hour, 14 * 24 * time.Hour, 28 * 24 * time.Hour,
+}
+
+// timeTicks returns tick times between start and end, aligned to the step in loc, and
+// the label format for them
+func timeTicks(start, end time.Time, count int, loc *time.Location) ([]time.Time, string) {
+	span := end.Sub(start)
+	step := timeTickSteps[len(timeTickSteps)-1]
+	for _, s := range timeTickSteps {
+		if span/s <= time.Duration(count) {
+			step = s
+			break
+		}
+	}
+
+	format := "15:04"
+	switch {
+	case step >= 24*time.Hour:
+		format = "Jan 2"
+	case span > 24*time.Hour:
+		format = "Jan 2 15:04"
+	}
+
+	// Count steps from local midnight so ticks fall on round times
+	local := start.In(loc)
+	t := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	var ticks []time.Time
+	for ; !t.After(end); t = t.Add(step) {
+		if !t.Before(start) {
+			ticks = append(ticks, t)
+		}
+	}
+	return ticks, format
+}
+
+// formatTickValue formats a value axis label without trailing zeros
+func formatTickValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// draw lays out the chart on canvas
+func (c *Chart) draw(canvas chartCanvas) {
+	width, height := float64(c.Width), float64(c.Height)
+	loc := c.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	theme := c.Theme
+	if theme == nil {
+		theme = chartLightTheme
+	}
+
+	canvas.fillRect(0, 0, width, height, theme.Background)
+	canvas.text(width/2, 14, c.Title, theme.Text, anchorMiddle)
+
+	// Legend
+	x := float64(chartMarginLeft)
+	for i, s := range c.Series {
+		col := seriesColor(s, i)
+		canvas.fillRect(x, 29, 12, 6, col)
+		canvas.text(x+16, 32, s.Label, theme.Text, anchorStart)
+		x += 16 + float64(len(s.Label))*7 + 20
+	}
+
+	plotX, plotY := float64(chartMarginLeft), float64(chartMarginTop)
+	plotW := width - chartMarginLeft - chartMarginRight
+	plotH := height - chartMarginTop - chartMarginBottom
+
+	start, end, minV, maxV, ok := c.bounds()
+	if !ok {
+		canvas.line(plotX, plotY+plotH, plotX+plotW, plotY+plotH, theme.Axis, 1)
+		canvas.text(plotX+plotW/2, plotY+plotH/2, "No data", theme.Axis, anchorMiddle)
+		return
+	}
+	if !end.After(start) {
+		start, end = start.Add(-30*time.Minute), end.Add(30*time.Minute)
+	}
+
+	yTicks := niceTicks(minV, maxV, 5)
+	yMin, yMax := yTicks[0], yTicks[len(yTicks)-1]
+
+	xPos := func(t time.Time) float64 {
+		return plotX + float64(t.Sub(start))/float64(end.Sub(start))*plotW
+	}
+	yPos := func(v float64) float64 {
+		return plotY + plotH - (v-yMin)/(yMax-yMin)*plotH
+	}
+
+	// Bands are clipped to the plotted value range
+	for _, b := range c.Bands {
+		low, high := math.Max(b.Low, yMin), math.Min(b.High, yMax)
+		if low >= high {
+			continue
+		}
+		canvas.fillRect(plotX, yPos(high), plotW, yPos(low)-yPos(high), blendColor(b.Color, theme.Background, chartBandOpacity))
+	}
+
+	for _, v := range yTicks {
+		y := yPos(v)
+		canvas.line(plotX, y, plotX+plotW, y, theme.Grid, 1)
+		canvas.text(plotX-6, y, formatTickValue(v), theme.Text, anchorEnd)
+	}
+
+	// Leave room for the widest "Jan 2 15:04" labels
+	xTicks, format := timeTicks(start, end, int(math.Max(2, plotW/110)), loc)
+	for _, t := range xTicks {
+		x := xPos(t)
+		canvas.line(x, plotY, x, plotY+plotH, theme.Grid, 1)
+		canvas.text(x, plotY+plotH+14, t.In(loc).Format(format), theme.Text, anchorMiddle)
+	}
+
+	canvas.line(plotX, plotY+plotH, plotX+plotW, plotY+plotH, theme.Axis, 1)
+	canvas.line(plotX, plotY, plotX, plotY+plotH, theme.Axis, 1)
+
+	for i, s := range c.Series {
+		col := seriesColor(s, i)
+		var segment [][2]float64
+		for j, p := range s.Points {
+			if j > 0 && c.MaxGap > 0 && p.Time.Sub(s.Points[j-1].Time) > c.MaxGap {
+				canvas.polyline(segment, col, chartLineWidth)
+				segment = nil
+			}
+			segment = append(segment, [2]float64{xPos(p.Time), yPos(p.Value)})
+		}
+		canvas.polyline(segment, col, chartLineWidth)
+	}
+}
+
+// RenderPNG draws the chart as a PNG image
+func (c *Chart) RenderPNG(w io.Writer) error {
+	canvas := &pngCanvas{img: image.NewRGBA(image.Rect(0, 0, c.Width, c.Height))}
+	c.draw(canvas)
+	if err := png.Encode(w, canvas.img); err != nil {
+		return fmt.Errorf("failed to encode chart: %w", err)
+	}
+	return nil
+}
+
+// RenderSVG draws the chart as an SVG document
+func (c *Chart) RenderSVG(w io.Writer) error {
+	canvas := &svgCanvas{}
+	fmt.Fprintf(&canvas.buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="DejaVu Sans Mono, Menlo, Consolas, monospace" font-size="12">`+"\n",
+		c.Width, c.Height, c.Width, c.Height)
+	c.draw(canvas)
+	canvas.buf.WriteString("</svg>\n")
+
+	if _, err := canvas.buf.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to write chart: %w", err)
+	}
+	return nil
+}
+
+// svgCanvas collects SVG elements. The 12px monospace font is close to the 7px glyphs
+// the legend layout assumes.
+type svgCanvas struct {
+	buf bytes.Buffer
+}
+
+func (s *svgCanvas) fillRect(x, y, w, h float64, c color.RGBA) {
+	fmt.Fprintf(&s.buf, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n", x, y, w, h, hexColor(c))
+}
+
+func (s *svgCanvas) line(x1, y1, x2, y2 float64, c color.RGBA, width float64) {
+	fmt.Fprintf(&s.buf, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s" stroke-width="%g"/>`+"\n",
+		x1, y1, x2, y2, hexColor(c), width)
+}
+
+func (s *svgCanvas) polyline(points [][2]float64, c color.RGBA, width float64) {
+	if len(points) == 1 {
+		fmt.Fprintf(&s.buf, `<circle cx="%.1f" cy="%.1f" r="%g" fill="%s"/>`+"\n", points[0][0], points[0][1], width, hexColor(c))
+		return
+	}
+	if len(points) == 0 {
+		return
+	}
+
+	s.buf.WriteString(`<polyline fill="none" stroke-linejoin="round" points="`)
+	for i, p := range points {
+		if i > 0 {
+			s.buf.WriteByte(' ')
+		}
+		fmt.Fprintf(&s.buf, "%.1f,%.1f", p[0], p[1])
+	}
+	fmt.Fprintf(&s.buf, `" stroke="%s" stroke-width="%g"/>`+"\n", hexColor(c), width)
+}
+
+func (s *svgCanvas) text(x, y float64, str string, c color.RGBA, anchor textAnchor) {
+	anchors := map[textAnchor]string{anchorStart: "start", anchorMiddle: "middle", anchorEnd: "end"}
+	fmt.Fprintf(&s.buf, `<text x="%.1f" y="%.1f" fill="%s" text-anchor="%s" dominant-baseline="central">`,
+		x, y, hexColor(c), anchors[anchor])
+	xml.EscapeText(&s.buf, []byte(str))
+	s.buf.WriteString("</text>\n")
+}
+
+// pngCanvas draws onto an in-memory image
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func (p *pngCanvas) fillRect(x, y, w, h float64, c color.RGBA) {
+	r := image.Rect(int(math.Round(x)), int(math.Round(y)), int(math.Round(x+w)), int(math.Round(y+h)))
+	draw.Draw(p.img, r, image.NewUniform(c), image.Point{}, draw.Over)
+}
+
+// line stamps a square brush along the segment, which is enough for thin chart lines
+func (p *pngCanvas) line(x1, y1, x2, y2 float64, c color.RGBA, width float64) {
+	steps := int(math.Max(math.Abs(x2-x1), math.Abs(y2-y1))*2) + 1
+	half := width / 2
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		x := x1 + (x2-x1)*t
+		y := y1 + (y2-y1)*t
+		p.fillRect(math.Floor(x-half+0.5), math.Floor(y-half+0.5), width, width, c)
+	}
+}
+
+func (p *pngCanvas) polyline(points [][2]float64, c color.RGBA, width float64) {
+	if len(points) == 1 {
+		p.fillRect(points[0][0]-width, points[0][1]-width, width*2, width*2, c)
+	}
+	for i := 1; i < len(points); i++ {
+		p.line(points[i-1][0], points[i-1][1], points[i][0], points[i][1], c, width)
+	}
+}
+
+func (p *pngCanvas) text(x, y float64, s string, c color.RGBA, anchor textAnchor) {
+	face := basicfont.Face7x13
+	d := &font.Drawer{Dst: p.img, Src: image.NewUniform(c), Face: face}
+
+	switch anchor {
+	case anchorMiddle:
+		x -= float64(d.MeasureString(s).Round()) / 2
+	case anchorEnd:
+		x -= float64(d.MeasureString(s).Round())
+	}
+	d.Dot = fixed.P(int(math.Round(x)), int(math.Round(y))+face.Ascent/2)
+	d.DrawString(s)
+}
+
+// Chart image sizes accepted by the chart endpoints, in pixels
+const (
+	defaultChartWidth  = 800
+	defaultChartHeight = 400
+	minChartWidth      = 200
+	minChartHeight     = 150
+	maxChartWidth      = 2000
+	maxChartHeight     = 1200
+)
+
+// chartAQIFields and chartPM25Fields are the fields AQI bands can be drawn behind, on
+// the AQI scale and in µg/m³ respectively
+var (
+	chartAQIFields  = map[string]bool{"pm25_aqi": true, "pm25_aqi_b": true}
+	chartPM25Fields = map[string]bool{"pm25_cf1": true, "pm25_cf1_b": true, "pm25_atm": true, "pm25_atm_b": true}
+)
+
+// ChartRequest describes a chart requested from /api/chart.png or /api/chart.svg
+type ChartRequest struct {
+	Range    TimeRange
+	Fields   []string
+	Sensors  []string
+	Title    string
+	Width    int
+	Height   int
+	Theme    *ChartTheme
+	Bands    []ChartBand
+	Location *time.Location
+}
+
+// parseChartRequest reads chart parameters:
+//   - fields: numeric measurement fields to plot (default pm25_cf1)
+//   - sensor: comma separated sensor IDs (default all sensors)
+//   - start/end/hours/tz: the time range, as for /api/measurements; tz also sets the axis labels
+//   - width/height: image size in pixels, clamped to the supported range
+//   - theme: light (default) or dark
+//   - bands: "aqi" shades the background by AQI category, for PM2.5 or AQI fields
+//   - title: chart title (default the field names)
+func parseChartRequest(query url.Values) (*ChartRequest, error) {
+	timeRange, err := parseTimeRange(query, 24)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := parseLocation(query)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &ChartRequest{
+		Range:    timeRange,
+		Title:    query.Get("title"),
+		Width:    defaultChartWidth,
+		Height:   defaultChartHeight,
+		Theme:    chartLightTheme,
+		Location: loc,
+	}
+
+	numeric := make(map[string]bool, len(numericMeasurementFields))
+	for _, f := range numericMeasurementFields {
+		numeric[f] = true
+	}
+	seen := make(map[string]bool)
+	for _, f := range strings.Split(query.Get("fields"), ",") {
+		f = strings.TrimSpace(f)
+		if f == "" || seen[f] {
+			continue
+		}
+		if !numeric[f] {
+			return nil, fmt.Errorf("unknown or non-numeric field: %s", f)
+		}
+		seen[f] = true
+		req.Fields = append(req.Fields, f)
+	}
+	if len(req.Fields) == 0 {
+		req.Fields = []string{"pm25_cf1"}
+	}
+	if req.Title == "" {
+		req.Title = strings.Join(req.Fields, ", ")
+	}
+
+	for _, id := range strings.Split(query.Get("sensor"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			req.Sensors = append(req.Sensors, id)
+		}
+	}
+
+	size := func(name string, dest *int, min, max int) error {
+		value := query.Get(name)
+		if value == "" {
+			return nil
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid %s %q", name, value)
+		}
+		*dest = int(math.Min(math.Max(float64(parsed), float64(min)), float64(max)))
+		return nil
+	}
+	if err := size("width", &req.Width, minChartWidth, maxChartWidth); err != nil {
+		return nil, err
+	}
+	if err := size("height", &req.Height, minChartHeight, maxChartHeight); err != nil {
+		return nil, err
+	}
+
+	if name := query.Get("theme"); name != "" {
+		theme, ok := chartThemes[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid theme %q: expected light or dark", name)
+		}
+		req.Theme = theme
+	}
+
+	switch query.Get("bands") {
+	case "":
+	case "aqi":
+		if req.Bands = aqiBands(req.Fields); req.Bands == nil {
+			return nil, fmt.Errorf("AQI bands need only PM2.5 or only AQI fields")
+		}
+	default:
+		return nil, fmt.Errorf("invalid bands %q: expected aqi", query.Get("bands"))
+	}
+	return req, nil
+}
+
+// aqiBands returns the AQI category bands on the scale of fields, or nil unless all the
+// fields are PM2.5 concentrations or all are AQI values
+func aqiBands(fields []string) []ChartBand {
+	allAQI, allPM25 := true, true
+	for _, f := range fields {
+		allAQI = allAQI && chartAQIFields[f]
+		allPM25 = allPM25 && chartPM25Fields[f]
+	}
+	if !allAQI && !allPM25 {
+		return nil
+	}
+
+	bands := make([]ChartBand, len(pm25Breakpoints))
+	low := 0.0
+	for i, bp := range pm25Breakpoints {
+		high := bp.concHigh
+		if allAQI {
+			high = float64(bp.aqiHigh)
+		}
+		if i == len(pm25Breakpoints)-1 {
+			high = math.Inf(1)
+		}
+		bands[i] = ChartBand{Low: low, High: high, Color: aqiCategoryColors[i]}
+		low = high
+	}
+	return bands
+}
+
+// chartBucket accumulates the readings of one series in one bucket
+type chartBucket struct {
+	index int64
+	count int
+	sum   float64
+}
+
+// point returns the bucket's mean, placed at the middle of the bucket
+func (b *chartBucket) point(start time.Time, bucket time.Duration) ChartPoint {
+	return ChartPoint{
+		Time:  start.Add(time.Duration(b.index)*bucket + bucket/2),
+		Value: b.sum / float64(b.count),
+	}
+}
+
+// bucket returns the span of time drawn in one pixel column, or 0 when the range is
+// open-ended and readings are drawn as they are
+func (r *ChartRequest) bucket() time.Duration {
+	if r.Range.Start.IsZero() || r.Range.End.IsZero() || r.Width <= 0 {
+		return 0
+	}
+	return r.Range.End.Sub(r.Range.Start) / time.Duration(r.Width)
+}
+
+// build queries the requested measurements and lays them out as a chart, with one
+// series per sensor and field
+func (r *ChartRequest) build(database Storage) (*Chart, error) {
+	q := MeasurementQuery{
+		Range:  r.Range,
+		Fields: append([]string{"observed_at", "sensor_id"}, r.Fields...),
+	}
+	wanted := make(map[string]bool, len(r.Sensors))
+	for _, id := range r.Sensors {
+		wanted[id] = true
+	}
+	if len(r.Sensors) == 1 {
+		q.SensorID = r.Sensors[0]
+	}
+
+	// Readings are averaged into buckets about a pixel column wide, so a long range
+	// costs no more memory than the image has columns
+	bucket := r.bucket()
+	points := make(map[string][][]ChartPoint)
+	buckets := make(map[string][]chartBucket)
+	err := database.QueryMeasurements(q, func(values []interface{}) error {
+		sensorID := scannedString(values[1])
+		if len(wanted) > 0 && !wanted[sensorID] {
+			return nil
+		}
+		observed, err := scannedTime(values[0])
+		if err != nil {
+			return err
+		}
+
+		series := points[sensorID]
+		if series == nil {
+			series = make([][]ChartPoint, len(r.Fields))
+			points[sensorID] = series
+			buckets[sensorID] = make([]chartBucket, len(r.Fields))
+		}
+		for i := range r.Fields {
+			v, ok := numericValue(values[i+2])
+			if !ok {
+				continue
+			}
+			if bucket <= 0 {
+				series[i] = append(series[i], ChartPoint{Time: observed, Value: v})
+				continue
+			}
+			b := &buckets[sensorID][i]
+			index := int64(observed.Sub(r.Range.Start) / bucket)
+			if b.count > 0 && index != b.index {
+				series[i] = append(series[i], b.point(r.Range.Start, bucket))
+				b.count, b.sum = 0, 0
+			}
+			b.index = index
+			b.count++
+			b.sum += v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chart data: %w", err)
+	}
+	for id, series := range buckets {
+		for i := range series {
+			if series[i].count > 0 {
+				points[id][i] = append(points[id][i], series[i].point(r.Range.Start, bucket))
+			}
+		}
+	}
+
+	chart := &Chart{
+		Title:    r.Title,
+		Bands:    r.Bands,
+		Width:    r.Width,
+		Height:   r.Height,
+		Location: r.Location,
+		Theme:    r.Theme,
+		// Neighbouring buckets are a bucket apart even when no reading is missing
+		MaxGap: defaultMaxSampleGap + bucket,
+	}
+
+	sensors := make([]string, 0, len(points))
+	for id := range points {
+		sensors = append(sensors, id)
+	}
+	sort.Strings(sensors)
+	for _, id := range sensors {
+		for i, field := range r.Fields {
+			label := field
+			switch {
+			case len(sensors) > 1 && len(r.Fields) > 1:
+				label = id + " " + field
+			case len(sensors) > 1:
+				label = id
+			}
+			chart.Series = append(chart.Series, ChartSeries{Label: label, Points: points[id][i]})
+		}
+	}
+	return chart, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChartBucketsLongRanges(t *testing.T) {
+	database := NewMemoryDatabase(40000)
+	end := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	start := end.AddDate(-1, 0, 0)
+	var batch []*AirQualityData
+	for at := start; at.Before(end); at = at.Add(30 * time.Minute) {
+		batch = append(batch, testMeasurement("a", at, 10, 10), testMeasurement("b", at, 20, 20))
+	}
+	if err := database.StoreMeasurements(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &ChartRequest{Range: TimeRange{Start: start, End: end}, Fields: []string{"pm25_cf1"}, Width: 800, Height: 400, Location: time.UTC}
+	chart, err := r.build(database)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if len(chart.Series) != 2 {
+		t.Fatalf("chart has %d series, want one per sensor", len(chart.Series))
+	}
+	for i, want := range []float64{10, 20} {
+		series := chart.Series[i]
+		if len(series.Points) > r.Width || len(series.Points) < r.Width-1 {
+			t.Errorf("%s has %d points from %d readings, want about %d", series.Label, len(series.Points), len(batch)/2, r.Width)
+		}
+		for _, p := range series.Points {
+			if p.Value != want || p.Time.Before(start) || !p.Time.Before(end) {
+				t.Fatalf("%s has point %+v, want %g within the range", series.Label, p, want)
+			}
+		}
+	}
+	// Readings every 30 minutes are continuous, though buckets are 11 hours apart
+	if chart.MaxGap <= r.bucket() {
+		t.Errorf("MaxGap %s breaks the line between neighbouring buckets of %s", chart.MaxGap, r.bucket())
+	}
+
+	// Over a short range each reading is its own point
+	r.Range = TimeRange{Start: start, End: start.Add(6 * time.Hour)}
+	chart, err = r.build(database)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if len(chart.Series[0].Points) != 12 {
+		t.Errorf("6 hours of readings every 30 minutes gave %d points, want 12", len(chart.Series[0].Points))
+	}
+}
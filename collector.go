@@ -0,0 +1,630 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultCollectionInterval is how often each sensor is read when no interval is configured
+	defaultCollectionInterval = 5 * time.Minute
+
+	// minCollectionInterval keeps a misconfigured interval from flooding a sensor, which
+	// only refreshes its readings every two minutes anyway
+	minCollectionInterval = 10 * time.Second
+
+	// maxRecentGaps is how many missed or failed ticks each collector remembers
+	maxRecentGaps = 20
+)
+
+// Reasons a tick left a gap in the measurements
+const (
+	gapMissed = "missed"
+	gapFailed = "failed"
+)
+
+// CollectionConfig controls which sensors are read in the background and how often
+type CollectionConfig struct {
+	// Interval is the default time between readings, such as "2m". When unset,
+	// server.refresh_interval (seconds) is used, and otherwise five minutes.
+	Interval string `json:"interval"`
+
+	// Jitter delays each reading by a random amount up to this duration after its tick,
+	// so many sensors on one network aren't all read at the same instant
+	Jitter string `json:"jitter"`
+
+	// Sensors are the devices to collect from. When empty, the device given on the
+	// command line is collected.
+	Sensors []SensorConfig `json:"sensors"`
+
+	// Discovery finds sensors configured by sensor_id on the network
+	Discovery DiscoveryConfig `json:"discovery"`
+
+	interval time.Duration
+	jitter   time.Duration
+}
+
+// SensorConfig is a sensor to collect from, by URL or by sensor ID
+type SensorConfig struct {
+	// Name identifies the sensor in logs and health checks; it defaults to the URL's
+	// host, or the sensor ID
+	Name string `json:"name"`
+	URL  string `json:"url"`
+
+	// SensorID, the sensor's MAC address, makes discovery keep track of the sensor's
+	// address. URL is then optional and only used until the sensor is found.
+	SensorID string `json:"sensor_id"`
+
+	// Interval overrides the default collection interval for this sensor
+	Interval string `json:"interval"`
+
+	interval time.Duration
+}
+
+// ServerConfig holds settings from the config file's server section
+type ServerConfig struct {
+	// RefreshInterval is the default collection interval in seconds
+	RefreshInterval int `json:"refresh_interval"`
+}
+
+// validate parses the intervals, filling in defaults
+func (c *CollectionConfig) validate(refreshInterval int) error {
+	var err error
+	switch {
+	case c.Interval != "":
+		if c.interval, err = parseCollectionInterval(c.Interval); err != nil {
+			return fmt.Errorf("collection.interval: %w", err)
+		}
+	case refreshInterval < 0:
+		return fmt.Errorf("server.refresh_interval can't be negative")
+	case refreshInterval > 0:
+		c.interval = time.Duration(refreshInterval) * time.Second
+		if c.interval < minCollectionInterval {
+			return fmt.Errorf("server.refresh_interval must be at least %d seconds", int(minCollectionInterval.Seconds()))
+		}
+	default:
+		c.interval = defaultCollectionInterval
+	}
+
+	if c.Jitter != "" {
+		if c.jitter, err = time.ParseDuration(c.Jitter); err != nil || c.jitter < 0 {
+			return fmt.Errorf("invalid collection.jitter %q: expected a duration such as 15s", c.Jitter)
+		}
+	}
+	if c.jitter >= c.interval {
+		return fmt.Errorf("collection.jitter must be shorter than the collection interval")
+	}
+
+	if err := c.Discovery.validate(); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Sensors {
+		sensor := &c.Sensors[i]
+		switch {
+		case sensor.URL != "":
+			u, err := url.Parse(sensor.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("sensor %d: invalid url %q", i+1, sensor.URL)
+			}
+		case sensor.SensorID == "":
+			return fmt.Errorf("sensor %d needs a url or a sensor_id", i+1)
+		case !c.Discovery.enabled():
+			return fmt.Errorf("sensor %d has no url, so it needs collection.discovery to find it", i+1)
+		}
+		if sensor.Name == "" {
+			sensor.Name = sensor.SensorID
+			if sensor.URL != "" {
+				sensor.Name = hostName(sensor.URL)
+			}
+		}
+		if names[sensor.Name] {
+			return fmt.Errorf("duplicate sensor name %q", sensor.Name)
+		}
+		names[sensor.Name] = true
+
+		sensor.interval = c.interval
+		if sensor.Interval != "" {
+			if sensor.interval, err = parseCollectionInterval(sensor.Interval); err != nil {
+				return fmt.Errorf("sensor %q: %w", sensor.Name, err)
+			}
+		}
+		if c.jitter >= sensor.interval {
+			return fmt.Errorf("sensor %q: collection.jitter must be shorter than the interval", sensor.Name)
+		}
+	}
+	return nil
+}
+
+// parseCollectionInterval parses a collection interval such as "2m"
+func parseCollectionInterval(value string) (time.Duration, error) {
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %q: expected a duration such as 2m", value)
+	}
+	if interval < minCollectionInterval {
+		return 0, fmt.Errorf("interval %s is shorter than the minimum of %s", interval, minCollectionInterval)
+	}
+	return interval, nil
+}
+
+// sensorsOrDefault returns the configured sensors, or the device given on the command
+// line if there are none
+func (c *CollectionConfig) sensorsOrDefault(deviceURL string) []SensorConfig {
+	if len(c.Sensors) > 0 {
+		return c.Sensors
+	}
+	return []SensorConfig{{Name: hostName(deviceURL), URL: deviceURL, interval: c.interval}}
+}
+
+// hostName returns the host of a sensor URL, which names the sensor when no name is configured
+func hostName(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return rawURL
+}
+
+// CollectionGap is a tick that stored no measurement
+type CollectionGap struct {
+	Tick   time.Time `json:"tick"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Collector reads one sensor in the background and stores each reading. Ticks are
+// aligned to wall-clock multiples of the interval, so a 5m interval reads at :00, :05,
+// :10 and so on whenever the server was started, and readings from different sensors
+// and restarts fall into the same buckets. Collection can be paused, and the interval
+// changed, while it runs.
+type Collector struct {
+	Name   string
+	Device *Device
+
+	// reschedule wakes Run to work out the next tick again after the interval changes
+	// or the collector is paused or resumed
+	reschedule chan struct{}
+
+	// cancel stops Run; it is set when the server starts the collector
+	cancel func()
+
+	mu            sync.Mutex
+	interval      time.Duration
+	jitter        time.Duration
+	paused        bool
+	started       time.Time
+	lastRun       time.Time
+	lastError     string
+	lastCollected time.Time
+	nextRun       time.Time
+	collected     int64
+	failed        int64
+	missed        int64
+	gaps          []CollectionGap
+}
+
+// CollectorStatus reports what a collector has done and will do next
+type CollectorStatus struct {
+	Name            string          `json:"name"`
+	URL             string          `json:"url"`
+	IntervalSeconds int             `json:"interval_seconds"`
+	Paused          bool            `json:"paused"`
+	LastRun         *time.Time      `json:"last_run,omitempty"`
+	LastError       string          `json:"last_error,omitempty"`
+	LastCollected   *time.Time      `json:"last_collected,omitempty"`
+	NextRun         *time.Time      `json:"next_run,omitempty"`
+	Collected       int64           `json:"collected"`
+	Failed          int64           `json:"failed"`
+	Missed          int64           `json:"missed"`
+	RecentGaps      []CollectionGap `json:"recent_gaps,omitempty"`
+}
+
+// NewCollector creates a collector for a device
+func NewCollector(name string, device *Device, interval, jitter time.Duration) *Collector {
+	return &Collector{
+		Name:       name,
+		Device:     device,
+		reschedule: make(chan struct{}, 1),
+		interval:   interval,
+		jitter:     jitter,
+	}
+}
+
+// nextTick returns the first multiple of interval after now
+func nextTick(now time.Time, interval time.Duration) time.Time {
+	return now.Truncate(interval).Add(interval)
+}
+
+// Run collects on every tick until stop is closed. It also collects once at startup,
+// rather than leaving a gap of up to a whole interval before the first tick.
+func (c *Collector) Run(database Storage, stop <-chan struct{}) {
+	c.mu.Lock()
+	c.started = time.Now()
+	interval, jitter, paused := c.interval, c.jitter, c.paused
+	c.mu.Unlock()
+	slog.Info("Starting data collection", "sensor", c.Name, "url", c.Device.URL(),
+		"interval", interval.String(), "jitter", jitter.String(), "paused", paused)
+
+	// A sensor discovery hasn't found yet is first read at the next tick
+	if !paused && c.Device.URL() != "" {
+		c.collectTick(database, time.Now())
+	}
+	tick := nextTick(time.Now(), interval)
+	for {
+		interval, paused := c.schedule()
+
+		// A paused collector only waits to be resumed or stopped
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if !paused {
+			at := tick.Add(c.delay())
+			timer = time.NewTimer(time.Until(at))
+			fire = timer.C
+			c.setNextRun(at)
+		} else {
+			c.setNextRun(time.Time{})
+		}
+
+		select {
+		case <-fire:
+		case <-c.reschedule:
+			if timer != nil {
+				timer.Stop()
+			}
+			// Ticks skipped while paused aren't gaps; collection starts again at the
+			// next tick
+			tick = nextTick(time.Now(), c.Interval())
+			continue
+		case <-stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			slog.Info("Stopping data collection", "sensor", c.Name)
+			return
+		}
+
+		// Ticks that passed while a slow reading ran or the machine was suspended can't
+		// be made up, so they are recorded as gaps
+		latest := time.Now().Truncate(interval)
+		for ; tick.Before(latest); tick = tick.Add(interval) {
+			c.recordGap(CollectionGap{Tick: tick, Reason: gapMissed})
+			slog.Warn("Missed collection tick", "sensor", c.Name, "tick", tick)
+		}
+		c.collectTick(database, tick)
+		tick = tick.Add(interval)
+	}
+}
+
+// schedule returns the current interval and whether collection is paused
+func (c *Collector) schedule() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.interval, c.paused
+}
+
+// setNextRun records when the next reading is due, or that none is while paused
+func (c *Collector) setNextRun(at time.Time) {
+	c.mu.Lock()
+	c.nextRun = at
+	c.mu.Unlock()
+}
+
+// delay returns a random delay of up to the jitter
+func (c *Collector) delay() time.Duration {
+	c.mu.Lock()
+	jitter := c.jitter
+	c.mu.Unlock()
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// collectTick collects for a scheduled tick, recording a gap if nothing was stored
+func (c *Collector) collectTick(database Storage, tick time.Time) {
+	// Each collection gets its own correlation ID, like a request
+	ctx := withRequestID(context.Background(), newRequestID())
+	if _, err := c.Collect(ctx, database); err != nil {
+		c.recordGap(CollectionGap{Tick: tick, Reason: gapFailed, Error: err.Error()})
+	}
+}
+
+// Collect reads the sensor now and stores the measurement. The measurement is returned
+// even if it couldn't be stored; it is nil if the sensor couldn't be read.
+func (c *Collector) Collect(ctx context.Context, database Storage) (*AirQualityData, error) {
+	if database == nil {
+		slog.WarnContext(ctx, "Database not available, skipping data collection", "sensor", c.Name)
+		return nil, fmt.Errorf("database not available")
+	}
+
+	data, err := c.Device.Fetch(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error collecting data", "sensor", c.Name, "error", err)
+		c.recordRun(err)
+		return nil, err
+	}
+
+	if err := database.StoreMeasurement(data); err != nil {
+		slog.ErrorContext(ctx, "Error storing measurement", "sensor", c.Name, "error", err)
+		err = fmt.Errorf("failed to store measurement: %w", err)
+		c.recordRun(err)
+		return data, err
+	}
+	c.recordRun(nil)
+
+	slog.InfoContext(ctx, "Data collected and stored",
+		"sensor", c.Name, "sensor_id", data.SensorId, "pm25_aqi", data.Pm25Aqi, "temp_f", data.CurrentTempF, "humidity", data.CurrentHumidity)
+	return data, nil
+}
+
+// recordRun notes the outcome of a collection
+func (c *Collector) recordRun(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = time.Now()
+	if err != nil {
+		c.lastError = err.Error()
+		return
+	}
+	c.lastError = ""
+	c.lastCollected = c.lastRun
+	c.collected++
+}
+
+// recordGap counts a tick that stored nothing and remembers it among the recent gaps
+func (c *Collector) recordGap(gap CollectionGap) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gap.Reason == gapMissed {
+		c.missed++
+	} else {
+		c.failed++
+	}
+	c.gaps = append(c.gaps, gap)
+	if len(c.gaps) > maxRecentGaps {
+		c.gaps = c.gaps[len(c.gaps)-maxRecentGaps:]
+	}
+}
+
+// Interval returns the time between readings
+func (c *Collector) Interval() time.Duration {
+	interval, _ := c.schedule()
+	return interval
+}
+
+// SetInterval changes the time between readings, starting from the next tick of the
+// new interval
+func (c *Collector) SetInterval(interval time.Duration) error {
+	c.mu.Lock()
+	jitter := c.jitter
+	c.mu.Unlock()
+	return c.SetSchedule(interval, jitter)
+}
+
+// SetSchedule changes the time between readings and the jitter, starting from the next
+// tick of the new interval
+func (c *Collector) SetSchedule(interval, jitter time.Duration) error {
+	if interval < minCollectionInterval {
+		return fmt.Errorf("interval %s is shorter than the minimum of %s", interval, minCollectionInterval)
+	}
+	if jitter >= interval {
+		return fmt.Errorf("interval %s must be longer than the jitter of %s", interval, jitter)
+	}
+
+	c.mu.Lock()
+	c.interval = interval
+	c.jitter = jitter
+	if !c.paused {
+		c.nextRun = nextTick(time.Now(), interval)
+	}
+	c.mu.Unlock()
+	c.wake()
+	return nil
+}
+
+// Pause stops scheduled collection until Resume is called. Collect still works.
+func (c *Collector) Pause() {
+	c.mu.Lock()
+	c.paused = true
+	c.nextRun = time.Time{}
+	c.mu.Unlock()
+	c.wake()
+}
+
+// Resume restarts scheduled collection from the next tick
+func (c *Collector) Resume() {
+	c.mu.Lock()
+	c.paused = false
+	c.nextRun = nextTick(time.Now(), c.interval)
+	c.mu.Unlock()
+	c.wake()
+}
+
+// wake tells Run the schedule changed, without waiting if it already has been told
+func (c *Collector) wake() {
+	select {
+	case c.reschedule <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns a snapshot of the collector's progress
+func (c *Collector) Status() CollectorStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := CollectorStatus{
+		Name:            c.Name,
+		URL:             c.Device.URL(),
+		IntervalSeconds: int(c.interval.Seconds()),
+		Paused:          c.paused,
+		LastError:       c.lastError,
+		Collected:       c.collected,
+		Failed:          c.failed,
+		Missed:          c.missed,
+		RecentGaps:      append([]CollectionGap(nil), c.gaps...),
+	}
+	if !c.lastRun.IsZero() {
+		lastRun := c.lastRun
+		status.LastRun = &lastRun
+	}
+	if !c.lastCollected.IsZero() {
+		lastCollected := c.lastCollected
+		status.LastCollected = &lastCollected
+	}
+	if !c.nextRun.IsZero() {
+		nextRun := c.nextRun
+		status.NextRun = &nextRun
+	}
+	return status
+}
+
+// startedAt returns when Run started, or the zero time if it hasn't
+func (c *Collector) startedAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.started
+}
+
+// collectorList returns the running collectors
+func (s *Server) collectorList() []*Collector {
+	s.collectorsMu.RLock()
+	defer s.collectorsMu.RUnlock()
+	return append([]*Collector(nil), s.collectors...)
+}
+
+// collector returns the collector with a name, or nil
+func (s *Server) collector(name string) *Collector {
+	for _, c := range s.collectorList() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// collectorFromPath returns the collector named in the request path, sending a 404 if
+// there is none
+func (s *Server) collectorFromPath(w http.ResponseWriter, r *http.Request) *Collector {
+	name := mux.Vars(r)["name"]
+	c := s.collector(name)
+	if c == nil {
+		writeError(w, r, http.StatusNotFound, errNotFound, fmt.Sprintf("No collector named %q", name))
+	}
+	return c
+}
+
+// writeCollectorStatus sends a collector's status
+func writeCollectorStatus(w http.ResponseWriter, c *Collector) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Status())
+}
+
+// handleListCollectors serves the status of every collector
+func (s *Server) handleListCollectors(w http.ResponseWriter, r *http.Request) {
+	collectors := s.collectorList()
+	statuses := make([]CollectorStatus, len(collectors))
+	for i, c := range collectors {
+		statuses[i] = c.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"collectors": statuses})
+}
+
+// handleGetCollector serves the status of one collector
+func (s *Server) handleGetCollector(w http.ResponseWriter, r *http.Request) {
+	if c := s.collectorFromPath(w, r); c != nil {
+		writeCollectorStatus(w, c)
+	}
+}
+
+// handlePauseCollector pauses scheduled collection from a sensor
+func (s *Server) handlePauseCollector(w http.ResponseWriter, r *http.Request) {
+	c := s.collectorFromPath(w, r)
+	if c == nil {
+		return
+	}
+	c.Pause()
+	slog.InfoContext(r.Context(), "Collection paused", "sensor", c.Name)
+	writeCollectorStatus(w, c)
+}
+
+// handleResumeCollector resumes scheduled collection from a sensor
+func (s *Server) handleResumeCollector(w http.ResponseWriter, r *http.Request) {
+	c := s.collectorFromPath(w, r)
+	if c == nil {
+		return
+	}
+	c.Resume()
+	slog.InfoContext(r.Context(), "Collection resumed", "sensor", c.Name)
+	writeCollectorStatus(w, c)
+}
+
+// handleTriggerCollection reads a sensor and stores the measurement now
+func (s *Server) handleTriggerCollection(w http.ResponseWriter, r *http.Request) {
+	c := s.collectorFromPath(w, r)
+	if c == nil {
+		return
+	}
+	if s.database == nil {
+		databaseUnavailable(w, r)
+		return
+	}
+
+	data, err := c.Collect(r.Context(), s.storage(r))
+	if data == nil && err != nil {
+		s.deviceError(w, r, c.Device, err)
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errInternal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"collector":   c.Status(),
+		"measurement": data,
+	})
+}
+
+// handleSetCollectorInterval changes how often a sensor is read, from a body like
+// {"interval": "2m"}
+func (s *Server) handleSetCollectorInterval(w http.ResponseWriter, r *http.Request) {
+	c := s.collectorFromPath(w, r)
+	if c == nil {
+		return
+	}
+
+	var body struct {
+		Interval string `json:"interval"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+		writeError(w, r, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	interval, err := time.ParseDuration(body.Interval)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("Invalid interval %q: expected a duration such as 2m", body.Interval))
+		return
+	}
+	if err := c.SetInterval(interval); err != nil {
+		writeError(w, r, http.StatusBadRequest, errInvalidRequest, err.Error())
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Collection interval changed", "sensor", c.Name, "interval", interval.String())
+	writeCollectorStatus(w, c)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config holds the settings read from config.json. Settings that predate the file are
+// still read from environment variables.
+type Config struct {
+	Server     ServerConfig     `json:"server"`
+	Collection CollectionConfig `json:"collection"`
+	SMTP       SMTPConfig       `json:"smtp"`
+	Reports    []ReportConfig   `json:"reports"`
+	Auth       AuthConfig       `json:"auth"`
+	TLS        TLSConfig        `json:"tls"`
+	RateLimit  RateLimitConfig  `json:"rate_limit"`
+	Logging    LoggingConfig    `json:"logging"`
+}
+
+// AuthConfig controls API key authentication and cross-origin access
+type AuthConfig struct {
+	// Enabled requires an API key for every request except health checks
+	Enabled bool `json:"enabled"`
+
+	// PublicRead lets read-only requests, including the dashboard pages, through
+	// without a key when authentication is enabled
+	PublicRead bool `json:"public_read"`
+
+	// CORSOrigins are the origins, such as https://wiki.example.com, allowed to call
+	// the API from a browser; "*" allows any origin
+	CORSOrigins []string `json:"cors_origins"`
+}
+
+// SMTPConfig is the mail server used to send reports
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+
+	// TLS connects with implicit TLS (usually port 465) instead of upgrading a plain
+	// connection with STARTTLS when the server offers it
+	TLS bool `json:"tls"`
+}
+
+// ReportConfig describes a scheduled email report
+type ReportConfig struct {
+	Name     string   `json:"name"`
+	Schedule string   `json:"schedule"`
+	Period   string   `json:"period"`
+	To       []string `json:"to"`
+	Sensor   string   `json:"sensor"`
+	Timezone string   `json:"timezone"`
+
+	schedule *CronSchedule
+	location *time.Location
+}
+
+// configPath returns the config file location from CONFIG_PATH, defaulting to config.json
+func configPath() string {
+	if path := os.Getenv("CONFIG_PATH"); path != "" {
+		return path
+	}
+	return "config.json"
+}
+
+// LoadConfig reads and validates a config file. A missing file is not an error and
+// yields an empty configuration.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{Auth: AuthConfig{PublicRead: true}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Still fill in the defaults
+		return cfg, cfg.validate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// validate checks the configuration and prepares parsed values
+func (c *Config) validate() error {
+	if c.SMTP.Port == 0 {
+		c.SMTP.Port = 25
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Reports {
+		r := &c.Reports[i]
+		if r.Name == "" {
+			return fmt.Errorf("report %d has no name", i+1)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate report name %q", r.Name)
+		}
+		names[r.Name] = true
+
+		schedule, err := ParseCronSchedule(r.Schedule)
+		if err != nil {
+			return fmt.Errorf("report %q: %w", r.Name, err)
+		}
+		r.schedule = schedule
+
+		switch r.Period {
+		case reportDaily, reportWeekly, reportMonthly:
+		default:
+			return fmt.Errorf("report %q: period must be %s, %s or %s", r.Name, reportDaily, reportWeekly, reportMonthly)
+		}
+
+		if len(r.To) == 0 {
+			return fmt.Errorf("report %q has no recipients", r.Name)
+		}
+
+		r.location = time.UTC
+		if r.Timezone != "" {
+			if r.location, err = time.LoadLocation(r.Timezone); err != nil {
+				return fmt.Errorf("report %q: invalid timezone %q", r.Name, r.Timezone)
+			}
+		}
+	}
+
+	if len(c.Reports) > 0 && (c.SMTP.Host == "" || c.SMTP.From == "") {
+		return fmt.Errorf("reports need smtp.host and smtp.from")
+	}
+
+	if err := c.Collection.validate(c.Server.RefreshInterval); err != nil {
+		return err
+	}
+	if err := c.TLS.validate(); err != nil {
+		return err
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+	if err := c.Logging.validate(); err != nil {
+		return err
+	}
+
+	// Browsers send the origin without a trailing slash or path
+	for i, origin := range c.Auth.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return fmt.Errorf("invalid CORS origin %q: expected scheme://host[:port]", origin)
+		}
+		c.Auth.CORSOrigins[i] = u.Scheme + "://" + u.Host
+	}
+	return nil
+}
@@ -3,20 +3,39 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// sqliteTimeFormat matches the format SQLite uses for CURRENT_TIMESTAMP
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
 // Database represents the database connection and operations
 type Database struct {
-	db *sql.DB
+	db   *sql.DB
+	path string
+}
+
+// sqliteBusyTimeout is how long a connection waits for a lock held by another writer
+const sqliteBusyTimeout = 5 * time.Second
+
+// sqliteDSN adds connection options to a database path: WAL mode lets readers proceed
+// while a write is in progress, and the busy timeout makes contending writers wait
+// instead of failing with SQLITE_BUSY
+func sqliteDSN(dbPath string) string {
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%s_journal_mode=WAL&_busy_timeout=%d", dbPath, sep, sqliteBusyTimeout.Milliseconds())
 }
 
 // NewDatabase creates a new database connection
 func NewDatabase(dbPath string) (*Database, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := sql.Open("sqlite3", sqliteDSN(dbPath))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -26,7 +45,12 @@ func NewDatabase(dbPath string) (*Database, error) {
 		return nil, fmt.Errorf("failed to create tables: %w", err)
 	}
 
-	return &Database{db: db}, nil
+	// Bring older databases up to the current schema
+	if err := migrateSchema(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
+	}
+
+	return &Database{db: db, path: dbPath}, nil
 }
 
 // createTables creates the necessary database tables
@@ -97,28 +121,158 @@ func createTables(db *sql.DB) error {
 	return err
 }
 
-// StoreMeasurement stores a single air quality measurement
-func (d *Database) StoreMeasurement(data *AirQualityData) error {
-	insertSQL := `
-	INSERT INTO measurements (
+// schemaMigrations upgrade the measurements table in order; the number applied so far is
+// tracked in SQLite's user_version pragma
+var schemaMigrations = []string{
+	// 1: use the device DateTime as the observation time and collapse repeated readings
+	`
+	ALTER TABLE measurements ADD COLUMN observed_at DATETIME;
+
+	UPDATE measurements SET observed_at = CASE
+		WHEN datetime GLOB '[0-9][0-9][0-9][0-9]/[0-9][0-9]/[0-9][0-9]T[0-9][0-9]:[0-9][0-9]:[0-9][0-9]*'
+		THEN replace(replace(substr(datetime, 1, 19), '/', '-'), 'T', ' ')
+		ELSE timestamp
+	END;
+
+	DELETE FROM measurements WHERE id NOT IN (
+		SELECT MAX(id) FROM measurements GROUP BY sensor_id, observed_at
+	);
+
+	DROP INDEX IF EXISTS idx_measurements_sensor_datetime;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_measurements_sensor_observed ON measurements(sensor_id, observed_at);
+	CREATE INDEX IF NOT EXISTS idx_measurements_observed_at ON measurements(observed_at);
+	`,
+	// 2: per-sensor daily summaries
+	`
+	CREATE TABLE daily_summaries (
+		sensor_id TEXT NOT NULL,
+		date TEXT NOT NULL,
+		samples INTEGER,
+		hours_with_data INTEGER,
+		completeness REAL,
+		mean_pm25 REAL,
+		aqi INTEGER,
+		category TEXT,
+		max_hourly_aqi INTEGER,
+		hours_good INTEGER,
+		hours_moderate INTEGER,
+		hours_unhealthy_sensitive INTEGER,
+		hours_unhealthy INTEGER,
+		hours_very_unhealthy INTEGER,
+		hours_hazardous INTEGER,
+		min_temp REAL,
+		max_temp REAL,
+		computed_at DATETIME,
+		PRIMARY KEY (sensor_id, date)
+	);
+	`,
+	// 3: API keys, stored as SHA-256 hashes
+	`
+	CREATE TABLE api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		role TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME
+	);
+	`,
+	// 4: a single row rewritten by health checks to prove the database accepts writes
+	`
+	CREATE TABLE health_check (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		checked_at DATETIME NOT NULL
+	);
+	`,
+}
+
+// migrateSchema applies any schema migrations the database hasn't seen yet
+func migrateSchema(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := version; i < len(schemaMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(schemaMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		slog.Info("Applied database migration", "version", i+1)
+	}
+
+	return nil
+}
+
+// measurementInsertColumns lists the columns written for each measurement, matching measurementArgs
+const measurementInsertColumns = `
 		sensor_id, datetime, geo, lat, lon, place, version, uptime, rssi, wlstate, ssid,
 		current_temp_f, current_humidity, current_dewpoint_f, pressure, gas_680,
 		pm25_aqi, pm10_cf1, pm25_cf1, pm100_cf1, pm10_atm, pm25_atm, pm100_atm,
 		pm25_aqi_b, pm10_cf1_b, pm25_cf1_b, pm100_cf1_b, pm10_atm_b, pm25_atm_b, pm100_atm_b,
 		mem, memfrag, memfb, memcs, adc, httpsuccess, httpsends, pa_latency,
-		status_0, status_1, status_2, status_3, status_4
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
+		status_0, status_1, status_2, status_3, status_4`
 
-	_, err := d.db.Exec(insertSQL,
+// measurementPlaceholders has one bind parameter per column in measurementInsertColumns
+const measurementPlaceholders = `?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?`
+
+// measurementArgs returns the insert arguments for a measurement in column order
+func measurementArgs(data *AirQualityData) []interface{} {
+	return []interface{}{
 		data.SensorId, data.DateTime, data.Geo, data.Lat, data.Lon, data.Place, data.Version, data.Uptime, data.Rssi, data.Wlstate, data.Ssid,
 		data.CurrentTempF, data.CurrentHumidity, data.CurrentDewpointF, data.Pressure, data.Gas680,
 		data.Pm25Aqi, data.Pm10Cf1, data.Pm25Cf1, data.Pm100Cf1, data.Pm10Atm, data.Pm25Atm, data.Pm100Atm,
 		data.Pm25AqiB, data.Pm10Cf1B, data.Pm25Cf1B, data.Pm100Cf1B, data.Pm10AtmB, data.Pm25AtmB, data.Pm100AtmB,
 		data.Mem, data.Memfrag, data.Memfb, data.Memcs, data.Adc, data.Httpsuccess, data.Httpsends, data.PaLatency,
 		data.Status0, data.Status1, data.Status2, data.Status3, data.Status4,
-	)
+	}
+}
+
+// measurementUpsertSQL inserts a measurement, or refreshes the stored row when the same
+// device reading has already been recorded for the sensor
+var measurementUpsertSQL = `INSERT INTO measurements (observed_at, ` + measurementInsertColumns + `)
+	VALUES (?, ` + measurementPlaceholders + `)
+	ON CONFLICT(sensor_id, observed_at) DO UPDATE SET ` + upsertAssignments(measurementInsertColumns)
+
+// upsertAssignments builds "col = excluded.col" assignments for a column list
+func upsertAssignments(columns string) string {
+	var assignments []string
+	for _, column := range strings.Split(columns, ",") {
+		column = strings.TrimSpace(column)
+		assignments = append(assignments, column+" = excluded."+column)
+	}
+	return strings.Join(assignments, ", ")
+}
+
+// observedAt returns the device observation time, falling back to the current time when
+// the device didn't report a usable DateTime
+func observedAt(data *AirQualityData) time.Time {
+	t, err := data.ObservedAt()
+	if err != nil {
+		slog.Warn("Using current time for measurement", "error", err)
+		return time.Now().UTC()
+	}
+	return t
+}
+
+// StoreMeasurement stores a single air quality measurement, keyed by sensor and the
+// device's observation time so repeated fetches of the same reading don't duplicate rows
+func (d *Database) StoreMeasurement(data *AirQualityData) error {
+	args := append([]interface{}{observedAt(data).Format(sqliteTimeFormat)}, measurementArgs(data)...)
 
+	_, err := d.db.Exec(measurementUpsertSQL, args...)
 	if err != nil {
 		return fmt.Errorf("failed to insert measurement: %w", err)
 	}
@@ -126,44 +280,129 @@ func (d *Database) StoreMeasurement(data *AirQualityData) error {
 	return nil
 }
 
-// GetRecentMeasurements retrieves recent measurements for graphing
-func (d *Database) GetRecentMeasurements(hours int) ([]Measurement, error) {
+// StoreMeasurements stores a batch of measurements in a single transaction
+func (d *Database) StoreMeasurements(batch []*AirQualityData) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(measurementUpsertSQL)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, data := range batch {
+		args := append([]interface{}{observedAt(data).Format(sqliteTimeFormat)}, measurementArgs(data)...)
+		if _, err := stmt.Exec(args...); err != nil {
+			return fmt.Errorf("failed to insert measurement: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit measurements: %w", err)
+	}
+	return nil
+}
+
+// ImportMeasurements stores historical measurements in a single transaction, skipping
+// rows already stored for the same sensor and observation time. It returns the number
+// of rows inserted and skipped.
+func (d *Database) ImportMeasurements(records []*AirQualityData) (int, int, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	INSERT INTO measurements (observed_at, ` + measurementInsertColumns + `)
+	VALUES (?, ` + measurementPlaceholders + `)
+	ON CONFLICT(sensor_id, observed_at) DO NOTHING
+	`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to prepare import: %w", err)
+	}
+	defer stmt.Close()
+
+	inserted, skipped := 0, 0
+	for _, data := range records {
+		observedAt, err := data.ObservedAt()
+		if err != nil {
+			return inserted, skipped, err
+		}
+
+		args := append([]interface{}{observedAt.Format(sqliteTimeFormat)}, measurementArgs(data)...)
+		result, err := stmt.Exec(args...)
+		if err != nil {
+			return inserted, skipped, fmt.Errorf("failed to import measurement: %w", err)
+		}
+
+		if n, _ := result.RowsAffected(); n > 0 {
+			inserted++
+		} else {
+			skipped++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit import: %w", err)
+	}
+	return inserted, skipped, nil
+}
+
+// sqliteFilter builds the WHERE clause and bound arguments for a query
+func sqliteFilter(q MeasurementQuery) (string, []interface{}) {
+	return q.sqlFilter(
+		func(int) string { return "?" },
+		func(t time.Time) interface{} { return t.Format(sqliteTimeFormat) },
+	)
+}
+
+// EachMeasurement calls fn for each measurement matching the query, in observation
+// order, without buffering the result set
+func (d *Database) EachMeasurement(q MeasurementQuery, fn func(m Measurement) error) error {
+	where, args := sqliteFilter(q)
 	query := `
 	SELECT 
-		timestamp, sensor_id, current_temp_f, current_humidity, pressure, gas_680,
+		id, observed_at, sensor_id, current_temp_f, current_humidity, pressure, gas_680,
 		pm25_aqi, pm25_cf1, pm100_cf1, pm25_aqi_b, pm25_cf1_b, pm100_cf1_b,
 		mem, rssi, pa_latency
 	FROM measurements 
-	WHERE timestamp >= datetime('now', '-` + fmt.Sprintf("%d", hours) + ` hours')
-	ORDER BY timestamp ASC
-	`
+	` + where + `
+	ORDER BY observed_at ASC, id ASC
+	` + q.sqlLimit()
 
-	rows, err := d.db.Query(query)
+	rows, err := d.db.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query measurements: %w", err)
+		return fmt.Errorf("failed to query measurements: %w", err)
 	}
 	defer rows.Close()
 
-	var measurements []Measurement
 	for rows.Next() {
 		var m Measurement
 		err := rows.Scan(
-			&m.Timestamp, &m.SensorID, &m.Temperature, &m.Humidity, &m.Pressure, &m.Gas680,
+			&m.ID, &m.Timestamp, &m.SensorID, &m.Temperature, &m.Humidity, &m.Pressure, &m.Gas680,
 			&m.PM25AQI, &m.PM25CF1, &m.PM100CF1, &m.PM25AQIB, &m.PM25CF1B, &m.PM100CF1B,
 			&m.Memory, &m.RSSI, &m.PaLatency,
 		)
 		if err != nil {
-			log.Printf("Error scanning measurement: %v", err)
+			slog.Error("Error scanning measurement", "error", err)
 			continue
 		}
-		measurements = append(measurements, m)
+		if err := fn(m); err != nil {
+			return err
+		}
 	}
 
-	return measurements, nil
+	return rows.Err()
 }
 
-// GetMeasurementStats returns statistics for the specified time period
-func (d *Database) GetMeasurementStats(hours int) (*MeasurementStats, error) {
+// GetMeasurementStats returns statistics for the measurements matching the query
+func (d *Database) GetMeasurementStats(q MeasurementQuery) (*MeasurementStats, error) {
+	where, args := sqliteFilter(q)
 	query := `
 	SELECT 
 		COUNT(*) as count,
@@ -178,11 +417,10 @@ func (d *Database) GetMeasurementStats(hours int) (*MeasurementStats, error) {
 		COALESCE(MAX(current_temp_f), 0) as max_temp,
 		COALESCE(MIN(current_temp_f), 0) as min_temp
 	FROM measurements 
-	WHERE timestamp >= datetime('now', '-` + fmt.Sprintf("%d", hours) + ` hours')
-	`
+	` + where
 
 	var stats MeasurementStats
-	err := d.db.QueryRow(query).Scan(
+	err := d.db.QueryRow(query, args...).Scan(
 		&stats.Count, &stats.AvgTemp, &stats.AvgHumidity, &stats.AvgPressure,
 		&stats.AvgPM25AQI, &stats.AvgPM25CF1, &stats.AvgPM100CF1,
 		&stats.MaxPM25AQI, &stats.MinPM25AQI, &stats.MaxTemp, &stats.MinTemp,
@@ -195,6 +433,240 @@ func (d *Database) GetMeasurementStats(hours int) (*MeasurementStats, error) {
 	return &stats, nil
 }
 
+// AggregateMeasurements computes the aggregates of each field in the database, per bucket
+// when bucket is set
+func (d *Database) AggregateMeasurements(q MeasurementQuery, fields []string, offsets []float64, bucket time.Duration, fn func(start time.Time, count int, aggregates []FieldAggregate) error) error {
+	where, args := sqliteFilter(q)
+	bucketExpr := ""
+	if bucket > 0 {
+		bucketExpr = fmt.Sprintf("CAST(strftime('%%s', observed_at) AS INTEGER) / %d", int64(bucket/time.Second))
+	}
+
+	rows, err := d.db.Query(aggregateSQL(fields, offsets, bucketExpr, where), args...)
+	if err != nil {
+		return fmt.Errorf("failed to aggregate measurements: %w", err)
+	}
+	defer rows.Close()
+
+	return scanAggregates(rows, len(fields), bucket, fn)
+}
+
+// QueryMeasurements streams the query's columns for each matching measurement, calling
+// fn once per row without buffering the result set
+func (d *Database) QueryMeasurements(q MeasurementQuery, fn func(values []interface{}) error) error {
+	where, args := sqliteFilter(q)
+	query := `
+	SELECT ` + strings.Join(q.Fields, ", ") + `
+	FROM measurements
+	` + where + `
+	ORDER BY observed_at ASC, id ASC
+	` + q.sqlLimit()
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query measurements: %w", err)
+	}
+	defer rows.Close()
+
+	return scanRows(rows, len(q.Fields), fn)
+}
+
+// scanRows scans each row into a reused value slice and passes it to fn
+func scanRows(rows *sql.Rows, columns int, fn func(values []interface{}) error) error {
+	values := make([]interface{}, columns)
+	pointers := make([]interface{}, columns)
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return fmt.Errorf("failed to scan measurement: %w", err)
+		}
+		if err := fn(values); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// dailySummaryColumns lists the daily_summaries columns, matching dailySummaryArgs
+const dailySummaryColumns = `sensor_id, date, samples, hours_with_data, completeness, mean_pm25, aqi, category,
+		max_hourly_aqi, hours_good, hours_moderate, hours_unhealthy_sensitive, hours_unhealthy,
+		hours_very_unhealthy, hours_hazardous, min_temp, max_temp, computed_at`
+
+// dailySummaryArgs returns the insert arguments for a summary in column order
+func dailySummaryArgs(s *DailySummary, computedAt interface{}) []interface{} {
+	return []interface{}{
+		s.SensorID, s.Date, s.Samples, s.HoursWithData, s.Completeness, s.MeanPM25, s.AQI, s.Category,
+		s.MaxHourlyAQI, s.Hours.Good, s.Hours.Moderate, s.Hours.UnhealthySensitive, s.Hours.Unhealthy,
+		s.Hours.VeryUnhealthy, s.Hours.Hazardous, s.MinTemp, s.MaxTemp, computedAt,
+	}
+}
+
+// dailySummaryUpsert builds the statement that stores a summary, using placeholders
+// for the bind parameter list
+func dailySummaryUpsert(placeholders string) string {
+	return `INSERT INTO daily_summaries (` + dailySummaryColumns + `)
+	VALUES (` + placeholders + `)
+	ON CONFLICT (sensor_id, date) DO UPDATE SET ` + upsertAssignments(dailySummaryColumns)
+}
+
+// dailySummaryFilter builds the WHERE clause and arguments for GetDailySummaries
+func dailySummaryFilter(sensorID, from, to string, placeholder func(n int) string) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, placeholder(len(args))))
+	}
+
+	if sensorID != "" {
+		add("sensor_id = %s", sensorID)
+	}
+	if from != "" {
+		add("date >= %s", from)
+	}
+	if to != "" {
+		add("date < %s", to)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// scanDailySummaries reads daily_summaries rows selected with dailySummaryColumns
+func scanDailySummaries(rows *sql.Rows) ([]DailySummary, error) {
+	var summaries []DailySummary
+	for rows.Next() {
+		var s DailySummary
+		err := rows.Scan(
+			&s.SensorID, &s.Date, &s.Samples, &s.HoursWithData, &s.Completeness, &s.MeanPM25, &s.AQI, &s.Category,
+			&s.MaxHourlyAQI, &s.Hours.Good, &s.Hours.Moderate, &s.Hours.UnhealthySensitive, &s.Hours.Unhealthy,
+			&s.Hours.VeryUnhealthy, &s.Hours.Hazardous, &s.MinTemp, &s.MaxTemp, &s.ComputedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan daily summary: %w", err)
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries, rows.Err()
+}
+
+// StoreDailySummary stores a daily summary, replacing any earlier one for the same day
+func (d *Database) StoreDailySummary(summary *DailySummary) error {
+	args := dailySummaryArgs(summary, summary.ComputedAt.UTC().Format(sqliteTimeFormat))
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	if _, err := d.db.Exec(dailySummaryUpsert(placeholders), args...); err != nil {
+		return fmt.Errorf("failed to store daily summary: %w", err)
+	}
+	return nil
+}
+
+// GetDailySummaries returns the daily summaries between from (inclusive) and to (exclusive)
+func (d *Database) GetDailySummaries(sensorID, from, to string) ([]DailySummary, error) {
+	where, args := dailySummaryFilter(sensorID, from, to, func(int) string { return "?" })
+	rows, err := d.db.Query(`SELECT `+dailySummaryColumns+` FROM daily_summaries `+where+` ORDER BY date, sensor_id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query daily summaries: %w", err)
+	}
+	defer rows.Close()
+
+	return scanDailySummaries(rows)
+}
+
+// apiKeyColumns lists the api_keys columns read by scanAPIKeys
+const apiKeyColumns = `id, name, prefix, key_hash, role, created_at, last_used_at`
+
+// scanAPIKeys reads api_keys rows selected with apiKeyColumns
+func scanAPIKeys(rows *sql.Rows) ([]APIKey, error) {
+	var keys []APIKey
+	for rows.Next() {
+		var k APIKey
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Hash, &k.Role, &k.CreatedAt, &lastUsed); err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		if lastUsed.Valid {
+			k.LastUsedAt = &lastUsed.Time
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// CreateAPIKey stores a new API key
+func (d *Database) CreateAPIKey(key *APIKey) error {
+	result, err := d.db.Exec(`INSERT INTO api_keys (name, prefix, key_hash, role, created_at) VALUES (?, ?, ?, ?, ?)`,
+		key.Name, key.Prefix, key.Hash, key.Role, key.CreatedAt.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return fmt.Errorf("failed to store API key: %w", err)
+	}
+	key.ID, _ = result.LastInsertId()
+	return nil
+}
+
+// GetAPIKey returns the API key with the given hash, or nil if there is none
+func (d *Database) GetAPIKey(hash string) (*APIKey, error) {
+	rows, err := d.db.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API key: %w", err)
+	}
+	defer rows.Close()
+
+	keys, err := scanAPIKeys(rows)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	return &keys[0], nil
+}
+
+// ListAPIKeys returns every API key ordered by name
+func (d *Database) ListAPIKeys() ([]APIKey, error) {
+	rows, err := d.db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	defer rows.Close()
+
+	return scanAPIKeys(rows)
+}
+
+// DeleteAPIKey removes the API key with the given name, reporting whether it existed
+func (d *Database) DeleteAPIKey(name string) (bool, error) {
+	result, err := d.db.Exec(`DELETE FROM api_keys WHERE name = ?`, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete API key: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// TouchAPIKey records when an API key was last used
+func (d *Database) TouchAPIKey(id int64, usedAt time.Time) error {
+	if _, err := d.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, usedAt.UTC().Format(sqliteTimeFormat), id); err != nil {
+		return fmt.Errorf("failed to update API key: %w", err)
+	}
+	return nil
+}
+
+// CheckHealth pings the database and rewrites the health check row, which fails if the
+// file has become read-only or the disk is full
+func (d *Database) CheckHealth() error {
+	if err := d.db.Ping(); err != nil {
+		return fmt.Errorf("failed to reach database: %w", err)
+	}
+	_, err := d.db.Exec(`INSERT INTO health_check (id, checked_at) VALUES (1, ?)
+		ON CONFLICT(id) DO UPDATE SET checked_at = excluded.checked_at`, time.Now().UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return fmt.Errorf("failed to write to database: %w", err)
+	}
+	return nil
+}
+
 // Close closes the database connection
 func (d *Database) Close() error {
 	return d.db.Close()
@@ -202,6 +674,7 @@ func (d *Database) Close() error {
 
 // Measurement represents a simplified measurement for graphing
 type Measurement struct {
+	ID          int64     `json:"id"`
 	Timestamp   time.Time `json:"timestamp"`
 	SensorID    string    `json:"sensor_id"`
 	Temperature float64   `json:"temperature"`
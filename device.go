@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states. A closed circuit passes requests to the device; after
+// deviceFailureThreshold failures in a row it opens and requests fail immediately, so
+// a sensor that is down or overloaded isn't kept busy. Once deviceOpenDuration has
+// passed the circuit is half-open and lets one request through to test the device.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+const (
+	// deviceFailureThreshold is the number of consecutive failures that opens the circuit
+	deviceFailureThreshold = 3
+
+	// deviceOpenDuration is how long an open circuit rejects requests
+	deviceOpenDuration = 30 * time.Second
+)
+
+// errCircuitOpen is returned instead of contacting a device whose circuit is open
+var errCircuitOpen = errors.New("device circuit is open after repeated failures")
+
+// errSensorNotFound is returned for a sensor configured by ID that discovery hasn't
+// found on the network yet
+var errSensorNotFound = errors.New("sensor has not been found on the network yet")
+
+// Device is a PurpleAir sensor the server reads from. It tracks the device's health
+// for the circuit breaker and health checks. A device configured by sensor ID only
+// accepts readings from that sensor, and its URL is updated by discovery when the
+// sensor's address changes.
+type Device struct {
+	mu          sync.Mutex
+	url         string
+	expectedID  string
+	state       string
+	failures    int
+	openedAt    time.Time
+	trial       bool
+	lastSuccess time.Time
+	lastError   string
+	sensorID    string
+}
+
+// DeviceStatus reports the health of a device
+type DeviceStatus struct {
+	URL                 string     `json:"url"`
+	SensorID            string     `json:"sensor_id,omitempty"`
+	Circuit             string     `json:"circuit"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+// NewDevice creates a device with a closed circuit
+func NewDevice(url string) *Device {
+	return &Device{url: url, state: circuitClosed}
+}
+
+// NewSensorDevice creates a device for the sensor with an ID, such as its MAC address.
+// url is where the sensor was last seen, or "" to wait for discovery to find it.
+func NewSensorDevice(url, sensorID string) *Device {
+	return &Device{url: url, expectedID: sensorID, state: circuitClosed}
+}
+
+// URL returns the address the device is read from
+func (d *Device) URL() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.url
+}
+
+// SensorID returns the ID of the sensor the device must be, or "" for any sensor
+func (d *Device) SensorID() string {
+	return d.expectedID
+}
+
+// moveTo points the device at a new address and closes its circuit, since failures
+// at the old address say nothing about the new one
+func (d *Device) moveTo(url string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.url = url
+	d.state = circuitClosed
+	d.failures = 0
+	d.trial = false
+}
+
+// Fetch reads the current data from the device, unless its circuit is open
+func (d *Device) Fetch(ctx context.Context) (*AirQualityData, error) {
+	url := d.URL()
+	if url == "" {
+		return nil, errSensorNotFound
+	}
+	if !d.allow(time.Now()) {
+		return nil, errCircuitOpen
+	}
+	data, err := fetchAirQualityData(ctx, url)
+	if err == nil && d.expectedID != "" && !sameSensorID(data.SensorId, d.expectedID) {
+		// The address now belongs to another sensor, probably after a DHCP change
+		data, err = nil, fmt.Errorf("found sensor %s at %s instead of %s", data.SensorId, url, d.expectedID)
+	}
+	if err != nil && ctx.Err() != nil {
+		// The caller gave up, which says nothing about the device
+		d.mu.Lock()
+		d.trial = false
+		d.mu.Unlock()
+		return nil, err
+	}
+	d.record(data, err, time.Now())
+	return data, err
+}
+
+// allow reports whether a request may go to the device, moving an open circuit to
+// half-open once it has waited long enough
+func (d *Device) allow(now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch d.state {
+	case circuitOpen:
+		if now.Sub(d.openedAt) < deviceOpenDuration {
+			return false
+		}
+		d.state = circuitHalfOpen
+		d.trial = true
+		return true
+	case circuitHalfOpen:
+		// Only one trial request at a time
+		if d.trial {
+			return false
+		}
+		d.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the circuit with the outcome of a request
+func (d *Device) record(data *AirQualityData, err error, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.trial = false
+	if err == nil {
+		d.state = circuitClosed
+		d.failures = 0
+		d.lastSuccess = now
+		d.lastError = ""
+		d.sensorID = data.SensorId
+		return
+	}
+
+	d.failures++
+	d.lastError = err.Error()
+	if d.state == circuitHalfOpen || d.failures >= deviceFailureThreshold {
+		d.state = circuitOpen
+		d.openedAt = now
+	}
+}
+
+// Status returns a snapshot of the device's health
+func (d *Device) Status() DeviceStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status := DeviceStatus{
+		URL:                 d.url,
+		SensorID:            d.sensorID,
+		Circuit:             d.state,
+		ConsecutiveFailures: d.failures,
+		LastError:           d.lastError,
+	}
+	if status.SensorID == "" {
+		status.SensorID = d.expectedID
+	}
+	if !d.lastSuccess.IsZero() {
+		lastSuccess := d.lastSuccess
+		status.LastSuccess = &lastSuccess
+	}
+	return status
+}
+
+// RetryAfter returns how long until an open circuit lets a request through
+func (d *Device) RetryAfter() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.state != circuitOpen {
+		return 0
+	}
+	return deviceOpenDuration - time.Since(d.openedAt)
+}
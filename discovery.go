@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDiscoveryTimeout is how long each device, and mDNS responders, get to answer
+	defaultDiscoveryTimeout = 2 * time.Second
+
+	// defaultDiscoveryConcurrency is how many addresses are probed at once
+	defaultDiscoveryConcurrency = 64
+
+	// maxDiscoveryHosts bounds a subnet scan, the size of a /20
+	maxDiscoveryHosts = 4096
+
+	// defaultDiscoveryInterval is how often discovery looks for every sensor again
+	defaultDiscoveryInterval = 10 * time.Minute
+
+	// discoveryRetryInterval is how soon discovery looks again while a sensor is
+	// missing or not answering at its last address
+	discoveryRetryInterval = time.Minute
+
+	// mdnsService is the DNS-SD service PurpleAir sensors' web servers are found by
+	mdnsService = "_http._tcp.local"
+)
+
+// Where a sensor was found
+const (
+	discoveredByMDNS = "mdns"
+	discoveredByScan = "scan"
+)
+
+// sensorPort is the port sensors' web servers are probed on. Tests point it at servers
+// of their own.
+var sensorPort = "80"
+
+// DiscoveryConfig controls how the server finds sensors configured by sensor ID
+type DiscoveryConfig struct {
+	// CIDRs are IPv4 networks to scan, such as 192.168.1.0/24, each at most a /20
+	CIDRs []string `json:"cidrs"`
+
+	// MDNS also asks the network for web servers with multicast DNS
+	MDNS bool `json:"mdns"`
+
+	// Interval is how often to look for the sensors again, such as "10m". Discovery
+	// looks every minute while a sensor is missing or its circuit is open.
+	Interval string `json:"interval"`
+
+	networks []*net.IPNet
+	interval time.Duration
+}
+
+// validate parses the networks and interval
+func (c *DiscoveryConfig) validate() error {
+	networks, err := parseDiscoveryNetworks(c.CIDRs)
+	if err != nil {
+		return fmt.Errorf("collection.discovery: %w", err)
+	}
+	c.networks = networks
+
+	c.interval = defaultDiscoveryInterval
+	if c.Interval != "" {
+		if c.interval, err = time.ParseDuration(c.Interval); err != nil || c.interval < discoveryRetryInterval {
+			return fmt.Errorf("invalid collection.discovery.interval %q: expected a duration of at least %s", c.Interval, discoveryRetryInterval)
+		}
+	}
+	return nil
+}
+
+// enabled reports whether discovery has anywhere to look
+func (c *DiscoveryConfig) enabled() bool {
+	return c.MDNS || len(c.networks) > 0
+}
+
+// parseDiscoveryNetworks parses IPv4 networks, rejecting any too large to scan
+func parseDiscoveryNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil || network.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid network %q: expected an IPv4 CIDR such as 192.168.1.0/24", cidr)
+		}
+		ones, bits := network.Mask.Size()
+		if 1<<(bits-ones) > maxDiscoveryHosts {
+			return nil, fmt.Errorf("network %s is too large to scan; use a /20 or smaller", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// networkHosts returns the host addresses of an IPv4 network, leaving out the network
+// and broadcast addresses unless it is a /31 or /32
+func networkHosts(network *net.IPNet) []net.IP {
+	ones, bits := network.Mask.Size()
+	first := binary.BigEndian.Uint32(network.IP.To4())
+	size := uint32(1) << (bits - ones)
+
+	var hosts []net.IP
+	for i := uint32(0); i < size; i++ {
+		if size > 2 && (i == 0 || i == size-1) {
+			continue
+		}
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, first+i)
+		hosts = append(hosts, ip)
+	}
+	return hosts
+}
+
+// sameSensorID reports whether two sensor IDs name the same sensor. IDs are MAC
+// addresses, which may be written in either case.
+func sameSensorID(a, b string) bool {
+	return a != "" && strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// DiscoveredSensor is a PurpleAir sensor found on the network
+type DiscoveredSensor struct {
+	SensorID string `json:"sensor_id"`
+	URL      string `json:"url"`
+	Name     string `json:"name,omitempty"`
+	Place    string `json:"place,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Source   string `json:"source"`
+}
+
+// DiscoveryOptions says where and how hard to look for sensors
+type DiscoveryOptions struct {
+	Networks    []*net.IPNet
+	MDNS        bool
+	Timeout     time.Duration
+	Concurrency int
+}
+
+// discoverSensors looks for PurpleAir sensors with mDNS and by scanning networks. Every
+// candidate address is probed at /json, and only devices that answer with a sensor ID
+// are returned, sorted by ID. A sensor answering at several addresses is returned once.
+func discoverSensors(ctx context.Context, opts DiscoveryOptions) ([]DiscoveredSensor, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultDiscoveryTimeout
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultDiscoveryConcurrency
+	}
+
+	candidates := make(map[string]string) // address to source
+	var order []string
+	add := func(ip net.IP, source string) {
+		if _, ok := candidates[ip.String()]; !ok {
+			candidates[ip.String()] = source
+			order = append(order, ip.String())
+		}
+	}
+
+	if opts.MDNS {
+		mdnsCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+		hosts, err := mdnsLookup(mdnsCtx, mdnsService)
+		cancel()
+		if err != nil && len(opts.Networks) == 0 {
+			return nil, err
+		}
+		if err != nil {
+			slog.Warn("mDNS lookup failed, scanning networks only", "error", err)
+		}
+		for _, ip := range hosts {
+			add(ip, discoveredByMDNS)
+		}
+	}
+	for _, network := range opts.Networks {
+		for _, ip := range networkHosts(network) {
+			add(ip, discoveredByScan)
+		}
+	}
+
+	var mu sync.Mutex
+	found := make(map[string]DiscoveredSensor)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Concurrency)
+	for _, address := range order {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(address, source string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			sensor, ok := probeSensor(ctx, sensorAddress(address), opts.Timeout)
+			if !ok {
+				return
+			}
+			sensor.Source = source
+			mu.Lock()
+			defer mu.Unlock()
+			key := strings.ToLower(sensor.SensorID)
+			// Keep the lowest address so repeated runs agree
+			if existing, ok := found[key]; !ok || ipLess(sensor.URL, existing.URL) {
+				found[key] = sensor
+			}
+		}(address, candidates[address])
+	}
+	wg.Wait()
+
+	sensors := make([]DiscoveredSensor, 0, len(found))
+	for _, sensor := range found {
+		sensors = append(sensors, sensor)
+	}
+	sort.Slice(sensors, func(i, j int) bool { return sensors[i].SensorID < sensors[j].SensorID })
+	return sensors, ctx.Err()
+}
+
+// probeSensor reads /json from an address and reports whether a PurpleAir sensor answered
+func probeSensor(ctx context.Context, address string, timeout time.Duration) (DiscoveredSensor, bool) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	url := "http://" + address + "/json"
+	data, err := fetchAirQualityData(ctx, url)
+	if err != nil || data.SensorId == "" {
+		return DiscoveredSensor{}, false
+	}
+	return DiscoveredSensor{
+		SensorID: data.SensorId,
+		URL:      url,
+		Name:     data.Geo,
+		Place:    data.Place,
+		Version:  data.Version,
+	}, true
+}
+
+// sensorAddress returns the address a sensor at ip is probed at, leaving out the
+// default HTTP port so URLs stay as users would write them
+func sensorAddress(ip string) string {
+	if sensorPort == "80" {
+		return ip
+	}
+	return net.JoinHostPort(ip, sensorPort)
+}
+
+// ipLess orders sensor URLs by their IPv4 address
+func ipLess(a, b string) bool {
+	ipA := net.ParseIP(urlHostname(a)).To4()
+	ipB := net.ParseIP(urlHostname(b)).To4()
+	if ipA == nil || ipB == nil {
+		return a < b
+	}
+	return binary.BigEndian.Uint32(ipA) < binary.BigEndian.Uint32(ipB)
+}
+
+// urlHostname returns the host of a URL without its port
+func urlHostname(rawURL string) string {
+	host := hostName(rawURL)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// runDiscovery keeps the addresses of sensors configured by ID up to date until the
+// server stops
+func (s *Server) runDiscovery() {
+	ticker := time.NewTicker(discoveryRetryInterval)
+	defer ticker.Stop()
+
+	// Time since the last search is counted in ticks, so a search that takes a while
+	// doesn't push the next one back a whole tick
+	searched := false
+	var elapsed time.Duration
+	for {
+		cfg, tracked, lost := s.discoveryState()
+		if tracked && cfg.enabled() && (!searched || lost || elapsed >= cfg.interval) {
+			s.discover(cfg)
+			searched, elapsed = true, 0
+		}
+
+		select {
+		case <-ticker.C:
+			elapsed += discoveryRetryInterval
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// discoveryState returns the discovery settings, whether any sensor is configured by
+// ID, and whether one of those is missing or not answering
+func (s *Server) discoveryState() (cfg DiscoveryConfig, tracked, lost bool) {
+	s.collectorsMu.RLock()
+	defer s.collectorsMu.RUnlock()
+
+	for _, c := range s.collectors {
+		if c.Device.SensorID() == "" {
+			continue
+		}
+		tracked = true
+		if status := c.Device.Status(); status.URL == "" || status.Circuit != circuitClosed {
+			lost = true
+		}
+	}
+	return s.discovery, tracked, lost
+}
+
+// discover looks for the sensors configured by ID and points their devices at the
+// addresses they were found at
+func (s *Server) discover(cfg DiscoveryConfig) {
+	// Stopping the server abandons a scan in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	start := time.Now()
+	sensors, err := discoverSensors(ctx, DiscoveryOptions{Networks: cfg.networks, MDNS: cfg.MDNS})
+	if err != nil {
+		slog.Error("Error discovering sensors", "error", err)
+		return
+	}
+	slog.Debug("Discovery finished", "sensors", len(sensors), "duration_ms", time.Since(start).Milliseconds())
+
+	for _, c := range s.collectorList() {
+		id := c.Device.SensorID()
+		if id == "" {
+			continue
+		}
+		var match *DiscoveredSensor
+		for i := range sensors {
+			if sameSensorID(sensors[i].SensorID, id) {
+				match = &sensors[i]
+				break
+			}
+		}
+		switch {
+		case match == nil:
+			slog.Warn("Sensor not found on the network", "sensor", c.Name, "sensor_id", id, "last_url", c.Device.URL())
+		case match.URL != c.Device.URL():
+			slog.Info("Sensor found at a new address", "sensor", c.Name, "sensor_id", id, "url", match.URL, "previous_url", c.Device.URL())
+			c.Device.moveTo(match.URL)
+		}
+	}
+}
+
+// runDiscoverCommand finds PurpleAir sensors on the local network and prints them
+//
+//	discover [-cidr 192.168.1.0/24,...] [-mdns=false] [-timeout 2s] [-concurrency 64] [-json]
+func runDiscoverCommand(args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	cidrs := fs.String("cidr", "", "comma separated IPv4 networks to scan, e.g. 192.168.1.0/24 (at most a /20 each)")
+	useMDNS := fs.Bool("mdns", true, "ask for sensors with multicast DNS")
+	timeout := fs.Duration("timeout", defaultDiscoveryTimeout, "how long each device, and mDNS responders, have to answer")
+	concurrency := fs.Int("concurrency", defaultDiscoveryConcurrency, "how many addresses to probe at once")
+	asJSON := fs.Bool("json", false, "print the sensors as JSON")
+	fs.Parse(args)
+
+	var list []string
+	if *cidrs != "" {
+		list = strings.Split(*cidrs, ",")
+	}
+	networks, err := parseDiscoveryNetworks(list)
+	if err != nil {
+		return err
+	}
+	if !*useMDNS && len(networks) == 0 {
+		return fmt.Errorf("nothing to search: give -cidr or leave -mdns on")
+	}
+
+	sensors, err := discoverSensors(context.Background(), DiscoveryOptions{
+		Networks:    networks,
+		MDNS:        *useMDNS,
+		Timeout:     *timeout,
+		Concurrency: *concurrency,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sensors)
+	}
+	if len(sensors) == 0 {
+		fmt.Println("No sensors found")
+		if len(networks) == 0 {
+			fmt.Println("Not every network passes mDNS; try scanning one with -cidr, e.g. -cidr 192.168.1.0/24")
+		}
+		return nil
+	}
+	fmt.Printf("Found %d sensor(s):\n", len(sensors))
+	for _, sensor := range sensors {
+		fmt.Printf("  %-18s %-30s %-16s (%s)\n", sensor.SensorID, sensor.URL, sensor.Name, sensor.Source)
+	}
+	fmt.Println("\nTo follow a sensor across address changes, add it to collection.sensors in config.json by \"sensor_id\" and enable collection.discovery.")
+	return nil
+}
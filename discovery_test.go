@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sensorHandler answers /json like a PurpleAir sensor with an ID
+func sensorHandler(sensorID, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/json" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"SensorId":  sensorID,
+			"Geo":       name,
+			"place":     "outside",
+			"version":   "7.02",
+			"pm2.5_aqi": 12,
+		})
+	})
+}
+
+// fakeSensorNetwork serves handlers at loopback addresses, such as 127.0.0.2, all on
+// the same port, and points discovery at that port until the test ends. It returns the
+// URL of each sensor's /json.
+func fakeSensorNetwork(t *testing.T, handlers map[string]http.Handler) map[string]string {
+	port := "0"
+	urls := make(map[string]string)
+	for ip, handler := range handlers {
+		listener, err := net.Listen("tcp", net.JoinHostPort(ip, port))
+		if err != nil {
+			t.Skipf("can't listen on %s: %v", ip, err)
+		}
+		_, port, _ = net.SplitHostPort(listener.Addr().String())
+
+		server := httptest.NewUnstartedServer(handler)
+		server.Listener.Close()
+		server.Listener = listener
+		server.Start()
+		t.Cleanup(server.Close)
+		urls[ip] = server.URL + "/json"
+	}
+
+	previous := sensorPort
+	sensorPort = port
+	t.Cleanup(func() { sensorPort = previous })
+	return urls
+}
+
+func TestProbeSensor(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.Handler
+		want    bool
+	}{
+		{"sensor", sensorHandler("aa:bb:cc:dd:ee:01", "Kitchen"), true},
+		{"no sensor ID", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"place": "outside", "pm2.5_aqi": 12}`)
+		}), false},
+		{"web page", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "<html><body>Router login</body></html>")
+		}), false},
+		{"not found", http.NotFoundHandler(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+			address := strings.TrimPrefix(server.URL, "http://")
+
+			sensor, ok := probeSensor(context.Background(), address, time.Second)
+			if ok != tt.want {
+				t.Fatalf("probeSensor = %v, want %v", ok, tt.want)
+			}
+			want := DiscoveredSensor{SensorID: "aa:bb:cc:dd:ee:01", URL: server.URL + "/json", Name: "Kitchen", Place: "outside", Version: "7.02"}
+			if ok && sensor != want {
+				t.Errorf("probeSensor = %+v, want %+v", sensor, want)
+			}
+		})
+	}
+}
+
+func TestDiscoverSensorsKeepsLowestAddress(t *testing.T) {
+	urls := fakeSensorNetwork(t, map[string]http.Handler{
+		"127.0.0.2":  sensorHandler("bb:bb:bb:bb:bb:bb", "Porch"),
+		"127.0.0.3":  sensorHandler("aa:aa:aa:aa:aa:aa", "Kitchen"),
+		"127.0.0.10": sensorHandler("AA:AA:AA:AA:AA:AA", "Kitchen"),
+		"127.0.0.6":  http.NotFoundHandler(),
+	})
+	// 127.0.0.10 sorts before 127.0.0.3 as a string, but not as an address
+	_, network, _ := net.ParseCIDR("127.0.0.0/28")
+
+	// Probes finish in any order, so repeat to catch one that depends on it
+	for i := 0; i < 10; i++ {
+		sensors, err := discoverSensors(context.Background(), DiscoveryOptions{Networks: []*net.IPNet{network}, Timeout: time.Second})
+		if err != nil {
+			t.Fatalf("discoverSensors: %v", err)
+		}
+		want := []DiscoveredSensor{
+			{SensorID: "aa:aa:aa:aa:aa:aa", URL: urls["127.0.0.3"], Name: "Kitchen", Place: "outside", Version: "7.02", Source: discoveredByScan},
+			{SensorID: "bb:bb:bb:bb:bb:bb", URL: urls["127.0.0.2"], Name: "Porch", Place: "outside", Version: "7.02", Source: discoveredByScan},
+		}
+		if !reflect.DeepEqual(sensors, want) {
+			t.Fatalf("discoverSensors = %+v, want %+v", sensors, want)
+		}
+	}
+}
+
+func TestDiscoverMovesSensorDevices(t *testing.T) {
+	urls := fakeSensorNetwork(t, map[string]http.Handler{
+		"127.0.0.2": sensorHandler("bb:bb:bb:bb:bb:bb", "Porch"),
+		"127.0.0.3": sensorHandler("aa:aa:aa:aa:aa:aa", "Kitchen"),
+		"127.0.0.5": sensorHandler("aa:aa:aa:aa:aa:aa", "Kitchen"),
+	})
+
+	// The kitchen sensor was last seen where another sensor now answers, so its
+	// circuit has opened
+	kitchen := NewSensorDevice(urls["127.0.0.2"], "AA:AA:AA:AA:AA:AA")
+	for i := 0; i < deviceFailureThreshold; i++ {
+		if _, err := kitchen.Fetch(context.Background()); err == nil {
+			t.Fatal("fetching from a different sensor succeeded")
+		}
+	}
+	if status := kitchen.Status(); status.Circuit != circuitOpen {
+		t.Fatalf("circuit is %s after reading the wrong sensor, want open", status.Circuit)
+	}
+	// A sensor that isn't on the network keeps its address, and a device without an
+	// ID is left alone
+	garage := NewSensorDevice("http://192.0.2.10/json", "cc:cc:cc:cc:cc:cc")
+	plain := NewDevice(urls["127.0.0.5"])
+
+	s := &Server{stopChan: make(chan struct{})}
+	s.collectors = []*Collector{
+		NewCollector("kitchen", kitchen, time.Minute, 0),
+		NewCollector("garage", garage, time.Minute, 0),
+		NewCollector("plain", plain, time.Minute, 0),
+	}
+	cfg := DiscoveryConfig{CIDRs: []string{"127.0.0.0/29"}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	s.discover(cfg)
+
+	if kitchen.URL() != urls["127.0.0.3"] {
+		t.Errorf("kitchen sensor is at %s, want %s", kitchen.URL(), urls["127.0.0.3"])
+	}
+	if status := kitchen.Status(); status.Circuit != circuitClosed {
+		t.Errorf("circuit is %s after the move, want closed", status.Circuit)
+	}
+	if data, err := kitchen.Fetch(context.Background()); err != nil || data.SensorId != "aa:aa:aa:aa:aa:aa" {
+		t.Errorf("fetch after the move: %v", err)
+	}
+	if garage.URL() != "http://192.0.2.10/json" || plain.URL() != urls["127.0.0.5"] {
+		t.Errorf("discovery moved other devices: garage %s, plain %s", garage.URL(), plain.URL())
+	}
+}
+
+func TestNetworkHosts(t *testing.T) {
+	tests := []struct {
+		cidr        string
+		count       int
+		first, last string
+	}{
+		{"192.168.1.0/24", 254, "192.168.1.1", "192.168.1.254"},
+		{"10.0.0.4/30", 2, "10.0.0.5", "10.0.0.6"},
+		// Point-to-point links have no network or broadcast address
+		{"10.0.0.4/31", 2, "10.0.0.4", "10.0.0.5"},
+		{"10.0.0.9/32", 1, "10.0.0.9", "10.0.0.9"},
+		{"192.168.1.77/24", 254, "192.168.1.1", "192.168.1.254"},
+	}
+	for _, tt := range tests {
+		_, network, err := net.ParseCIDR(tt.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts := networkHosts(network)
+		if len(hosts) != tt.count || hosts[0].String() != tt.first || hosts[len(hosts)-1].String() != tt.last {
+			t.Errorf("networkHosts(%s) = %d hosts %v to %v, want %d from %s to %s",
+				tt.cidr, len(hosts), hosts[0], hosts[len(hosts)-1], tt.count, tt.first, tt.last)
+		}
+	}
+}
+
+// dnsName encodes a DNS name as labels
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(name, ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// dnsRecord encodes a resource record with an already encoded name
+func dnsRecord(name []byte, rtype uint16, data []byte) []byte {
+	b := append([]byte(nil), name...)
+	b = append(b, byte(rtype>>8), byte(rtype), 0x80, dnsClassIN) // cache-flush bit set, as mDNS does
+	b = append(b, 0, 0, 0x11, 0x94)                              // TTL
+	b = append(b, byte(len(data)>>8), byte(len(data)))
+	return append(b, data...)
+}
+
+// mdnsResponse builds a response to a PTR query for _http._tcp.local, naming the
+// service instance and host with compression pointers
+func mdnsResponse() []byte {
+	msg := []byte{0, 0, 0x84, 0, 0, 1, 0, 2, 0, 0, 0, 2} // one question, two answers, two additional
+	question := len(msg)
+	msg = append(msg, dnsName("_http._tcp.local")...)
+	msg = append(msg, 0, dnsTypePTR, 0, dnsClassIN)
+
+	pointer := func(off int) []byte { return []byte{0xC0 | byte(off>>8), byte(off)} }
+	// The PTR record's name points at the question, and its data names an instance
+	// under it
+	instance := append([]byte{6}, "sensor"...)
+	instance = append(instance, pointer(question)...)
+	msg = append(msg, dnsRecord(pointer(question), dnsTypePTR, instance)...)
+
+	host := len(msg)
+	msg = append(msg, dnsRecord(dnsName("purpleair-1.local"), dnsTypeA, []byte{192, 168, 1, 40})...)
+	// The additional records use a pointer to the host name, and one is an AAAA record
+	msg = append(msg, dnsRecord(pointer(host), 28, net.ParseIP("fe80::1"))...)
+	msg = append(msg, dnsRecord(pointer(host), dnsTypeA, []byte{192, 168, 1, 41})...)
+	return msg
+}
+
+func TestDNSAddresses(t *testing.T) {
+	msg := mdnsResponse()
+	addresses, err := dnsAddresses(msg)
+	if err != nil {
+		t.Fatalf("dnsAddresses: %v", err)
+	}
+	got := fmt.Sprint(addresses)
+	if want := "[192.168.1.40 192.168.1.41]"; got != want {
+		t.Errorf("dnsAddresses = %s, want %s", got, want)
+	}
+
+	// Every truncated message is an error, without reading past its end
+	for n := 0; n < len(msg); n++ {
+		if addresses, err := dnsAddresses(msg[:n]); err == nil {
+			t.Errorf("message truncated to %d of %d bytes: got %v and no error", n, len(msg), addresses)
+		}
+	}
+}
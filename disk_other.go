@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+// diskUsage is not implemented on this platform, so the disk space check is skipped
+func diskUsage(path string) (free, total uint64, err error) {
+	return 0, 0, errDiskUsageUnsupported
+}
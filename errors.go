@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes sent in the "code" field of error responses. Clients should branch on
+// these rather than on messages, which may change.
+const (
+	errInvalidParameter    = "invalid_parameter"
+	errInvalidRequest      = "invalid_request"
+	errUnauthorized        = "unauthorized"
+	errForbidden           = "forbidden"
+	errNotFound            = "not_found"
+	errMethodNotAllowed    = "method_not_allowed"
+	errRateLimited         = "rate_limited"
+	errDatabaseUnavailable = "database_unavailable"
+	errDeviceUnavailable   = "device_unavailable"
+	errInternal            = "internal_error"
+)
+
+// errorCodes lists every error code with a description, for the API documentation
+var errorCodes = []struct {
+	Code        string
+	Description string
+}{
+	{errInvalidParameter, "A query or path parameter is missing or invalid"},
+	{errInvalidRequest, "The request body could not be used"},
+	{errUnauthorized, "An API key is required, or the one sent is unknown"},
+	{errForbidden, "The API key's role does not allow the request"},
+	{errNotFound, "No such resource"},
+	{errMethodNotAllowed, "The resource does not support the request method"},
+	{errRateLimited, "Too many requests; retry after the Retry-After header's seconds"},
+	{errDatabaseUnavailable, "The database is not available"},
+	{errDeviceUnavailable, "The sensor could not be reached or returned bad data"},
+	{errInternal, "The server failed to handle the request"},
+}
+
+// APIError is the body of every error response, inside an "error" object
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeError sends an error response in the JSON envelope
+//
+//	{"error": {"code": "invalid_parameter", "message": "...", "request_id": "..."}}
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]APIError{
+		"error": {Code: code, Message: message, RequestID: requestID(r.Context())},
+	})
+}
+
+// badParameter sends a 400 response for an invalid request parameter
+func badParameter(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, http.StatusBadRequest, errInvalidParameter, err.Error())
+}
+
+// databaseUnavailable sends a 503 response when the server has no database
+func databaseUnavailable(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusServiceUnavailable, errDatabaseUnavailable, "Database not available")
+}
+
+// notFound sends a 404 response in the JSON envelope
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, errNotFound, "No such resource: "+r.URL.Path)
+}
+
+// methodNotAllowed sends a 405 response in the JSON envelope
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, errMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportWriter writes measurement rows in a specific export format
+type exportWriter interface {
+	WriteHeader(fields []string) error
+	WriteRow(values []interface{}) error
+	Flush() error
+}
+
+// newExportWriter returns the writer for the requested format
+func newExportWriter(format string, w io.Writer) (exportWriter, error) {
+	switch format {
+	case "", "csv":
+		return &csvExportWriter{w: csv.NewWriter(w)}, nil
+	case "ndjson":
+		return &ndjsonExportWriter{w: w}, nil
+	default:
+		return nil, fmt.Errorf("unsupported export format: %s", format)
+	}
+}
+
+// exportContentType returns the MIME type and file extension for an export format
+func exportContentType(format string) (string, string) {
+	if format == "ndjson" {
+		return "application/x-ndjson", "ndjson"
+	}
+	return "text/csv", "csv"
+}
+
+// exportFilename builds the attachment filename for an export of the given range
+func exportFilename(r TimeRange, format string) string {
+	_, ext := exportContentType(format)
+	return fmt.Sprintf("measurements-%s-%s.%s",
+		r.Start.UTC().Format("20060102T150405Z"), r.End.UTC().Format("20060102T150405Z"), ext)
+}
+
+// csvExportWriter writes rows as RFC 4180 CSV
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvExportWriter) WriteHeader(fields []string) error {
+	return c.w.Write(fields)
+}
+
+func (c *csvExportWriter) WriteRow(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = formatExportValue(v)
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvExportWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// ndjsonExportWriter writes one JSON object per line, keeping the requested field order
+type ndjsonExportWriter struct {
+	w      io.Writer
+	fields []string
+}
+
+func (n *ndjsonExportWriter) WriteHeader(fields []string) error {
+	n.fields = fields
+	return nil
+}
+
+func (n *ndjsonExportWriter) WriteRow(values []interface{}) error {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(n.fields[i])
+		b.Write(key)
+		b.WriteByte(':')
+
+		switch val := v.(type) {
+		case time.Time:
+			v = val.UTC().Format(time.RFC3339)
+		case []byte:
+			v = string(val)
+		}
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to encode field %s: %w", n.fields[i], err)
+		}
+		b.Write(encoded)
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(n.w, b.String())
+	return err
+}
+
+func (n *ndjsonExportWriter) Flush() error {
+	return nil
+}
+
+// formatExportValue converts a scanned database value to its CSV representation
+func formatExportValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return val.UTC().Format(time.RFC3339)
+	case []byte:
+		return string(val)
+	case string:
+		return val
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// exportMeasurements streams the measurements matching q to w in the given format
+func exportMeasurements(database Storage, w io.Writer, q MeasurementQuery, format string, flush func()) (int, error) {
+	writer, err := newExportWriter(format, w)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := writer.WriteHeader(q.Fields); err != nil {
+		return 0, fmt.Errorf("failed to write header: %w", err)
+	}
+
+	count := 0
+	err = database.QueryMeasurements(q, func(values []interface{}) error {
+		if err := writer.WriteRow(values); err != nil {
+			return fmt.Errorf("failed to write row: %w", err)
+		}
+		count++
+		// Push data to the client periodically so large exports don't sit in buffers
+		if count%500 == 0 {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+			if flush != nil {
+				flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	if err := writer.Flush(); err != nil {
+		return count, fmt.Errorf("failed to flush export: %w", err)
+	}
+	return count, nil
+}
+
+// runExportCommand implements the `export` CLI command for scripted and cron exports
+func runExportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDatabasePath(), "SQLite database path or postgres:// connection URL")
+	startFlag := fs.String("start", "", "start of the range (RFC 3339 or YYYY-MM-DD, default 24h before end)")
+	endFlag := fs.String("end", "", "end of the range, exclusive (RFC 3339 or YYYY-MM-DD, default now)")
+	tz := fs.String("tz", "", "time zone for YYYY-MM-DD dates, e.g. America/Chicago (default UTC)")
+	sensorID := fs.String("sensor", "", "only export measurements from this sensor ID")
+	format := fs.String("format", "csv", "output format: csv or ndjson")
+	fieldList := fs.String("fields", "", "comma separated list of fields (default all)")
+	output := fs.String("o", "", "output file (default stdout)")
+	fs.Parse(args)
+
+	params := url.Values{}
+	params.Set("start", *startFlag)
+	params.Set("end", *endFlag)
+	params.Set("tz", *tz)
+	params.Set("sensor", *sensorID)
+	params.Set("fields", *fieldList)
+	q, err := parseMeasurementQuery(params, 24)
+	if err != nil {
+		return err
+	}
+
+	database, err := OpenStorage(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	buffered := bufio.NewWriter(w)
+	count, err := exportMeasurements(database, buffered, q, *format, nil)
+	if err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d measurements\n", count)
+	return nil
+}
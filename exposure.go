@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultPM25Threshold is the PM2.5 concentration, in µg/m³, above which time counts
+	// as exposure; it matches the EPA 24-hour standard
+	defaultPM25Threshold = 35.0
+
+	// defaultAQIThreshold is the AQI above which time counts as exposure (Unhealthy for
+	// Sensitive Groups and worse)
+	defaultAQIThreshold = 100
+
+	// defaultDailyStandard is the EPA 24-hour PM2.5 standard in µg/m³
+	defaultDailyStandard = 35.0
+
+	// defaultMaxSampleGap is the longest time a single reading is taken to represent;
+	// longer gaps count as missing data and break a continuous exceedance
+	defaultMaxSampleGap = 15 * time.Minute
+)
+
+// ExposureThresholds configures an exposure report
+type ExposureThresholds struct {
+	PM25          float64 `json:"pm25"`
+	AQI           int     `json:"aqi"`
+	DailyStandard float64 `json:"daily_standard"`
+	MaxGapMinutes float64 `json:"max_gap_minutes"`
+}
+
+// Exceedance is a continuous period above the PM2.5 threshold
+type Exceedance struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Hours float64   `json:"hours"`
+	Peak  float64   `json:"peak_pm25"`
+}
+
+// ExceedanceDay is a day whose mean PM2.5 exceeded the 24-hour standard, counted only
+// for days with readings covering at least minDayCompleteness of the day
+type ExceedanceDay struct {
+	Date     string  `json:"date"`
+	MeanPM25 float64 `json:"mean_pm25"`
+}
+
+// SensorExposure reports one sensor's exposure over the report range. PM2.5 is the mean
+// of the channel A and B CF=1 readings, and each reading is weighted by the time until
+// the next one.
+type SensorExposure struct {
+	SensorID           string          `json:"sensor_id"`
+	Samples            int             `json:"samples"`
+	HoursCovered       float64         `json:"hours_covered"`
+	HoursAbovePM25     float64         `json:"hours_above_pm25"`
+	HoursAboveAQI      float64         `json:"hours_above_aqi"`
+	CumulativeExposure float64         `json:"cumulative_exposure"`
+	MeanPM25           float64         `json:"mean_pm25"`
+	DaysAboveStandard  int             `json:"days_above_standard"`
+	ExceedanceDays     []ExceedanceDay `json:"exceedance_days"`
+	LongestExceedance  *Exceedance     `json:"longest_exceedance"`
+}
+
+// ExposureReport is the /api/exposure response
+type ExposureReport struct {
+	Start      time.Time          `json:"start"`
+	End        time.Time          `json:"end"`
+	Timezone   string             `json:"timezone"`
+	Thresholds ExposureThresholds `json:"thresholds"`
+	Sensors    []*SensorExposure  `json:"sensors"`
+}
+
+// exposureDay accumulates the time-weighted PM2.5 for one calendar day
+type exposureDay struct {
+	weighted float64
+	hours    float64
+	length   time.Duration
+}
+
+// exposureState tracks one sensor while its readings are streamed in time order
+type exposureState struct {
+	report  *SensorExposure
+	last    time.Time
+	lastPM  float64
+	lastDur time.Duration
+	days    map[string]*exposureDay
+	current *Exceedance
+}
+
+// parseExposureThresholds reads the pm25, aqi, daily_standard and max_gap parameters
+func parseExposureThresholds(query url.Values) (ExposureThresholds, error) {
+	t := ExposureThresholds{
+		PM25:          defaultPM25Threshold,
+		AQI:           defaultAQIThreshold,
+		DailyStandard: defaultDailyStandard,
+		MaxGapMinutes: defaultMaxSampleGap.Minutes(),
+	}
+
+	floatParam := func(name string, dest *float64) error {
+		value := query.Get(name)
+		if value == "" {
+			return nil
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("invalid %s %q", name, value)
+		}
+		*dest = parsed
+		return nil
+	}
+
+	if err := floatParam("pm25", &t.PM25); err != nil {
+		return t, err
+	}
+	if err := floatParam("daily_standard", &t.DailyStandard); err != nil {
+		return t, err
+	}
+	if err := floatParam("max_gap", &t.MaxGapMinutes); err != nil {
+		return t, err
+	}
+	if t.MaxGapMinutes == 0 {
+		return t, fmt.Errorf("max_gap must be greater than zero")
+	}
+	if value := query.Get("aqi"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return t, fmt.Errorf("invalid aqi %q", value)
+		}
+		t.AQI = parsed
+	}
+	return t, nil
+}
+
+// computeExposure builds an exposure report for the measurements matching q. Days for the
+// 24-hour standard are calendar days in loc.
+func computeExposure(database Storage, q MeasurementQuery, thresholds ExposureThresholds, loc *time.Location) (*ExposureReport, error) {
+	maxGap := time.Duration(thresholds.MaxGapMinutes * float64(time.Minute))
+	states := make(map[string]*exposureState)
+
+	// Each reading is credited once the next one shows how long it lasted
+	credit := func(s *exposureState, dur time.Duration) {
+		gap := dur > maxGap
+		if gap {
+			dur = maxGap
+		}
+		hours := dur.Hours()
+		r := s.report
+		r.HoursCovered += hours
+		r.CumulativeExposure += s.lastPM * hours
+
+		s.creditDays(s.last, dur, loc)
+
+		if PM25AQI(s.lastPM) > thresholds.AQI {
+			r.HoursAboveAQI += hours
+		}
+		if s.lastPM > thresholds.PM25 {
+			r.HoursAbovePM25 += hours
+			if s.current == nil {
+				s.current = &Exceedance{Start: s.last}
+			}
+			s.current.End = s.last.Add(dur)
+			s.current.Hours += hours
+			if s.lastPM > s.current.Peak {
+				s.current.Peak = s.lastPM
+			}
+		}
+
+		// The run ends at a reading below the threshold or at a gap in the data
+		if s.lastPM <= thresholds.PM25 || gap {
+			s.endExceedance()
+		}
+		s.lastDur = dur
+	}
+
+	q.Fields = []string{"observed_at", "sensor_id", "pm25_cf1", "pm25_cf1_b"}
+	err := database.QueryMeasurements(q, func(values []interface{}) error {
+		observed, err := scannedTime(values[0])
+		if err != nil {
+			return err
+		}
+		pm, ok := samplePM25(values[2], values[3])
+		if !ok {
+			return nil
+		}
+		sensorID := scannedString(values[1])
+
+		s := states[sensorID]
+		if s == nil {
+			s = &exposureState{
+				report: &SensorExposure{SensorID: sensorID, ExceedanceDays: []ExceedanceDay{}},
+				days:   make(map[string]*exposureDay),
+			}
+			states[sensorID] = s
+		} else {
+			credit(s, observed.Sub(s.last))
+		}
+
+		s.report.Samples++
+		s.last = observed
+		s.lastPM = pm
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute exposure: %w", err)
+	}
+
+	report := &ExposureReport{
+		Start:      q.Range.Start,
+		End:        q.Range.End,
+		Timezone:   loc.String(),
+		Thresholds: thresholds,
+		Sensors:    []*SensorExposure{},
+	}
+
+	for _, s := range states {
+		// The final reading is taken to last as long as the one before it
+		if s.report.Samples > 1 {
+			credit(s, s.lastDur)
+		}
+		s.endExceedance()
+
+		r := s.report
+		if r.HoursCovered > 0 {
+			r.MeanPM25 = r.CumulativeExposure / r.HoursCovered
+		}
+		for date, day := range s.days {
+			// Like the daily summaries, a day's mean only counts with enough of it covered
+			if day.hours == 0 || day.hours/day.length.Hours()*100 < minDayCompleteness {
+				continue
+			}
+			if mean := day.weighted / day.hours; mean > thresholds.DailyStandard {
+				r.ExceedanceDays = append(r.ExceedanceDays, ExceedanceDay{Date: date, MeanPM25: mean})
+			}
+		}
+		sort.Slice(r.ExceedanceDays, func(i, j int) bool {
+			return r.ExceedanceDays[i].Date < r.ExceedanceDays[j].Date
+		})
+		r.DaysAboveStandard = len(r.ExceedanceDays)
+		report.Sensors = append(report.Sensors, r)
+	}
+
+	sort.Slice(report.Sensors, func(i, j int) bool {
+		return report.Sensors[i].SensorID < report.Sensors[j].SensorID
+	})
+	return report, nil
+}
+
+// creditDays adds the last reading, lasting dur from start, to the calendar days in loc
+// it covers, splitting it at midnight
+func (s *exposureState) creditDays(start time.Time, dur time.Duration, loc *time.Location) {
+	end := start.Add(dur)
+	for start.Before(end) {
+		local := start.In(loc)
+		dayStart := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		dayEnd := dayStart.AddDate(0, 0, 1)
+		spanEnd := end
+		if dayEnd.Before(spanEnd) {
+			spanEnd = dayEnd
+		}
+
+		date := dayStart.Format(summaryDateFormat)
+		day := s.days[date]
+		if day == nil {
+			// Days are 23 or 25 hours long when daylight saving time changes
+			day = &exposureDay{length: dayEnd.Sub(dayStart)}
+			s.days[date] = day
+		}
+		hours := spanEnd.Sub(start).Hours()
+		day.weighted += s.lastPM * hours
+		day.hours += hours
+		start = spanEnd
+	}
+}
+
+// endExceedance closes the current exceedance, keeping it if it is the longest so far
+func (s *exposureState) endExceedance() {
+	if s.current == nil {
+		return
+	}
+	if s.report.LongestExceedance == nil || s.current.Hours > s.report.LongestExceedance.Hours {
+		s.report.LongestExceedance = s.current
+	}
+	s.current = nil
+}
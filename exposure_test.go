@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// storeReadings stores a reading of pm every step from start for dur
+func storeReadings(t *testing.T, storage Storage, start time.Time, dur, step time.Duration, pm float64) {
+	t.Helper()
+	var batch []*AirQualityData
+	for at := start; at.Before(start.Add(dur)); at = at.Add(step) {
+		data := testMeasurement("a", at, PM25AQI(pm), pm)
+		data.Pm25Cf1B = pm
+		batch = append(batch, data)
+	}
+	if err := storage.StoreMeasurements(batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExposureDaysNeedCompleteData(t *testing.T) {
+	storage := NewMemoryDatabase(1000)
+	day := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	// July 1: one short spike in otherwise missing data
+	storeReadings(t, storage, day.Add(12*time.Hour), 10*time.Minute, 10*time.Minute, 300)
+	// July 2: 17 hours of readings above the standard, one short of 75%
+	storeReadings(t, storage, day.AddDate(0, 0, 1), 17*time.Hour, 10*time.Minute, 50)
+	// July 3: 19 hours above the standard
+	storeReadings(t, storage, day.AddDate(0, 0, 2), 19*time.Hour, 10*time.Minute, 50)
+
+	thresholds := ExposureThresholds{PM25: 35, AQI: 100, DailyStandard: 35, MaxGapMinutes: 15}
+	q := MeasurementQuery{Range: TimeRange{Start: day, End: day.AddDate(0, 0, 4)}}
+	report, err := computeExposure(storage, q, thresholds, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Sensors) != 1 {
+		t.Fatalf("report has %d sensors, want 1", len(report.Sensors))
+	}
+	days := report.Sensors[0].ExceedanceDays
+	if len(days) != 1 || days[0].Date != "2024-07-03" {
+		t.Errorf("exceedance days = %+v, want only 2024-07-03", days)
+	}
+}
+
+func TestExposureSplitsReadingsAtMidnight(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone data is not available")
+	}
+	s := &exposureState{days: make(map[string]*exposureDay), lastPM: 40}
+
+	// 20 minutes starting 10 minutes before midnight
+	s.creditDays(time.Date(2024, 3, 9, 23, 50, 0, 0, loc), 20*time.Minute, loc)
+	for _, date := range []string{"2024-03-09", "2024-03-10"} {
+		day := s.days[date]
+		if day == nil || math.Abs(day.hours-1.0/6) > 1e-9 || math.Abs(day.weighted-40.0/6) > 1e-9 {
+			t.Errorf("%s = %+v, want 10 minutes at 40 µg/m³", date, day)
+		}
+	}
+
+	// Daylight saving time starts on March 10, which is 23 hours long
+	if length := s.days["2024-03-10"].length; length != 23*time.Hour {
+		t.Errorf("2024-03-10 is %s long, want 23h", length)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Health check results
+const (
+	checkOK      = "ok"
+	checkFailed  = "failed"
+	checkPending = "pending"
+	checkSkipped = "skipped"
+)
+
+const (
+	// staleCollectionIntervals is how many collection intervals may pass without a
+	// stored measurement before a sensor counts as stale
+	staleCollectionIntervals = 3
+
+	// minFreeDiskBytes is the free space below which the database disk counts as full
+	minFreeDiskBytes = 100 << 20
+
+	// minFreeDiskRatio is the fraction of the disk that must stay free, for small disks
+	minFreeDiskRatio = 0.02
+)
+
+// errDiskUsageUnsupported is returned by diskUsage on platforms without statfs
+var errDiskUsageUnsupported = errors.New("disk usage is not supported on this platform")
+
+// HealthCheck is the result of one readiness check. Details hold check-specific values
+// such as free bytes or per-sensor ages.
+type HealthCheck struct {
+	Status     string                 `json:"status"`
+	Message    string                 `json:"message,omitempty"`
+	DurationMs float64                `json:"duration_ms"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+// handleLive serves the liveness check: the process is up and serving requests. It
+// checks nothing else, so an orchestrator doesn't restart the server over problems a
+// restart can't fix, like an unreachable sensor.
+func (s *Server) handleLive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "alive",
+		"timestamp": time.Now().UTC(),
+	})
+}
+
+// handleReady serves the readiness check, responding 503 with the failing checks when
+// the server can't do its job
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	s.writeReadiness(w, s.readiness(), nil)
+}
+
+// handleHealth serves the readiness checks together with operational statistics
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	extra := make(map[string]interface{})
+	if queue, ok := s.database.(*WriteQueue); ok {
+		extra["write_queue"] = queue.Stats()
+	}
+	if s.limiter != nil {
+		extra["rate_limit"] = s.limiter.Stats()
+	}
+	s.writeReadiness(w, s.readiness(), extra)
+}
+
+// writeReadiness writes the check results, with any extra top-level fields
+func (s *Server) writeReadiness(w http.ResponseWriter, checks map[string]HealthCheck, extra map[string]interface{}) {
+	status, code := "healthy", http.StatusOK
+	for _, check := range checks {
+		if check.Status == checkFailed {
+			status, code = "degraded", http.StatusServiceUnavailable
+		}
+	}
+
+	body := map[string]interface{}{
+		"status":    status,
+		"timestamp": time.Now().UTC(),
+		"service":   "air-quality-monitor",
+		"checks":    checks,
+	}
+	for k, v := range extra {
+		body[k] = v
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// readiness runs every readiness check
+func (s *Server) readiness() map[string]HealthCheck {
+	now := time.Now()
+	return map[string]HealthCheck{
+		"database":   timed(s.checkDatabase),
+		"disk":       timed(s.checkDisk),
+		"collection": timed(func() HealthCheck { return s.checkCollection(now) }),
+		"devices":    timed(s.checkDevices),
+	}
+}
+
+// timed runs a check and records how long it took
+func timed(check func() HealthCheck) HealthCheck {
+	start := time.Now()
+	result := check()
+	result.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	return result
+}
+
+// checkDatabase verifies the database is reachable and writable
+func (s *Server) checkDatabase() HealthCheck {
+	if s.database == nil {
+		return HealthCheck{Status: checkFailed, Message: "Database not available"}
+	}
+	if err := s.database.CheckHealth(); err != nil {
+		return HealthCheck{Status: checkFailed, Message: err.Error()}
+	}
+	if queue, ok := s.database.(*WriteQueue); ok {
+		if stats := queue.Stats(); stats.Depth >= stats.Capacity {
+			return HealthCheck{Status: checkFailed, Message: "Write queue is full"}
+		}
+	}
+	return HealthCheck{Status: checkOK}
+}
+
+// checkDisk verifies the disk holding a SQLite database has room to grow
+func (s *Server) checkDisk() HealthCheck {
+	database, ok := sqliteDatabase(s.database)
+	if !ok {
+		return HealthCheck{Status: checkSkipped, Message: "Only checked for SQLite databases"}
+	}
+
+	dir := filepath.Dir(database.path)
+	free, total, err := diskUsage(dir)
+	if errors.Is(err, errDiskUsageUnsupported) {
+		return HealthCheck{Status: checkSkipped, Message: err.Error()}
+	}
+	if err != nil {
+		return HealthCheck{Status: checkFailed, Message: "Failed to read disk usage: " + err.Error()}
+	}
+
+	check := HealthCheck{
+		Status:  checkOK,
+		Details: map[string]interface{}{"path": dir, "free_bytes": free, "total_bytes": total},
+	}
+	if free < minFreeDiskBytes || float64(free) < float64(total)*minFreeDiskRatio {
+		check.Status = checkFailed
+		check.Message = "Database disk is nearly full"
+	}
+	return check
+}
+
+// checkCollection verifies every sensor has had a measurement stored within a few of
+// its collection intervals. A sensor not yet collected from is pending until that
+// much time has passed since its collector started. Paused sensors aren't checked.
+func (s *Server) checkCollection(now time.Time) HealthCheck {
+	check := HealthCheck{Status: checkOK}
+	collectors := s.collectorList()
+	sensors := make(map[string]interface{}, len(collectors))
+	var stale, pending, paused []string
+	for _, c := range collectors {
+		status := c.Status()
+		sensors[status.Name] = status
+		maxAge := staleCollectionIntervals * c.Interval()
+		switch {
+		case status.Paused:
+			paused = append(paused, status.Name)
+		case status.LastCollected != nil:
+			if now.Sub(*status.LastCollected) > maxAge {
+				stale = append(stale, status.Name)
+			}
+		case c.startedAt().IsZero() || now.Sub(c.startedAt()) < maxAge:
+			pending = append(pending, status.Name)
+		default:
+			stale = append(stale, status.Name)
+		}
+	}
+	check.Details = map[string]interface{}{"sensors": sensors}
+
+	switch {
+	case len(stale) > 0:
+		sort.Strings(stale)
+		check.Status = checkFailed
+		check.Message = "No recent measurements from " + strings.Join(stale, ", ")
+	case len(pending) > 0:
+		sort.Strings(pending)
+		check.Status = checkPending
+		check.Message = "No measurements collected yet from " + strings.Join(pending, ", ")
+	case len(paused) > 0:
+		sort.Strings(paused)
+		check.Message = "Collection paused for " + strings.Join(paused, ", ")
+	}
+	return check
+}
+
+// checkDevices verifies no device's circuit breaker is open
+func (s *Server) checkDevices() HealthCheck {
+	check := HealthCheck{Status: checkOK}
+	var open []string
+	devices := make(map[string]interface{})
+	for _, device := range s.devices() {
+		status := device.Status()
+		key := status.URL
+		if key == "" {
+			// A sensor discovery hasn't found yet
+			key = status.SensorID
+		}
+		devices[key] = status
+		if status.Circuit == circuitOpen {
+			open = append(open, key)
+		}
+	}
+	check.Details = map[string]interface{}{"devices": devices}
+	if len(open) > 0 {
+		check.Status = checkFailed
+		check.Message = "Circuit open for " + strings.Join(open, ", ")
+	}
+	return check
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// importBatchSize is the number of rows written per import transaction
+const importBatchSize = 500
+
+// maxImportErrors caps the number of row errors reported back for a single import
+const maxImportErrors = 20
+
+// ImportResult summarizes an import of one or more SD card log files
+type ImportResult struct {
+	Files    int      `json:"files"`
+	Rows     int      `json:"rows"`
+	Inserted int      `json:"inserted"`
+	Skipped  int      `json:"skipped"`
+	Invalid  int      `json:"invalid"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// addError records a row error, keeping only the first few messages
+func (r *ImportResult) addError(format string, args ...interface{}) {
+	r.Invalid++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+// sdColumnSetter assigns a single CSV value to the matching AirQualityData field
+type sdColumnSetter func(data *AirQualityData, value string) error
+
+func setString(field func(*AirQualityData) *string) sdColumnSetter {
+	return func(data *AirQualityData, value string) error {
+		*field(data) = value
+		return nil
+	}
+}
+
+func setInt(field func(*AirQualityData) *int) sdColumnSetter {
+	return func(data *AirQualityData, value string) error {
+		if value == "" {
+			return nil
+		}
+		// Some firmware versions write integer columns with a decimal part
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		*field(data) = int(f)
+		return nil
+	}
+}
+
+func setFloat(field func(*AirQualityData) *float64) sdColumnSetter {
+	return func(data *AirQualityData, value string) error {
+		if value == "" {
+			return nil
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		*field(data) = f
+		return nil
+	}
+}
+
+// sdCardColumns maps PurpleAir SD card log headers onto the measurement fields we store
+var sdCardColumns = map[string]sdColumnSetter{
+	"UTCDateTime":          setString(func(d *AirQualityData) *string { return &d.DateTime }),
+	"mac_address":          setString(func(d *AirQualityData) *string { return &d.SensorId }),
+	"firmware_ver":         setString(func(d *AirQualityData) *string { return &d.Version }),
+	"hardware":             setString(func(d *AirQualityData) *string { return &d.Hardwareversion }),
+	"current_temp_f":       setFloat(func(d *AirQualityData) *float64 { return &d.CurrentTempF }),
+	"current_humidity":     setInt(func(d *AirQualityData) *int { return &d.CurrentHumidity }),
+	"current_dewpoint_f":   setFloat(func(d *AirQualityData) *float64 { return &d.CurrentDewpointF }),
+	"pressure":             setFloat(func(d *AirQualityData) *float64 { return &d.Pressure }),
+	"adc":                  setFloat(func(d *AirQualityData) *float64 { return &d.Adc }),
+	"mem":                  setInt(func(d *AirQualityData) *int { return &d.Mem }),
+	"rssi":                 setInt(func(d *AirQualityData) *int { return &d.Rssi }),
+	"uptime":               setInt(func(d *AirQualityData) *int { return &d.Uptime }),
+	"gas":                  setFloat(func(d *AirQualityData) *float64 { return &d.Gas680 }),
+	"pm1_0_cf_1":           setFloat(func(d *AirQualityData) *float64 { return &d.Pm10Cf1 }),
+	"pm2_5_cf_1":           setFloat(func(d *AirQualityData) *float64 { return &d.Pm25Cf1 }),
+	"pm10_0_cf_1":          setFloat(func(d *AirQualityData) *float64 { return &d.Pm100Cf1 }),
+	"pm1_0_atm":            setFloat(func(d *AirQualityData) *float64 { return &d.Pm10Atm }),
+	"pm2_5_atm":            setFloat(func(d *AirQualityData) *float64 { return &d.Pm25Atm }),
+	"pm10_0_atm":           setFloat(func(d *AirQualityData) *float64 { return &d.Pm100Atm }),
+	"pm2.5_aqi_atm":        setInt(func(d *AirQualityData) *int { return &d.Pm25Aqi }),
+	"pm1_0_cf_1_b":         setFloat(func(d *AirQualityData) *float64 { return &d.Pm10Cf1B }),
+	"pm2_5_cf_1_b":         setFloat(func(d *AirQualityData) *float64 { return &d.Pm25Cf1B }),
+	"pm10_0_cf_1_b":        setFloat(func(d *AirQualityData) *float64 { return &d.Pm100Cf1B }),
+	"pm1_0_atm_b":          setFloat(func(d *AirQualityData) *float64 { return &d.Pm10AtmB }),
+	"pm2_5_atm_b":          setFloat(func(d *AirQualityData) *float64 { return &d.Pm25AtmB }),
+	"pm10_0_atm_b":         setFloat(func(d *AirQualityData) *float64 { return &d.Pm100AtmB }),
+	"pm2.5_aqi_atm_b":      setInt(func(d *AirQualityData) *int { return &d.Pm25AqiB }),
+	"current_temp_f_680":   setFloat(func(d *AirQualityData) *float64 { return &d.CurrentTempF680 }),
+	"current_humidity_680": setInt(func(d *AirQualityData) *int { return &d.CurrentHumidity680 }),
+	"pressure_680":         setFloat(func(d *AirQualityData) *float64 { return &d.Pressure680 }),
+	"gas_680":              setFloat(func(d *AirQualityData) *float64 { return &d.Gas680 }),
+}
+
+// importSDCardCSV parses a PurpleAir SD card CSV log and stores its rows, adding the
+// outcome to result. sensorID overrides the mac_address column when set.
+func importSDCardCSV(database Storage, r io.Reader, name, sensorID string, result *ImportResult) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("%s: failed to read header: %w", name, err)
+	}
+
+	setters := make([]sdColumnSetter, len(header))
+	hasTime := false
+	for i, column := range header {
+		column = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))
+		setters[i] = sdCardColumns[column]
+		if column == "UTCDateTime" {
+			hasTime = true
+		}
+	}
+	if !hasTime {
+		return fmt.Errorf("%s: missing UTCDateTime column, not a PurpleAir SD card log", name)
+	}
+
+	result.Files++
+	batch := make([]*AirQualityData, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		inserted, skipped, err := database.ImportMeasurements(batch)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		result.Inserted += inserted
+		result.Skipped += skipped
+		batch = batch[:0]
+		return nil
+	}
+
+	line := 1
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		line++
+		if err != nil {
+			result.Rows++
+			result.addError("%s line %d: %v", name, line, err)
+			continue
+		}
+		// Units that reboot mid-file repeat the header row
+		if len(record) > 0 && record[0] == header[0] {
+			continue
+		}
+		result.Rows++
+
+		data, err := parseSDCardRecord(setters, header, record)
+		if err != nil {
+			result.addError("%s line %d: %v", name, line, err)
+			continue
+		}
+		if sensorID != "" {
+			data.SensorId = sensorID
+		}
+		if data.SensorId == "" {
+			result.addError("%s line %d: missing mac_address, use a sensor override", name, line)
+			continue
+		}
+
+		batch = append(batch, data)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return flush()
+}
+
+// parseSDCardRecord converts one CSV record into an AirQualityData using the header setters
+func parseSDCardRecord(setters []sdColumnSetter, header, record []string) (*AirQualityData, error) {
+	data := &AirQualityData{}
+	for i, value := range record {
+		if i >= len(setters) || setters[i] == nil {
+			continue
+		}
+		if err := setters[i](data, strings.TrimSpace(value)); err != nil {
+			return nil, fmt.Errorf("invalid %s value %q", header[i], value)
+		}
+	}
+
+	// Normalize the DateTime so it matches what the live /json endpoint reports
+	observedAt, err := data.ObservedAt()
+	if err != nil {
+		return nil, err
+	}
+	data.DateTime = observedAt.Format(deviceTimeFormat)
+	return data, nil
+}
+
+// runImportCommand implements the `import` CLI command for SD card log backfills
+func runImportCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDatabasePath(), "SQLite database path or postgres:// connection URL")
+	sensorID := fs.String("sensor", "", "sensor ID to record, overriding the mac_address column")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [flags] file.csv...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no files to import")
+	}
+
+	loc, err := summaryLocationFromEnv()
+	if err != nil {
+		return err
+	}
+	storage, err := OpenStorage(*dbPath)
+	if err != nil {
+		return err
+	}
+	// Closing the tracker updates the daily summaries for the imported days
+	database := NewSummaryTracker(storage, loc)
+	defer database.Close()
+
+	var result ImportResult
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		err = importSDCardCSV(database, f, path, *sensorID, &result)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, msg := range result.Errors {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", msg)
+	}
+	fmt.Printf("Imported %d files: %d rows, %d inserted, %d skipped, %d invalid\n",
+		result.Files, result.Rows, result.Inserted, result.Skipped, result.Invalid)
+	return nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log output formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// requestIDHeader carries the correlation ID of a request, both from clients and
+// reverse proxies that set one and back in every response
+const requestIDHeader = "X-Request-ID"
+
+// LoggingConfig controls where log records go and which are kept
+type LoggingConfig struct {
+	// Level is the lowest level logged: debug, info, warn or error
+	Level string `json:"level"`
+
+	// Format is text (key=value pairs) or json (one object per line)
+	Format string `json:"format"`
+
+	// File, if set, receives the log instead of stderr. It is rotated when it grows
+	// past MaxSizeMB, keeping MaxBackups old files as File.1, File.2 and so on.
+	File       string `json:"file"`
+	MaxSizeMB  int    `json:"max_size_mb"`
+	MaxBackups int    `json:"max_backups"`
+
+	level slog.Level
+}
+
+// validate fills in defaults and parses the level
+func (c *LoggingConfig) validate() error {
+	if c.Level == "" {
+		c.Level = "info"
+	}
+	if err := c.level.UnmarshalText([]byte(c.Level)); err != nil {
+		return fmt.Errorf("invalid logging.level %q: expected debug, info, warn or error", c.Level)
+	}
+
+	switch c.Format {
+	case "":
+		c.Format = logFormatText
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("invalid logging.format %q: expected %s or %s", c.Format, logFormatText, logFormatJSON)
+	}
+
+	if c.MaxSizeMB < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("logging.max_size_mb and logging.max_backups can't be negative")
+	}
+	if c.MaxSizeMB == 0 {
+		c.MaxSizeMB = 10
+	}
+	if c.MaxBackups == 0 {
+		c.MaxBackups = 5
+	}
+	return nil
+}
+
+// setupLogging makes the configured logger the default for slog and the log package.
+// The returned closer closes the log file, if there is one.
+func setupLogging(cfg LoggingConfig) (io.Closer, error) {
+	var out io.Writer = os.Stderr
+	var closer io.Closer = io.NopCloser(nil)
+	if cfg.File != "" {
+		f, err := openRotatingFile(cfg.File, int64(cfg.MaxSizeMB)<<20, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = f, f
+	}
+
+	opts := &slog.HandlerOptions{Level: cfg.level}
+	var handler slog.Handler
+	if cfg.Format == logFormatJSON {
+		handler = slog.NewJSONHandler(out, opts)
+	} else {
+		handler = slog.NewTextHandler(out, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return closer, nil
+}
+
+// fatal logs an error that stops the server and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// contextHandler adds the request ID from the context to each record, so everything
+// logged while handling a request can be found by its ID
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestIDContextKey is the context key for the correlation ID
+type requestIDContextKey struct{}
+
+// withRequestID returns a context carrying a correlation ID
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// requestID returns the correlation ID carried by ctx, or ""
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random correlation ID
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// validRequestID reports whether an ID sent by a client is safe to log and echo back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder captures the status and size of a response for the request log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets streaming handlers such as the export flush through the recorder
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logRequests is middleware that gives each request a correlation ID and logs it once
+// it completes. Health checks and throttled requests are logged at debug level so
+// monitoring, or a client hammering the server, doesn't drown out everything else.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		ctx := withRequestID(r.Context(), id)
+		w.Header().Set(requestIDHeader, id)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case r.URL.Path == "/health" || strings.HasPrefix(r.URL.Path, "/health/"), rec.status == http.StatusTooManyRequests:
+			level = slog.LevelDebug
+		}
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		slog.Log(ctx, level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"client", client)
+	})
+}
+
+// requestStorage passes calls through to a Storage, logging each one at debug level
+// with the request's correlation ID and how long it took
+type requestStorage struct {
+	Storage
+	ctx context.Context
+}
+
+// storage returns the database for use while handling r
+func (s *Server) storage(r *http.Request) Storage {
+	if s.database == nil {
+		return nil
+	}
+	return &requestStorage{Storage: s.database, ctx: r.Context()}
+}
+
+// Unwrap returns the storage backend behind the request wrapper
+func (d *requestStorage) Unwrap() Storage {
+	return d.Storage
+}
+
+// logCall logs a finished database call
+func (d *requestStorage) logCall(op string, start time.Time, err error) {
+	attrs := []any{"op", op, "duration_ms", float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	slog.DebugContext(d.ctx, "database call", attrs...)
+}
+
+func (d *requestStorage) StoreMeasurement(data *AirQualityData) error {
+	start := time.Now()
+	err := d.Storage.StoreMeasurement(data)
+	d.logCall("StoreMeasurement", start, err)
+	return err
+}
+
+func (d *requestStorage) ImportMeasurements(records []*AirQualityData) (int, int, error) {
+	start := time.Now()
+	inserted, skipped, err := d.Storage.ImportMeasurements(records)
+	d.logCall("ImportMeasurements", start, err)
+	return inserted, skipped, err
+}
+
+func (d *requestStorage) EachMeasurement(q MeasurementQuery, fn func(m Measurement) error) error {
+	start := time.Now()
+	err := d.Storage.EachMeasurement(q, fn)
+	d.logCall("EachMeasurement", start, err)
+	return err
+}
+
+func (d *requestStorage) GetMeasurementStats(q MeasurementQuery) (*MeasurementStats, error) {
+	start := time.Now()
+	stats, err := d.Storage.GetMeasurementStats(q)
+	d.logCall("GetMeasurementStats", start, err)
+	return stats, err
+}
+
+func (d *requestStorage) AggregateMeasurements(q MeasurementQuery, fields []string, offsets []float64, bucket time.Duration, fn func(start time.Time, count int, aggregates []FieldAggregate) error) error {
+	start := time.Now()
+	err := d.Storage.AggregateMeasurements(q, fields, offsets, bucket, fn)
+	d.logCall("AggregateMeasurements", start, err)
+	return err
+}
+
+func (d *requestStorage) QueryMeasurements(q MeasurementQuery, fn func(values []interface{}) error) error {
+	start := time.Now()
+	err := d.Storage.QueryMeasurements(q, fn)
+	d.logCall("QueryMeasurements", start, err)
+	return err
+}
+
+func (d *requestStorage) GetDailySummaries(sensorID, from, to string) ([]DailySummary, error) {
+	start := time.Now()
+	summaries, err := d.Storage.GetDailySummaries(sensorID, from, to)
+	d.logCall("GetDailySummaries", start, err)
+	return summaries, err
+}
+
+func (d *requestStorage) GetAPIKey(hash string) (*APIKey, error) {
+	start := time.Now()
+	key, err := d.Storage.GetAPIKey(hash)
+	d.logCall("GetAPIKey", start, err)
+	return key, err
+}
+
+func (d *requestStorage) TouchAPIKey(id int64, usedAt time.Time) error {
+	start := time.Now()
+	err := d.Storage.TouchAPIKey(id, usedAt)
+	d.logCall("TouchAPIKey", start, err)
+	return err
+}
+
+// rotatingFile is a log file that is renamed aside once it reaches maxSize, keeping
+// at most maxBackups old files
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// openRotatingFile opens path for appending, creating its directory if needed
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the current file rather than losing records
+			fmt.Fprintf(os.Stderr, "Error rotating log file: %v\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts File.N-1 to File.N and so on, moves the current file to File.1 and
+// starts a new one
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		// Reopen the current file so writes can continue
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	return f.open()
+}
+
+// Close closes the log file
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -80,17 +85,42 @@ type AirQualityData struct {
 	Ssid                  string  `json:"ssid"`
 }
 
+// deviceTimeFormat is the layout PurpleAir uses for DateTime, e.g. 2023/08/05T19:20:36z
+const deviceTimeFormat = "2006/01/02T15:04:05z"
+
+// ObservedAt parses the device DateTime into a UTC time
+func (d *AirQualityData) ObservedAt() (time.Time, error) {
+	value := strings.TrimSpace(d.DateTime)
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "z"), "Z")
+	t, err := time.Parse("2006/01/02T15:04:05", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid device DateTime %q: %w", d.DateTime, err)
+	}
+	return t.UTC(), nil
+}
+
 // fetchAirQualityData makes an HTTP request to the IoT device and returns the parsed data
-func fetchAirQualityData(deviceURL string) (*AirQualityData, error) {
+func fetchAirQualityData(ctx context.Context, deviceURL string) (*AirQualityData, error) {
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
 
-	resp, err := client.Get(deviceURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, deviceURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	if id := requestID(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make HTTP request: %w", err)
 	}
 	defer resp.Body.Close()
+	slog.DebugContext(ctx, "Fetched device data", "url", deviceURL, "status", resp.StatusCode,
+		"duration_ms", float64(time.Since(start).Microseconds())/1000)
 
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("HTTP request failed with status: %d", resp.StatusCode)
@@ -157,7 +187,65 @@ func printAirQualityData(data *AirQualityData) {
 		data.Status0, data.Status1, data.Status2, data.Status3, data.Status4)
 }
 
+// defaultDatabasePath returns the PostgreSQL URL from DATABASE_URL, the SQLite path from
+// DATABASE_PATH, or the built-in SQLite default
+func defaultDatabasePath() string {
+	if dbURL := os.Getenv("DATABASE_URL"); dbURL != "" {
+		return dbURL
+	}
+	if dbPath := os.Getenv("DATABASE_PATH"); dbPath != "" {
+		return dbPath
+	}
+	return "air_quality.db"
+}
+
 func main() {
+	// Subcommands take precedence over the device URL argument
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			if err := runExportCommand(os.Args[2:]); err != nil {
+				log.Fatalf("Error exporting measurements: %v", err)
+			}
+			return
+		case "import":
+			if err := runImportCommand(os.Args[2:]); err != nil {
+				log.Fatalf("Error importing measurements: %v", err)
+			}
+			return
+		case "backup":
+			if err := runBackupCommand(os.Args[2:]); err != nil {
+				log.Fatalf("Error backing up database: %v", err)
+			}
+			return
+		case "restore":
+			if err := runRestoreCommand(os.Args[2:]); err != nil {
+				log.Fatalf("Error restoring database: %v", err)
+			}
+			return
+		case "report":
+			if err := runReportCommand(os.Args[2:]); err != nil {
+				log.Fatalf("Error running report: %v", err)
+			}
+			return
+		case "summarize":
+			if err := runSummarizeCommand(os.Args[2:]); err != nil {
+				log.Fatalf("Error summarizing measurements: %v", err)
+			}
+			return
+		case "keys":
+			if err := runKeysCommand(os.Args[2:]); err != nil {
+				log.Fatalf("Error managing API keys: %v", err)
+			}
+			return
+		case "discover":
+			if err := runDiscoverCommand(os.Args[2:]); err != nil {
+				log.Fatalf("Error discovering sensors: %v", err)
+			}
+			return
+		}
+	}
+
 	// Check if server mode is requested
 	if len(os.Args) > 1 && os.Args[1] == "--server" {
 		// Server mode
@@ -176,30 +264,90 @@ func main() {
 		fmt.Printf("Server address: %s\n", serverAddr)
 		fmt.Printf("Web interface: http://localhost%s\n", serverAddr)
 		fmt.Printf("Graphs: http://localhost%s/graphs\n", serverAddr)
+		fmt.Printf("Calendar: http://localhost%s/calendar\n", serverAddr)
 		fmt.Printf("API endpoints:\n")
 		fmt.Printf("  - GET /data/json - Raw JSON data\n")
 		fmt.Printf("  - GET /data - Formatted text data\n")
 		fmt.Printf("  - GET /health - Health check\n")
+		fmt.Printf("  - GET /health/live, /health/ready - Liveness and readiness probes\n")
 		fmt.Printf("  - GET /graphs - Historical graphs\n")
-		fmt.Printf("  - GET /api/measurements - Measurement data for graphing\n")
-		fmt.Printf("  - GET /api/stats - Statistics\n\n")
+		fmt.Printf("  - GET /api/v1/measurements - Measurement data for graphing\n")
+		fmt.Printf("  - GET /api/v1/stats - Statistics\n")
+		fmt.Printf("  - GET /api/v1/daily - Daily summaries\n")
+		fmt.Printf("  - GET /api/v1/export - CSV/NDJSON export\n")
+		fmt.Printf("  - POST /api/v1/import - SD card CSV import\n")
+		fmt.Printf("  - GET /api/v1/admin/collectors - Collection status and control\n")
+		fmt.Printf("  - GET /api/openapi.json - OpenAPI description of every endpoint\n\n")
 		
-		// Initialize database
-		dbPath := os.Getenv("DATABASE_PATH")
-		if dbPath == "" {
-			dbPath = "air_quality.db"
+		cfg, err := LoadConfig(configPath())
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
 		}
-		database, err := NewDatabase(dbPath)
+		logFile, err := setupLogging(cfg.Logging)
 		if err != nil {
-			log.Printf("Warning: Failed to initialize database: %v", err)
-			log.Printf("Data storage and graphing will be disabled\n")
-			database = nil
+			log.Fatalf("Error setting up logging: %v", err)
+		}
+		defer logFile.Close()
+
+		// Initialize database
+		database, err := OpenStorage(defaultDatabasePath())
+		if err != nil {
+			slog.Warn("Failed to initialize database, falling back to in-memory storage; measurements will not survive a restart", "error", err)
+			database = NewMemoryDatabase(memoryCapacityFromEnv())
 		} else {
-			log.Printf("Database initialized successfully\n")
+			slog.Info("Database initialized successfully")
 		}
+
+		// Keep daily summaries up to date as measurements are written
+		summaryLoc, err := summaryLocationFromEnv()
+		if err != nil {
+			fatal("Error reading summary settings", err)
+		}
+		summaries := NewSummaryTracker(database, summaryLoc)
+
+		// Batch writes from the collector and request handlers into transactions
+		database = NewWriteQueue(summaries, defaultWriteBatchSize, defaultWriteFlushInterval)
 		
 		server := NewServer(deviceURL, database)
-		log.Fatal(server.Start(serverAddr))
+		server.EnableSummaries(summaries)
+		server.EnableCollection(cfg.Collection)
+		server.EnableConfigReload(configPath(), cfg)
+
+		server.EnableReports(cfg.SMTP, cfg.Reports)
+		server.EnableAuth(cfg.Auth)
+		server.EnableRateLimit(cfg.RateLimit)
+		if err := server.EnableTLS(cfg.TLS); err != nil {
+			fatal("Error setting up TLS", err)
+		}
+
+		backups, err := backupConfigFromEnv()
+		if err != nil {
+			fatal("Error reading backup settings", err)
+		}
+		if backups != nil {
+			server.EnableBackups(backups)
+		}
+		// Flush queued writes and close the database on Ctrl-C or SIGTERM
+		shutdownDone := make(chan struct{})
+		go func() {
+			defer close(shutdownDone)
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			sig := <-signals
+			slog.Info("Shutting down", "signal", sig.String())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Error("Error during shutdown", "error", err)
+			}
+		}()
+
+		if err := server.Start(serverAddr); err != nil {
+			fatal("Server error", err)
+		}
+		<-shutdownDone
+		slog.Info("Shutdown complete")
 	} else {
 		// Command-line mode
 		deviceURL := "http://192.168.1.100/json"
@@ -210,7 +358,7 @@ func main() {
 		fmt.Printf("Fetching air quality data from: %s\n\n", deviceURL)
 
 		// Fetch data from the IoT device
-		data, err := fetchAirQualityData(deviceURL)
+		data, err := fetchAirQualityData(context.Background(), deviceURL)
 		if err != nil {
 			log.Fatalf("Error fetching air quality data: %v", err)
 		}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS record types used by mDNS lookups
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsClassIN = 1
+)
+
+// mdnsGroup is the multicast DNS group address
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsLookup asks the local network for instances of a DNS-SD service, such as
+// _http._tcp.local, and returns the IPv4 addresses of every host that answers before
+// ctx is done. The query is sent from an ephemeral port, so responders answer it
+// directly (RFC 6762 section 6.7) and no multicast group needs to be joined.
+func mdnsLookup(ctx context.Context, service string) ([]net.IP, error) {
+	query, err := dnsQuery(service, dnsTypePTR)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mDNS socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.WriteToUDP(query, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %w", err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultDiscoveryTimeout)
+	}
+	conn.SetReadDeadline(deadline)
+
+	seen := make(map[string]bool)
+	var hosts []net.IP
+	add := func(ip net.IP) {
+		if ip4 := ip.To4(); ip4 != nil && !seen[ip4.String()] {
+			seen[ip4.String()] = true
+			hosts = append(hosts, ip4)
+		}
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return hosts, nil
+		}
+		if err != nil {
+			return hosts, fmt.Errorf("failed to read mDNS response: %w", err)
+		}
+		if ctx.Err() != nil {
+			return hosts, nil
+		}
+
+		// The responder itself is a candidate even if it only sent names
+		add(from.IP)
+		addresses, err := dnsAddresses(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, ip := range addresses {
+			add(ip)
+		}
+	}
+}
+
+// dnsQuery builds a DNS query message with one question
+func dnsQuery(name string, qtype uint16) ([]byte, error) {
+	id := make([]byte, 2)
+	rand.Read(id)
+	msg := append(id, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0) // flags, one question, no records
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("invalid DNS name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	return msg, nil
+}
+
+// dnsAddresses returns the IPv4 addresses in the A records of a DNS response
+func dnsAddresses(msg []byte) ([]net.IP, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("DNS message too short")
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	var err error
+	for i := 0; i < questions; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4 // type and class
+	}
+
+	var addresses []net.IP
+	for i := 0; i < records; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errors.New("DNS record truncated")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, errors.New("DNS record truncated")
+		}
+		if rtype == dnsTypeA && length == net.IPv4len {
+			addresses = append(addresses, net.IP(append([]byte(nil), msg[off:off+length]...)))
+		}
+		off += length
+	}
+	return addresses, nil
+}
+
+// skipDNSName returns the offset just past the name starting at off
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errors.New("DNS name truncated")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xC0 == 0xC0:
+			// A compression pointer ends the name
+			return off + 2, nil
+		default:
+			off += 1 + length
+		}
+	}
+}
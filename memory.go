@@ -0,0 +1,540 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultMemoryCapacity is the number of measurements kept by the in-memory store
+const defaultMemoryCapacity = 10000
+
+// memoryCapacityFromEnv returns the in-memory store size from MEMORY_STORE_SIZE
+func memoryCapacityFromEnv() int {
+	capacity, err := strconv.Atoi(os.Getenv("MEMORY_STORE_SIZE"))
+	if err != nil || capacity <= 0 {
+		return defaultMemoryCapacity
+	}
+	return capacity
+}
+
+// memoryRecord is a stored measurement along with its bookkeeping columns
+type memoryRecord struct {
+	id         int64
+	observedAt time.Time
+	receivedAt time.Time
+	data       AirQualityData
+}
+
+// memoryKey identifies a device reading the same way the SQL unique constraint does
+type memoryKey struct {
+	sensorID   string
+	observedAt int64
+}
+
+// MemoryDatabase keeps the most recently observed measurements, up to a fixed number.
+// It is used when no database file can be opened and for ephemeral deployments.
+type MemoryDatabase struct {
+	mu sync.RWMutex
+	// records is kept in (observed_at, id) order, the order queries return, so the
+	// oldest reading is evicted first and queries seek rather than sort
+	records  []*memoryRecord
+	index    map[memoryKey]*memoryRecord
+	capacity int
+	lastID   int64
+
+	summaries map[summaryDay]DailySummary
+	apiKeys   []APIKey
+	lastKeyID int64
+}
+
+// NewMemoryDatabase creates an in-memory store holding up to capacity measurements
+func NewMemoryDatabase(capacity int) *MemoryDatabase {
+	if capacity <= 0 {
+		capacity = defaultMemoryCapacity
+	}
+	return &MemoryDatabase{
+		records:  make([]*memoryRecord, 0, capacity),
+		index:    make(map[memoryKey]*memoryRecord),
+		capacity: capacity,
+
+		summaries: make(map[summaryDay]DailySummary),
+	}
+}
+
+// insert adds or replaces a measurement, evicting the earliest observed one once the
+// store is full. A reading older than everything in a full store isn't kept. It reports
+// whether a new row was added; existing rows are only replaced when update is set.
+func (m *MemoryDatabase) insert(data *AirQualityData, observedAt time.Time, update bool) bool {
+	key := memoryKey{sensorID: data.SensorId, observedAt: observedAt.Unix()}
+	if existing, ok := m.index[key]; ok {
+		if update {
+			existing.data = *data
+		}
+		return false
+	}
+
+	if len(m.records) >= m.capacity {
+		if !observedAt.After(m.records[0].observedAt) {
+			return false
+		}
+		evicted := m.records[0]
+		m.records[0] = nil // so the backing array doesn't keep it alive
+		m.records = m.records[1:]
+		delete(m.index, memoryKey{sensorID: evicted.data.SensorId, observedAt: evicted.observedAt.Unix()})
+	}
+
+	m.lastID++
+	record := &memoryRecord{
+		id:         m.lastID,
+		observedAt: observedAt,
+		receivedAt: time.Now().UTC(),
+		data:       *data,
+	}
+	// Live readings are the newest and are appended; imported history is inserted in
+	// place. The new record has the highest ID, so it goes after others observed at the
+	// same time.
+	i := sort.Search(len(m.records), func(i int) bool { return m.records[i].observedAt.After(observedAt) })
+	m.records = append(m.records, nil)
+	copy(m.records[i+1:], m.records[i:])
+	m.records[i] = record
+	m.index[key] = record
+	return true
+}
+
+// StoreMeasurement stores a measurement, replacing any stored reading with the same
+// sensor and observation time
+func (m *MemoryDatabase) StoreMeasurement(data *AirQualityData) error {
+	observed := observedAt(data)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.insert(data, observed, true)
+	return nil
+}
+
+// StoreMeasurements stores a batch of measurements
+func (m *MemoryDatabase) StoreMeasurements(batch []*AirQualityData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, data := range batch {
+		m.insert(data, observedAt(data), true)
+	}
+	return nil
+}
+
+// ImportMeasurements stores historical measurements, skipping ones already stored and,
+// when the store is full, ones older than everything it holds
+func (m *MemoryDatabase) ImportMeasurements(records []*AirQualityData) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inserted, skipped := 0, 0
+	for _, data := range records {
+		observed, err := data.ObservedAt()
+		if err != nil {
+			return inserted, skipped, err
+		}
+		if m.insert(data, observed, false) {
+			inserted++
+		} else {
+			skipped++
+		}
+	}
+	return inserted, skipped, nil
+}
+
+// matching returns copies of the records matching the query, ordered by observation
+// time. It seeks to the start of the range or the cursor and stops at the end of the
+// range or the page.
+func (m *MemoryDatabase) matching(q MeasurementQuery) []memoryRecord {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	start := 0
+	if !q.Range.Start.IsZero() {
+		start = sort.Search(len(m.records), func(i int) bool { return !m.records[i].observedAt.Before(q.Range.Start) })
+	}
+	if q.After != nil {
+		after := sort.Search(len(m.records), func(i int) bool { return q.After.Before(m.records[i].observedAt, m.records[i].id) })
+		if after > start {
+			start = after
+		}
+	}
+
+	var matched []memoryRecord
+	for _, r := range m.records[start:] {
+		if !q.Range.End.IsZero() && !r.observedAt.Before(q.Range.End) {
+			break
+		}
+		if q.SensorID != "" && r.data.SensorId != q.SensorID {
+			continue
+		}
+		matched = append(matched, *r)
+		if q.Limit > 0 && len(matched) == q.Limit {
+			break
+		}
+	}
+	return matched
+}
+
+// EachMeasurement calls fn for each measurement matching the query, in observation order
+func (m *MemoryDatabase) EachMeasurement(q MeasurementQuery, fn func(m Measurement) error) error {
+	for _, r := range m.matching(q) {
+		d := r.data
+		err := fn(Measurement{
+			ID:          r.id,
+			Timestamp:   r.observedAt,
+			SensorID:    d.SensorId,
+			Temperature: d.CurrentTempF,
+			Humidity:    d.CurrentHumidity,
+			Pressure:    d.Pressure,
+			Gas680:      d.Gas680,
+			PM25AQI:     d.Pm25Aqi,
+			PM25CF1:     d.Pm25Cf1,
+			PM100CF1:    d.Pm100Cf1,
+			PM25AQIB:    d.Pm25AqiB,
+			PM25CF1B:    d.Pm25Cf1B,
+			PM100CF1B:   d.Pm100Cf1B,
+			Memory:      d.Mem,
+			RSSI:        d.Rssi,
+			PaLatency:   d.PaLatency,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetMeasurementStats returns statistics for the measurements matching the query
+func (m *MemoryDatabase) GetMeasurementStats(q MeasurementQuery) (*MeasurementStats, error) {
+	// Like the SQL aggregates, stats cover every matching row rather than one page
+	q.Limit = 0
+	records := m.matching(q)
+
+	var stats MeasurementStats
+	stats.Count = len(records)
+	if stats.Count == 0 {
+		return &stats, nil
+	}
+
+	stats.MaxPM25AQI = records[0].data.Pm25Aqi
+	stats.MinPM25AQI = records[0].data.Pm25Aqi
+	stats.MaxTemp = records[0].data.CurrentTempF
+	stats.MinTemp = records[0].data.CurrentTempF
+
+	for _, r := range records {
+		d := r.data
+		stats.AvgTemp += d.CurrentTempF
+		stats.AvgHumidity += float64(d.CurrentHumidity)
+		stats.AvgPressure += d.Pressure
+		stats.AvgPM25AQI += float64(d.Pm25Aqi)
+		stats.AvgPM25CF1 += d.Pm25Cf1
+		stats.AvgPM100CF1 += d.Pm100Cf1
+
+		if d.Pm25Aqi > stats.MaxPM25AQI {
+			stats.MaxPM25AQI = d.Pm25Aqi
+		}
+		if d.Pm25Aqi < stats.MinPM25AQI {
+			stats.MinPM25AQI = d.Pm25Aqi
+		}
+		if d.CurrentTempF > stats.MaxTemp {
+			stats.MaxTemp = d.CurrentTempF
+		}
+		if d.CurrentTempF < stats.MinTemp {
+			stats.MinTemp = d.CurrentTempF
+		}
+	}
+
+	n := float64(stats.Count)
+	stats.AvgTemp /= n
+	stats.AvgHumidity /= n
+	stats.AvgPressure /= n
+	stats.AvgPM25AQI /= n
+	stats.AvgPM25CF1 /= n
+	stats.AvgPM100CF1 /= n
+
+	return &stats, nil
+}
+
+// AggregateMeasurements computes the aggregates of each field, per bucket when bucket
+// is set
+func (m *MemoryDatabase) AggregateMeasurements(q MeasurementQuery, fields []string, offsets []float64, bucket time.Duration, fn func(start time.Time, count int, aggregates []FieldAggregate) error) error {
+	q.Limit = 0
+	records := m.matching(q)
+	if bucket <= 0 && len(records) == 0 {
+		return fn(time.Time{}, 0, make([]FieldAggregate, len(fields)))
+	}
+
+	bucketOf := func(t time.Time) int64 {
+		if bucket <= 0 {
+			return 0
+		}
+		return t.Unix() / int64(bucket/time.Second)
+	}
+
+	for len(records) > 0 {
+		key := bucketOf(records[0].observedAt)
+		aggregates := make([]FieldAggregate, len(fields))
+		count := 0
+		for ; len(records) > 0 && bucketOf(records[0].observedAt) == key; records = records[1:] {
+			count++
+			for i, field := range fields {
+				value, err := records[0].field(field)
+				if err != nil {
+					return err
+				}
+				if f, ok := numericValue(value); ok {
+					aggregates[i].add(f, offsets[i])
+				}
+			}
+		}
+
+		var start time.Time
+		if bucket > 0 {
+			start = time.Unix(key*int64(bucket/time.Second), 0).UTC()
+		}
+		if err := fn(start, count, aggregates); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryMeasurements streams the query's columns for each matching measurement
+func (m *MemoryDatabase) QueryMeasurements(q MeasurementQuery, fn func(values []interface{}) error) error {
+	values := make([]interface{}, len(q.Fields))
+	for _, r := range m.matching(q) {
+		for i, field := range q.Fields {
+			value, err := r.field(field)
+			if err != nil {
+				return err
+			}
+			values[i] = value
+		}
+		if err := fn(values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// field returns the value of a measurements column for the record, using the same types
+// the SQL backends scan
+func (r *memoryRecord) field(name string) (interface{}, error) {
+	d := &r.data
+	switch name {
+	case "id":
+		return r.id, nil
+	case "observed_at":
+		return r.observedAt, nil
+	case "timestamp":
+		return r.receivedAt, nil
+	case "sensor_id":
+		return d.SensorId, nil
+	case "datetime":
+		return d.DateTime, nil
+	case "geo":
+		return d.Geo, nil
+	case "lat":
+		return d.Lat, nil
+	case "lon":
+		return d.Lon, nil
+	case "place":
+		return d.Place, nil
+	case "version":
+		return d.Version, nil
+	case "uptime":
+		return int64(d.Uptime), nil
+	case "rssi":
+		return int64(d.Rssi), nil
+	case "wlstate":
+		return d.Wlstate, nil
+	case "ssid":
+		return d.Ssid, nil
+	case "current_temp_f":
+		return d.CurrentTempF, nil
+	case "current_humidity":
+		return int64(d.CurrentHumidity), nil
+	case "current_dewpoint_f":
+		return d.CurrentDewpointF, nil
+	case "pressure":
+		return d.Pressure, nil
+	case "gas_680":
+		return d.Gas680, nil
+	case "pm25_aqi":
+		return int64(d.Pm25Aqi), nil
+	case "pm10_cf1":
+		return d.Pm10Cf1, nil
+	case "pm25_cf1":
+		return d.Pm25Cf1, nil
+	case "pm100_cf1":
+		return d.Pm100Cf1, nil
+	case "pm10_atm":
+		return d.Pm10Atm, nil
+	case "pm25_atm":
+		return d.Pm25Atm, nil
+	case "pm100_atm":
+		return d.Pm100Atm, nil
+	case "pm25_aqi_b":
+		return int64(d.Pm25AqiB), nil
+	case "pm10_cf1_b":
+		return d.Pm10Cf1B, nil
+	case "pm25_cf1_b":
+		return d.Pm25Cf1B, nil
+	case "pm100_cf1_b":
+		return d.Pm100Cf1B, nil
+	case "pm10_atm_b":
+		return d.Pm10AtmB, nil
+	case "pm25_atm_b":
+		return d.Pm25AtmB, nil
+	case "pm100_atm_b":
+		return d.Pm100AtmB, nil
+	case "mem":
+		return int64(d.Mem), nil
+	case "memfrag":
+		return int64(d.Memfrag), nil
+	case "memfb":
+		return int64(d.Memfb), nil
+	case "memcs":
+		return int64(d.Memcs), nil
+	case "adc":
+		return d.Adc, nil
+	case "httpsuccess":
+		return int64(d.Httpsuccess), nil
+	case "httpsends":
+		return int64(d.Httpsends), nil
+	case "pa_latency":
+		return int64(d.PaLatency), nil
+	case "status_0":
+		return int64(d.Status0), nil
+	case "status_1":
+		return int64(d.Status1), nil
+	case "status_2":
+		return int64(d.Status2), nil
+	case "status_3":
+		return int64(d.Status3), nil
+	case "status_4":
+		return int64(d.Status4), nil
+	default:
+		return nil, fmt.Errorf("unknown field: %s", name)
+	}
+}
+
+// StoreDailySummary stores a daily summary, replacing any earlier one for the same day
+func (m *MemoryDatabase) StoreDailySummary(summary *DailySummary) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.summaries[summaryDay{sensorID: summary.SensorID, date: summary.Date}] = *summary
+	return nil
+}
+
+// GetDailySummaries returns the daily summaries between from (inclusive) and to (exclusive)
+func (m *MemoryDatabase) GetDailySummaries(sensorID, from, to string) ([]DailySummary, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var summaries []DailySummary
+	for day, summary := range m.summaries {
+		if (sensorID != "" && day.sensorID != sensorID) || (from != "" && day.date < from) || (to != "" && day.date >= to) {
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Date == summaries[j].Date {
+			return summaries[i].SensorID < summaries[j].SensorID
+		}
+		return summaries[i].Date < summaries[j].Date
+	})
+	return summaries, nil
+}
+
+// CreateAPIKey stores a new API key
+func (m *MemoryDatabase) CreateAPIKey(key *APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, k := range m.apiKeys {
+		if k.Name == key.Name {
+			return fmt.Errorf("failed to store API key: name %q already exists", key.Name)
+		}
+	}
+	m.lastKeyID++
+	key.ID = m.lastKeyID
+	m.apiKeys = append(m.apiKeys, *key)
+	return nil
+}
+
+// GetAPIKey returns the API key with the given hash, or nil if there is none
+func (m *MemoryDatabase) GetAPIKey(hash string) (*APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, k := range m.apiKeys {
+		if k.Hash == hash {
+			return &k, nil
+		}
+	}
+	return nil, nil
+}
+
+// ListAPIKeys returns every API key ordered by name
+func (m *MemoryDatabase) ListAPIKeys() ([]APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := append([]APIKey(nil), m.apiKeys...)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys, nil
+}
+
+// DeleteAPIKey removes the API key with the given name, reporting whether it existed
+func (m *MemoryDatabase) DeleteAPIKey(name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, k := range m.apiKeys {
+		if k.Name == name {
+			m.apiKeys = append(m.apiKeys[:i], m.apiKeys[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// TouchAPIKey records when an API key was last used
+func (m *MemoryDatabase) TouchAPIKey(id int64, usedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.apiKeys {
+		if m.apiKeys[i].ID == id {
+			m.apiKeys[i].LastUsedAt = &usedAt
+		}
+	}
+	return nil
+}
+
+// CheckHealth always succeeds; the in-memory store can't become unreachable
+func (m *MemoryDatabase) CheckHealth() error {
+	return nil
+}
+
+// Close releases the stored measurements
+func (m *MemoryDatabase) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records = nil
+	m.index = make(map[memoryKey]*memoryRecord)
+	m.summaries = make(map[summaryDay]DailySummary)
+	m.apiKeys = nil
+	return nil
+}
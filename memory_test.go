@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemoryDatabase(100), "aa:bb:cc:dd:ee:ff")
+}
+
+// memoryTimes returns the observation times held by the store, in order
+func memoryTimes(t *testing.T, m *MemoryDatabase) []time.Time {
+	var times []time.Time
+	err := m.EachMeasurement(MeasurementQuery{}, func(measurement Measurement) error {
+		times = append(times, measurement.Timestamp)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return times
+}
+
+func TestMemoryStorageEvictsOldestObservation(t *testing.T) {
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hour int) time.Time { return base.Add(time.Duration(hour) * time.Hour) }
+	m := NewMemoryDatabase(3)
+
+	m.StoreMeasurement(testMeasurement("a", at(10), 10, 1))
+	m.StoreMeasurement(testMeasurement("a", at(11), 10, 1))
+
+	// Importing history into a full store must not push out the live readings
+	inserted, skipped, err := m.ImportMeasurements([]*AirQualityData{
+		testMeasurement("a", at(1), 10, 1),
+		testMeasurement("a", at(2), 10, 1),
+		testMeasurement("a", at(0), 10, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 2 || skipped != 1 {
+		t.Errorf("ImportMeasurements = %d inserted, %d skipped, want 2 and 1", inserted, skipped)
+	}
+	if got, want := memoryTimes(t, m), []time.Time{at(2), at(10), at(11)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after import the store holds %v, want %v", got, want)
+	}
+
+	m.StoreMeasurement(testMeasurement("a", at(12), 10, 1))
+	if got, want := memoryTimes(t, m), []time.Time{at(10), at(11), at(12)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after a live reading the store holds %v, want %v", got, want)
+	}
+
+	// An evicted reading can be stored again once it is no longer the oldest
+	if _, skipped, _ := m.ImportMeasurements([]*AirQualityData{testMeasurement("a", at(2), 10, 1)}); skipped != 1 {
+		t.Errorf("a reading older than a full store was kept")
+	}
+}
+
+// TestMemoryStorageMatchesSQLite loads the same readings into both stores and compares
+// range, sensor, paging and stats queries
+func TestMemoryStorageMatchesSQLite(t *testing.T) {
+	sqlite, err := NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	memory := NewMemoryDatabase(1000)
+
+	rng := rand.New(rand.NewSource(1))
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	var batch []*AirQualityData
+	for i := 0; i < 300; i++ {
+		sensor := fmt.Sprintf("sensor-%d", rng.Intn(3))
+		observed := base.Add(time.Duration(rng.Intn(48*60)) * time.Minute)
+		batch = append(batch, testMeasurement(sensor, observed, rng.Intn(200), float64(rng.Intn(1000))/10))
+	}
+	for _, storage := range []Storage{sqlite, memory} {
+		if err := storage.StoreMeasurements(batch); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := storage.ImportMeasurements(batch[:50]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queries := []MeasurementQuery{
+		{},
+		{SensorID: "sensor-1"},
+		{Range: TimeRange{Start: base.Add(36 * time.Hour)}},
+		{Range: TimeRange{Start: base.Add(6 * time.Hour), End: base.Add(18 * time.Hour)}, SensorID: "sensor-2"},
+		{Limit: 25},
+	}
+	for i, q := range queries {
+		if got, want := collectPages(t, memory, q), collectPages(t, sqlite, q); !reflect.DeepEqual(got, want) {
+			t.Errorf("query %d: memory returned %d rows, SQLite %d, or they differ", i, len(got), len(want))
+		}
+
+		got, err := memory.GetMeasurementStats(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := sqlite.GetMeasurementStats(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Count != want.Count || got.MinPM25AQI != want.MinPM25AQI || got.MaxPM25AQI != want.MaxPM25AQI ||
+			fmt.Sprintf("%.6f %.6f", got.AvgPM25AQI, got.AvgPM25CF1) != fmt.Sprintf("%.6f %.6f", want.AvgPM25AQI, want.AvgPM25CF1) {
+			t.Errorf("query %d: memory stats %+v, SQLite %+v", i, got, want)
+		}
+	}
+}
+
+// collectPages pages through a query with cursors, returning each row's sensor, time
+// and AQI. IDs differ between stores, so they are left out.
+func collectPages(t *testing.T, storage Storage, q MeasurementQuery) []string {
+	pageSize := 7
+	if q.Limit > 0 {
+		pageSize = q.Limit
+	}
+	page := q
+	page.Limit = pageSize
+
+	var rows []string
+	for {
+		var last *Measurement
+		n := 0
+		err := storage.EachMeasurement(page, func(m Measurement) error {
+			rows = append(rows, fmt.Sprintf("%s %s %d", m.SensorID, m.Timestamp.UTC().Format(time.RFC3339), m.PM25AQI))
+			last = &m
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < pageSize || q.Limit > 0 {
+			return rows
+		}
+		page.After = &MeasurementCursor{ObservedAt: last.Timestamp, ID: last.ID}
+	}
+}
+
+func TestMemoryStorageStaysOrdered(t *testing.T) {
+	m := NewMemoryDatabase(200)
+	rng := rand.New(rand.NewSource(1))
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 1000; i++ {
+		data := testMeasurement(fmt.Sprintf("sensor-%d", rng.Intn(3)), base.Add(time.Duration(rng.Intn(600))*time.Minute), i, 1)
+		if i%2 == 0 {
+			m.StoreMeasurement(data)
+		} else {
+			m.ImportMeasurements([]*AirQualityData{data})
+		}
+	}
+
+	if len(m.records) != 200 || len(m.index) != 200 {
+		t.Fatalf("store holds %d records and %d index entries, want 200", len(m.records), len(m.index))
+	}
+	for i := 1; i < len(m.records); i++ {
+		a, b := m.records[i-1], m.records[i]
+		if b.observedAt.Before(a.observedAt) || (b.observedAt.Equal(a.observedAt) && b.id < a.id) {
+			t.Fatalf("records %d and %d are out of order", i-1, i)
+		}
+	}
+
+	// A cursor resumes right after the row it names
+	all := m.matching(MeasurementQuery{})
+	after := all[99]
+	page := m.matching(MeasurementQuery{After: &MeasurementCursor{ObservedAt: after.observedAt, ID: after.id}, Limit: 10})
+	if len(page) != 10 {
+		t.Fatalf("page has %d rows, want 10", len(page))
+	}
+	for i := range page {
+		if page[i].id != all[100+i].id {
+			t.Fatalf("page after row 99 starts %v, want rows from 100", page[0].observedAt)
+		}
+	}
+}
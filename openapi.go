@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	// apiPrefix is the path of the current API version
+	apiPrefix = "/api/v1"
+
+	// legacyAPIPrefix serves the API at its original, unversioned paths
+	legacyAPIPrefix = "/api"
+)
+
+// routeParam documents a request parameter
+type routeParam struct {
+	Name        string
+	In          string // "query" or "path"
+	Type        string // "string", "integer" or "number"
+	Enum        []string
+	Description string
+}
+
+// route is an HTTP endpoint. setupRoutes registers the handlers from the route table and
+// the OpenAPI document is generated from it, so the two can't drift apart.
+type route struct {
+	Method string
+	// Path is a gorilla/mux path template. API routes are relative to apiPrefix.
+	Path    string
+	API     bool
+	Handler http.HandlerFunc
+
+	Summary string
+	Tag     string
+	Params  []routeParam
+	// Content lists the content types of a successful response
+	Content []string
+	// Body lists the request body content types accepted, if the route takes a body
+	Body []string
+}
+
+// fullPath returns the mux path template the route is served at
+func (rt route) fullPath() string {
+	if rt.API {
+		return apiPrefix + rt.Path
+	}
+	return rt.Path
+}
+
+// Parameters shared by several routes
+var (
+	timeRangeParams = []routeParam{
+		{Name: "start", In: "query", Type: "string", Description: "Start of the range, inclusive: RFC 3339 timestamp or YYYY-MM-DD date"},
+		{Name: "end", In: "query", Type: "string", Description: "End of the range, exclusive: RFC 3339 timestamp or YYYY-MM-DD date (default now)"},
+		{Name: "hours", In: "query", Type: "integer", Description: "Length of the range before end, used when start is not given"},
+		{Name: "tz", In: "query", Type: "string", Description: "IANA time zone for dates, e.g. America/Chicago (default UTC)"},
+	}
+	sensorParam    = routeParam{Name: "sensor", In: "query", Type: "string", Description: "Only include this sensor ID"}
+	fieldsParam    = routeParam{Name: "fields", In: "query", Type: "string", Description: "Comma separated measurement fields (default all)"}
+	collectorParam = routeParam{Name: "name", In: "path", Type: "string", Description: "Collector name, from collection.sensors or the device's host"}
+)
+
+// params joins parameter lists
+func params(lists ...[]routeParam) []routeParam {
+	var all []routeParam
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	return all
+}
+
+// openAPIPathVar matches a mux path variable with an optional pattern, e.g. {format:png|svg}
+var openAPIPathVar = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// jsonSchema is an OpenAPI schema object, kept loose since responses are documented by
+// example in the README
+type jsonSchema map[string]interface{}
+
+// buildOpenAPI returns the OpenAPI 3 document describing routes
+func buildOpenAPI(routes []route) ([]byte, error) {
+	paths := make(map[string]map[string]interface{})
+	for _, rt := range routes {
+		path := openAPIPathVar.ReplaceAllString(rt.fullPath(), "{$1}")
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(rt.Method)] = openAPIOperation(rt)
+	}
+
+	codes := make([]string, len(errorCodes))
+	var codeDocs []string
+	for i, c := range errorCodes {
+		codes[i] = c.Code
+		codeDocs = append(codeDocs, fmt.Sprintf("- `%s`: %s", c.Code, c.Description))
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Air Quality Monitor",
+			"version": "1",
+			"description": "Live readings from a PurpleAir sensor and the measurements stored from it.\n\n" +
+				"The API is also served without the version, under " + legacyAPIPrefix + "/, for existing clients; " +
+				"those paths, other than " + legacyAPIPrefix + "/openapi.json, are deprecated.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Error": jsonSchema{
+					"type":     "object",
+					"required": []string{"error"},
+					"properties": map[string]interface{}{
+						"error": jsonSchema{
+							"type":     "object",
+							"required": []string{"code", "message"},
+							"properties": map[string]interface{}{
+								"code": jsonSchema{
+									"type":        "string",
+									"enum":        codes,
+									"description": strings.Join(codeDocs, "\n"),
+								},
+								"message":    jsonSchema{"type": "string"},
+								"request_id": jsonSchema{"type": "string", "description": "Correlation ID, also sent in the X-Request-ID header"},
+							},
+						},
+					},
+				},
+			},
+			"responses": map[string]interface{}{
+				"Error": errorResponse("Error"),
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearer": jsonSchema{"type": "http", "scheme": "bearer"},
+				"apiKey": jsonSchema{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"basic":  jsonSchema{"type": "http", "scheme": "basic", "description": "The API key as the password, with any user name"},
+			},
+		},
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// openAPIOperation describes one route
+func openAPIOperation(rt route) map[string]interface{} {
+	op := map[string]interface{}{
+		"summary":     rt.Summary,
+		"operationId": operationID(rt),
+		"tags":        []string{rt.Tag},
+	}
+
+	var parameters []interface{}
+	for _, p := range rt.Params {
+		schema := jsonSchema{"type": p.Type}
+		if len(p.Enum) > 0 {
+			schema["enum"] = p.Enum
+		}
+		parameters = append(parameters, map[string]interface{}{
+			"name":        p.Name,
+			"in":          p.In,
+			"required":    p.In == "path",
+			"description": p.Description,
+			"schema":      schema,
+		})
+	}
+	if parameters != nil {
+		op["parameters"] = parameters
+	}
+
+	if len(rt.Body) > 0 {
+		content := make(map[string]interface{})
+		for _, ct := range rt.Body {
+			schema := jsonSchema{"type": "string"}
+			switch ct {
+			case "application/json":
+				schema = jsonSchema{"type": "object"}
+			case "multipart/form-data":
+				schema = jsonSchema{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"file": jsonSchema{"type": "array", "items": jsonSchema{"type": "string", "format": "binary"}},
+					},
+				}
+			}
+			content[ct] = map[string]interface{}{"schema": schema}
+		}
+		op["requestBody"] = map[string]interface{}{"required": true, "content": content}
+	}
+
+	content := make(map[string]interface{})
+	for _, ct := range rt.Content {
+		var schema jsonSchema
+		switch {
+		case ct == "application/json":
+			schema = jsonSchema{"type": "object"}
+		case strings.HasPrefix(ct, "image/png"):
+			schema = jsonSchema{"type": "string", "format": "binary"}
+		default:
+			schema = jsonSchema{"type": "string"}
+		}
+		content[ct] = map[string]interface{}{"schema": schema}
+	}
+	responses := map[string]interface{}{
+		"200":     map[string]interface{}{"description": "Success", "content": content},
+		"default": map[string]interface{}{"$ref": "#/components/responses/Error"},
+	}
+	if len(rt.Params) > 0 || len(rt.Body) > 0 {
+		responses["400"] = errorResponse("Invalid parameter or request body")
+	}
+	if rateClass(rt.fullPath()) != "" {
+		responses["429"] = errorResponse("Rate limited; see the Retry-After header")
+	}
+
+	// Document the role the auth middleware will ask for
+	req := &http.Request{Method: rt.Method, URL: &url.URL{Path: rt.fullPath()}}
+	role := requiredRole(req)
+	if role == "" {
+		op["security"] = []interface{}{}
+	} else {
+		var security []interface{}
+		for _, scheme := range []string{"bearer", "apiKey", "basic"} {
+			security = append(security, map[string][]string{scheme: {}})
+		}
+		op["security"] = security
+		description := fmt.Sprintf("Needs a key with the %s role when authentication is enabled", role)
+		if role == RoleRead && !storesReading(req) {
+			description += ", unless public read access is allowed"
+		}
+		op["description"] = description
+		responses["401"] = errorResponse("API key missing or unknown")
+		responses["403"] = errorResponse("API key role not allowed")
+	}
+	op["responses"] = responses
+	return op
+}
+
+// errorResponse is an OpenAPI response with the error envelope
+func errorResponse(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]string{"$ref": "#/components/schemas/Error"},
+			},
+		},
+	}
+}
+
+// operationID derives a stable, unique operation ID from the method and path, e.g.
+// getApiV1ChartFormat for GET /api/v1/chart.{format:png|svg}
+func operationID(rt route) string {
+	id := strings.ToLower(rt.Method)
+	path := openAPIPathVar.ReplaceAllString(rt.fullPath(), "$1")
+	words := strings.FieldsFunc(path, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	})
+	if len(words) == 0 {
+		words = []string{"home"}
+	}
+	for _, w := range words {
+		id += strings.ToUpper(w[:1]) + w[1:]
+	}
+	return id
+}
+
+// checkRoutes reports duplicate routes and operation IDs, which would silently drop
+// an operation from the document
+func checkRoutes(routes []route) error {
+	seen := make(map[string]bool)
+	ids := make(map[string]bool)
+	for _, rt := range routes {
+		key := rt.Method + " " + openAPIPathVar.ReplaceAllString(rt.fullPath(), "{$1}")
+		if seen[key] {
+			return fmt.Errorf("duplicate route %s", key)
+		}
+		seen[key] = true
+		id := operationID(rt)
+		if ids[id] {
+			return fmt.Errorf("duplicate operation ID %s", id)
+		}
+		ids[id] = true
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// routerOperations returns every method and path the router serves, as "GET /path" with
+// path variables written the OpenAPI way
+func routerOperations(t *testing.T, router *mux.Router) map[string]bool {
+	operations := make(map[string]bool)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+
+		path := openAPIPathVar.ReplaceAllString(template, "{$1}")
+		for _, method := range methods {
+			operations[method+" "+path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to walk router: %v", err)
+	}
+	return operations
+}
+
+func TestOpenAPIDescribesEveryRoute(t *testing.T) {
+	s := NewServer("http://127.0.0.1:1/json", nil)
+
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(s.openapi, &doc); err != nil {
+		t.Fatalf("invalid OpenAPI document: %v", err)
+	}
+	documented := make(map[string]bool)
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	served := routerOperations(t, s.router)
+	var missing, extra []string
+	for operation := range served {
+		// Unversioned API paths alias the versioned ones
+		method, path, _ := strings.Cut(operation, " ")
+		versioned := method + " " + apiPrefix + strings.TrimPrefix(path, legacyAPIPrefix)
+		if !documented[operation] && !(strings.HasPrefix(path, legacyAPIPrefix+"/") && documented[versioned]) {
+			missing = append(missing, operation)
+		}
+	}
+	for operation := range documented {
+		if !served[operation] {
+			extra = append(extra, operation)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	if len(missing) > 0 {
+		t.Errorf("served but not documented: %v", missing)
+	}
+	if len(extra) > 0 {
+		t.Errorf("documented but not served: %v", extra)
+	}
+}
+
+func TestOpenAPIServedUnderBothPrefixes(t *testing.T) {
+	s := NewServer("http://127.0.0.1:1/json", nil)
+
+	// Neither path to the document is deprecated
+	for _, prefix := range []string{apiPrefix, legacyAPIPrefix} {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, prefix+"/openapi.json", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != string(s.openapi) {
+			t.Errorf("GET %s/openapi.json = %d, want the OpenAPI document", prefix, rec.Code)
+		}
+		if deprecation := rec.Header().Get("Deprecation"); deprecation != "" {
+			t.Errorf("GET %s/openapi.json: Deprecation header %q", prefix, deprecation)
+		}
+	}
+
+	// Other unversioned paths still are
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, legacyAPIPrefix+"/measurements", nil))
+	if rec.Header().Get("Deprecation") != "true" {
+		t.Errorf("GET %s/measurements is not marked deprecated", legacyAPIPrefix)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// PostgresDatabase stores measurements in PostgreSQL, using a TimescaleDB hypertable
+// when the extension is available
+type PostgresDatabase struct {
+	db *sql.DB
+}
+
+// NewPostgresDatabase connects to PostgreSQL and creates the schema if needed
+func NewPostgresDatabase(dsn string) (*PostgresDatabase, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	if err := createPostgresTables(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	return &PostgresDatabase{db: db}, nil
+}
+
+// createPostgresTables creates the measurements table and, on TimescaleDB, turns it into
+// a hypertable partitioned by observation time
+func createPostgresTables(db *sql.DB) error {
+	// TimescaleDB requires unique indexes to include the partitioning column, so the
+	// table has no primary key on id alone
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS measurements (
+		id BIGSERIAL,
+		observed_at TIMESTAMPTZ NOT NULL,
+		timestamp TIMESTAMPTZ DEFAULT now(),
+		sensor_id TEXT NOT NULL,
+		datetime TEXT,
+		geo TEXT,
+		lat DOUBLE PRECISION,
+		lon DOUBLE PRECISION,
+		place TEXT,
+		version TEXT,
+		uptime INTEGER,
+		rssi INTEGER,
+		wlstate TEXT,
+		ssid TEXT,
+
+		-- Environmental data
+		current_temp_f DOUBLE PRECISION,
+		current_humidity INTEGER,
+		current_dewpoint_f DOUBLE PRECISION,
+		pressure DOUBLE PRECISION,
+		gas_680 DOUBLE PRECISION,
+
+		-- Air quality data (Channel A)
+		pm25_aqi INTEGER,
+		pm10_cf1 DOUBLE PRECISION,
+		pm25_cf1 DOUBLE PRECISION,
+		pm100_cf1 DOUBLE PRECISION,
+		pm10_atm DOUBLE PRECISION,
+		pm25_atm DOUBLE PRECISION,
+		pm100_atm DOUBLE PRECISION,
+
+		-- Air quality data (Channel B)
+		pm25_aqi_b INTEGER,
+		pm10_cf1_b DOUBLE PRECISION,
+		pm25_cf1_b DOUBLE PRECISION,
+		pm100_cf1_b DOUBLE PRECISION,
+		pm10_atm_b DOUBLE PRECISION,
+		pm25_atm_b DOUBLE PRECISION,
+		pm100_atm_b DOUBLE PRECISION,
+
+		-- System data
+		mem INTEGER,
+		memfrag INTEGER,
+		memfb INTEGER,
+		memcs INTEGER,
+		adc DOUBLE PRECISION,
+		httpsuccess INTEGER,
+		httpsends INTEGER,
+		pa_latency INTEGER,
+		status_0 INTEGER,
+		status_1 INTEGER,
+		status_2 INTEGER,
+		status_3 INTEGER,
+		status_4 INTEGER,
+
+		UNIQUE (sensor_id, observed_at)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_measurements_observed_at ON measurements(observed_at);
+
+	CREATE TABLE IF NOT EXISTS daily_summaries (
+		sensor_id TEXT NOT NULL,
+		date TEXT NOT NULL,
+		samples INTEGER,
+		hours_with_data INTEGER,
+		completeness DOUBLE PRECISION,
+		mean_pm25 DOUBLE PRECISION,
+		aqi INTEGER,
+		category TEXT,
+		max_hourly_aqi INTEGER,
+		hours_good INTEGER,
+		hours_moderate INTEGER,
+		hours_unhealthy_sensitive INTEGER,
+		hours_unhealthy INTEGER,
+		hours_very_unhealthy INTEGER,
+		hours_hazardous INTEGER,
+		min_temp DOUBLE PRECISION,
+		max_temp DOUBLE PRECISION,
+		computed_at TIMESTAMPTZ,
+		PRIMARY KEY (sensor_id, date)
+	);
+
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id BIGSERIAL PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		role TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		last_used_at TIMESTAMPTZ
+	);
+
+	CREATE TABLE IF NOT EXISTS health_check (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		checked_at TIMESTAMPTZ NOT NULL
+	);
+	`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		return err
+	}
+
+	var timescale bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'timescaledb')`).Scan(&timescale)
+	if err != nil {
+		return fmt.Errorf("failed to check for TimescaleDB: %w", err)
+	}
+	if !timescale {
+		slog.Info("TimescaleDB not available, using a plain PostgreSQL table")
+		return nil
+	}
+
+	if _, err := db.Exec(`CREATE EXTENSION IF NOT EXISTS timescaledb`); err != nil {
+		return fmt.Errorf("failed to enable TimescaleDB: %w", err)
+	}
+	_, err = db.Exec(`SELECT create_hypertable('measurements', 'observed_at', if_not_exists => TRUE, migrate_data => TRUE)`)
+	if err != nil {
+		return fmt.Errorf("failed to create hypertable: %w", err)
+	}
+
+	return nil
+}
+
+// postgresPlaceholders returns n numbered bind parameters starting at $start
+func postgresPlaceholders(start, n int) string {
+	params := make([]string, n)
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", start+i)
+	}
+	return strings.Join(params, ", ")
+}
+
+// measurementColumnCount is the number of columns in measurementInsertColumns
+var measurementColumnCount = len(strings.Split(measurementInsertColumns, ","))
+
+// postgresUpsertSQL inserts a measurement or refreshes the row for the same device reading
+var postgresUpsertSQL = `INSERT INTO measurements (observed_at, ` + measurementInsertColumns + `)
+	VALUES ($1, ` + postgresPlaceholders(2, measurementColumnCount) + `)
+	ON CONFLICT (sensor_id, observed_at) DO UPDATE SET ` + upsertAssignments(measurementInsertColumns)
+
+// StoreMeasurement stores a single air quality measurement, updating the existing row
+// when the same device reading was already recorded
+func (p *PostgresDatabase) StoreMeasurement(data *AirQualityData) error {
+	args := append([]interface{}{observedAt(data)}, measurementArgs(data)...)
+	if _, err := p.db.Exec(postgresUpsertSQL, args...); err != nil {
+		return fmt.Errorf("failed to insert measurement: %w", err)
+	}
+
+	return nil
+}
+
+// StoreMeasurements stores a batch of measurements in a single transaction
+func (p *PostgresDatabase) StoreMeasurements(batch []*AirQualityData) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(postgresUpsertSQL)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, data := range batch {
+		args := append([]interface{}{observedAt(data)}, measurementArgs(data)...)
+		if _, err := stmt.Exec(args...); err != nil {
+			return fmt.Errorf("failed to insert measurement: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit measurements: %w", err)
+	}
+	return nil
+}
+
+// ImportMeasurements stores historical measurements in a single transaction, skipping
+// rows already stored for the same sensor and observation time
+func (p *PostgresDatabase) ImportMeasurements(records []*AirQualityData) (int, int, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	INSERT INTO measurements (observed_at, ` + measurementInsertColumns + `)
+	VALUES ($1, ` + postgresPlaceholders(2, measurementColumnCount) + `)
+	ON CONFLICT (sensor_id, observed_at) DO NOTHING
+	`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to prepare import: %w", err)
+	}
+	defer stmt.Close()
+
+	inserted, skipped := 0, 0
+	for _, data := range records {
+		observedAt, err := data.ObservedAt()
+		if err != nil {
+			return inserted, skipped, err
+		}
+
+		result, err := stmt.Exec(append([]interface{}{observedAt}, measurementArgs(data)...)...)
+		if err != nil {
+			return inserted, skipped, fmt.Errorf("failed to import measurement: %w", err)
+		}
+
+		if n, _ := result.RowsAffected(); n > 0 {
+			inserted++
+		} else {
+			skipped++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit import: %w", err)
+	}
+	return inserted, skipped, nil
+}
+
+// postgresFilter builds the WHERE clause and bound arguments for a query
+func postgresFilter(q MeasurementQuery) (string, []interface{}) {
+	return q.sqlFilter(
+		func(n int) string { return fmt.Sprintf("$%d", n) },
+		func(t time.Time) interface{} { return t },
+	)
+}
+
+// EachMeasurement calls fn for each measurement matching the query, in observation
+// order, without buffering the result set
+func (p *PostgresDatabase) EachMeasurement(q MeasurementQuery, fn func(m Measurement) error) error {
+	where, args := postgresFilter(q)
+	query := `
+	SELECT
+		id, observed_at, sensor_id, current_temp_f, current_humidity, pressure, gas_680,
+		pm25_aqi, pm25_cf1, pm100_cf1, pm25_aqi_b, pm25_cf1_b, pm100_cf1_b,
+		mem, rssi, pa_latency
+	FROM measurements
+	` + where + `
+	ORDER BY observed_at ASC, id ASC
+	` + q.sqlLimit()
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query measurements: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m Measurement
+		err := rows.Scan(
+			&m.ID, &m.Timestamp, &m.SensorID, &m.Temperature, &m.Humidity, &m.Pressure, &m.Gas680,
+			&m.PM25AQI, &m.PM25CF1, &m.PM100CF1, &m.PM25AQIB, &m.PM25CF1B, &m.PM100CF1B,
+			&m.Memory, &m.RSSI, &m.PaLatency,
+		)
+		if err != nil {
+			slog.Error("Error scanning measurement", "error", err)
+			continue
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// GetMeasurementStats returns statistics for the measurements matching the query
+func (p *PostgresDatabase) GetMeasurementStats(q MeasurementQuery) (*MeasurementStats, error) {
+	where, args := postgresFilter(q)
+	query := `
+	SELECT
+		COUNT(*),
+		COALESCE(AVG(current_temp_f), 0),
+		COALESCE(AVG(current_humidity), 0),
+		COALESCE(AVG(pressure), 0),
+		COALESCE(AVG(pm25_aqi), 0),
+		COALESCE(AVG(pm25_cf1), 0),
+		COALESCE(AVG(pm100_cf1), 0),
+		COALESCE(MAX(pm25_aqi), 0),
+		COALESCE(MIN(pm25_aqi), 0),
+		COALESCE(MAX(current_temp_f), 0),
+		COALESCE(MIN(current_temp_f), 0)
+	FROM measurements
+	` + where
+
+	var stats MeasurementStats
+	err := p.db.QueryRow(query, args...).Scan(
+		&stats.Count, &stats.AvgTemp, &stats.AvgHumidity, &stats.AvgPressure,
+		&stats.AvgPM25AQI, &stats.AvgPM25CF1, &stats.AvgPM100CF1,
+		&stats.MaxPM25AQI, &stats.MinPM25AQI, &stats.MaxTemp, &stats.MinTemp,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats: %w", err)
+	}
+
+	return &stats, nil
+}
+
+// AggregateMeasurements computes the aggregates of each field in the database, per bucket
+// when bucket is set
+func (p *PostgresDatabase) AggregateMeasurements(q MeasurementQuery, fields []string, offsets []float64, bucket time.Duration, fn func(start time.Time, count int, aggregates []FieldAggregate) error) error {
+	where, args := postgresFilter(q)
+	bucketExpr := ""
+	if bucket > 0 {
+		bucketExpr = fmt.Sprintf("FLOOR(EXTRACT(EPOCH FROM observed_at) / %d)::BIGINT", int64(bucket/time.Second))
+	}
+
+	rows, err := p.db.Query(aggregateSQL(fields, offsets, bucketExpr, where), args...)
+	if err != nil {
+		return fmt.Errorf("failed to aggregate measurements: %w", err)
+	}
+	defer rows.Close()
+
+	return scanAggregates(rows, len(fields), bucket, fn)
+}
+
+// QueryMeasurements streams the query's columns for each matching measurement
+func (p *PostgresDatabase) QueryMeasurements(q MeasurementQuery, fn func(values []interface{}) error) error {
+	where, args := postgresFilter(q)
+	query := `
+	SELECT ` + strings.Join(q.Fields, ", ") + `
+	FROM measurements
+	` + where + `
+	ORDER BY observed_at ASC, id ASC
+	` + q.sqlLimit()
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query measurements: %w", err)
+	}
+	defer rows.Close()
+
+	return scanRows(rows, len(q.Fields), fn)
+}
+
+// StoreDailySummary stores a daily summary, replacing any earlier one for the same day
+func (p *PostgresDatabase) StoreDailySummary(summary *DailySummary) error {
+	args := dailySummaryArgs(summary, summary.ComputedAt.UTC())
+	if _, err := p.db.Exec(dailySummaryUpsert(postgresPlaceholders(1, len(args))), args...); err != nil {
+		return fmt.Errorf("failed to store daily summary: %w", err)
+	}
+	return nil
+}
+
+// GetDailySummaries returns the daily summaries between from (inclusive) and to (exclusive)
+func (p *PostgresDatabase) GetDailySummaries(sensorID, from, to string) ([]DailySummary, error) {
+	where, args := dailySummaryFilter(sensorID, from, to, func(n int) string { return fmt.Sprintf("$%d", n) })
+	rows, err := p.db.Query(`SELECT `+dailySummaryColumns+` FROM daily_summaries `+where+` ORDER BY date, sensor_id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query daily summaries: %w", err)
+	}
+	defer rows.Close()
+
+	return scanDailySummaries(rows)
+}
+
+// CreateAPIKey stores a new API key
+func (p *PostgresDatabase) CreateAPIKey(key *APIKey) error {
+	err := p.db.QueryRow(`INSERT INTO api_keys (name, prefix, key_hash, role, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		key.Name, key.Prefix, key.Hash, key.Role, key.CreatedAt.UTC()).Scan(&key.ID)
+	if err != nil {
+		return fmt.Errorf("failed to store API key: %w", err)
+	}
+	return nil
+}
+
+// GetAPIKey returns the API key with the given hash, or nil if there is none
+func (p *PostgresDatabase) GetAPIKey(hash string) (*APIKey, error) {
+	rows, err := p.db.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = $1`, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API key: %w", err)
+	}
+	defer rows.Close()
+
+	keys, err := scanAPIKeys(rows)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	return &keys[0], nil
+}
+
+// ListAPIKeys returns every API key ordered by name
+func (p *PostgresDatabase) ListAPIKeys() ([]APIKey, error) {
+	rows, err := p.db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	defer rows.Close()
+
+	return scanAPIKeys(rows)
+}
+
+// DeleteAPIKey removes the API key with the given name, reporting whether it existed
+func (p *PostgresDatabase) DeleteAPIKey(name string) (bool, error) {
+	result, err := p.db.Exec(`DELETE FROM api_keys WHERE name = $1`, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete API key: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// TouchAPIKey records when an API key was last used
+func (p *PostgresDatabase) TouchAPIKey(id int64, usedAt time.Time) error {
+	if _, err := p.db.Exec(`UPDATE api_keys SET last_used_at = $1 WHERE id = $2`, usedAt.UTC(), id); err != nil {
+		return fmt.Errorf("failed to update API key: %w", err)
+	}
+	return nil
+}
+
+// CheckHealth pings the server and rewrites the health check row, which fails if the
+// connection is read-only or the database has run out of space
+func (p *PostgresDatabase) CheckHealth() error {
+	if err := p.db.Ping(); err != nil {
+		return fmt.Errorf("failed to reach database: %w", err)
+	}
+	_, err := p.db.Exec(`INSERT INTO health_check (id, checked_at) VALUES (1, $1)
+		ON CONFLICT (id) DO UPDATE SET checked_at = excluded.checked_at`, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to write to database: %w", err)
+	}
+	return nil
+}
+
+// Close closes the database connection
+func (p *PostgresDatabase) Close() error {
+	return p.db.Close()
+}
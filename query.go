@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeRange is a half-open [Start, End) interval of observation times. A zero Start or
+// End leaves that side of the range open.
+type TimeRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Contains reports whether t falls within the range
+func (r TimeRange) Contains(t time.Time) bool {
+	if !r.Start.IsZero() && t.Before(r.Start) {
+		return false
+	}
+	if !r.End.IsZero() && !t.Before(r.End) {
+		return false
+	}
+	return true
+}
+
+// MeasurementQuery selects measurements by observation time, sensor and columns.
+// After and Limit page through results in (observed_at, id) order.
+type MeasurementQuery struct {
+	Range    TimeRange
+	SensorID string
+	Fields   []string
+	After    *MeasurementCursor
+	Limit    int
+}
+
+// MeasurementCursor marks the last measurement of a page
+type MeasurementCursor struct {
+	ObservedAt time.Time
+	ID         int64
+}
+
+// Encode returns the cursor as an opaque URL-safe token
+func (c MeasurementCursor) Encode() string {
+	raw := fmt.Sprintf("%d.%d", c.ObservedAt.UnixNano(), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// Before reports whether the cursor sorts before a measurement with the given key
+func (c MeasurementCursor) Before(observedAt time.Time, id int64) bool {
+	if observedAt.Equal(c.ObservedAt) {
+		return id > c.ID
+	}
+	return observedAt.After(c.ObservedAt)
+}
+
+// parseMeasurementCursor decodes a token produced by MeasurementCursor.Encode
+func parseMeasurementCursor(token string) (*MeasurementCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var nanos, id int64
+	if _, err := fmt.Sscanf(string(raw), "%d.%d", &nanos, &id); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &MeasurementCursor{ObservedAt: time.Unix(0, nanos).UTC(), ID: id}, nil
+}
+
+const (
+	// defaultPageLimit is the number of measurements returned per page when no limit is given
+	defaultPageLimit = 1000
+
+	// maxPageLimit caps the limit a client can request
+	maxPageLimit = 5000
+)
+
+// parsePageParams reads the limit and cursor parameters used to page through measurements
+func parsePageParams(query url.Values) (int, *MeasurementCursor, error) {
+	limit := defaultPageLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return 0, nil, fmt.Errorf("invalid limit %q", value)
+		}
+		limit = parsed
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	var cursor *MeasurementCursor
+	if token := query.Get("cursor"); token != "" {
+		c, err := parseMeasurementCursor(token)
+		if err != nil {
+			return 0, nil, err
+		}
+		cursor = c
+	}
+	return limit, cursor, nil
+}
+
+// measurementFields lists the measurement columns that can be queried, in output order
+var measurementFields = []string{
+	"observed_at", "timestamp", "sensor_id", "datetime", "geo", "lat", "lon", "place", "version",
+	"uptime", "rssi", "wlstate", "ssid",
+	"current_temp_f", "current_humidity", "current_dewpoint_f", "pressure", "gas_680",
+	"pm25_aqi", "pm10_cf1", "pm25_cf1", "pm100_cf1", "pm10_atm", "pm25_atm", "pm100_atm",
+	"pm25_aqi_b", "pm10_cf1_b", "pm25_cf1_b", "pm100_cf1_b", "pm10_atm_b", "pm25_atm_b", "pm100_atm_b",
+	"mem", "memfrag", "memfb", "memcs", "adc", "httpsuccess", "httpsends", "pa_latency",
+	"status_0", "status_1", "status_2", "status_3", "status_4",
+}
+
+// parseMeasurementFields validates a comma separated field list, returning all fields when empty
+func parseMeasurementFields(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return measurementFields, nil
+	}
+
+	valid := make(map[string]bool, len(measurementFields))
+	for _, f := range measurementFields {
+		valid[f] = true
+	}
+
+	var fields []string
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !valid[f] {
+			return nil, fmt.Errorf("unknown field: %s", f)
+		}
+		fields = append(fields, f)
+	}
+
+	if len(fields) == 0 {
+		return measurementFields, nil
+	}
+	return fields, nil
+}
+
+// parseTimeParam parses an RFC 3339 timestamp, or a YYYY-MM-DD date at midnight in loc,
+// returning def when empty
+func parseTimeParam(value string, def time.Time, loc *time.Location) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: expected RFC 3339 or YYYY-MM-DD", value)
+}
+
+// parseLocation returns the time zone named by the tz parameter, defaulting to UTC
+func parseLocation(query url.Values) (*time.Location, error) {
+	tz := query.Get("tz")
+	if tz == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q", tz)
+	}
+	return loc, nil
+}
+
+// parseTimeRange reads a time range from request parameters:
+//   - start/end: RFC 3339 timestamps or YYYY-MM-DD dates (end is exclusive)
+//   - tz: IANA time zone used for dates, e.g. America/Chicago (default UTC)
+//   - hours: the last N hours before end, used when start is not given
+//
+// Without any of these the last defaultHours hours are returned.
+func parseTimeRange(query url.Values, defaultHours int) (TimeRange, error) {
+	loc, err := parseLocation(query)
+	if err != nil {
+		return TimeRange{}, err
+	}
+
+	hours := defaultHours
+	if value := query.Get("hours"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return TimeRange{}, fmt.Errorf("invalid hours %q: expected a positive whole number", value)
+		}
+		hours = parsed
+	}
+
+	end, err := parseTimeParam(query.Get("end"), time.Now(), loc)
+	if err != nil {
+		return TimeRange{}, err
+	}
+	start, err := parseTimeParam(query.Get("start"), end.Add(-time.Duration(hours)*time.Hour), loc)
+	if err != nil {
+		return TimeRange{}, err
+	}
+	if !start.Before(end) {
+		return TimeRange{}, fmt.Errorf("start must be before end")
+	}
+
+	return TimeRange{Start: start.UTC(), End: end.UTC()}, nil
+}
+
+// parseMeasurementQuery reads a time range, sensor filter and field list from request parameters
+func parseMeasurementQuery(query url.Values, defaultHours int) (MeasurementQuery, error) {
+	timeRange, err := parseTimeRange(query, defaultHours)
+	if err != nil {
+		return MeasurementQuery{}, err
+	}
+	fields, err := parseMeasurementFields(query.Get("fields"))
+	if err != nil {
+		return MeasurementQuery{}, err
+	}
+
+	return MeasurementQuery{
+		Range:    timeRange,
+		SensorID: query.Get("sensor"),
+		Fields:   fields,
+	}, nil
+}
+
+// sqlFilter builds the WHERE clause and bound arguments for a query. placeholder returns
+// the bind parameter syntax for the nth argument, and formatTime converts range bounds
+// into the backend's representation.
+func (q MeasurementQuery) sqlFilter(placeholder func(n int) string, formatTime func(time.Time) interface{}) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, placeholder(len(args))))
+	}
+
+	if !q.Range.Start.IsZero() {
+		add("observed_at >= %s", formatTime(q.Range.Start.UTC()))
+	}
+	if !q.Range.End.IsZero() {
+		add("observed_at < %s", formatTime(q.Range.End.UTC()))
+	}
+	if q.SensorID != "" {
+		add("sensor_id = %s", q.SensorID)
+	}
+	if q.After != nil {
+		after := formatTime(q.After.ObservedAt.UTC())
+		args = append(args, after, after, q.After.ID)
+		n := len(args)
+		conditions = append(conditions, fmt.Sprintf("(observed_at > %s OR (observed_at = %s AND id > %s))",
+			placeholder(n-2), placeholder(n-1), placeholder(n)))
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// sqlLimit returns the LIMIT clause for the query, if it has one
+func (q MeasurementQuery) sqlLimit() string {
+	if q.Limit <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("LIMIT %d", q.Limit)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limit classes. Device requests are proxied to the sensor itself, which only
+// handles a few requests at a time; database requests only load this server.
+const (
+	rateClassDevice   = "device"
+	rateClassDatabase = "database"
+)
+
+// rateLimitIdleTimeout is how long an unused client bucket is kept before it is dropped
+const rateLimitIdleTimeout = 10 * time.Minute
+
+// RateLimitConfig controls per-client request throttling
+type RateLimitConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Device limits /data and /data/json, which query the sensor on every request
+	Device RateBudget `json:"device"`
+
+	// Database limits the /api endpoints
+	Database RateBudget `json:"database"`
+
+	// TrustForwardedFor identifies clients by the X-Forwarded-For header. Only enable
+	// it behind a reverse proxy that sets the header, or clients can pick their own.
+	TrustForwardedFor bool `json:"trust_forwarded_for"`
+}
+
+// RateBudget is a token bucket: a client may make Burst requests at once, refilled at
+// PerMinute requests per minute
+type RateBudget struct {
+	PerMinute float64 `json:"per_minute"`
+	Burst     int     `json:"burst"`
+}
+
+// validate fills in default budgets and checks the configured ones
+func (c *RateLimitConfig) validate() error {
+	if c.Device == (RateBudget{}) {
+		c.Device = RateBudget{PerMinute: 6, Burst: 3}
+	}
+	if c.Database == (RateBudget{}) {
+		c.Database = RateBudget{PerMinute: 120, Burst: 30}
+	}
+	for name, b := range map[string]RateBudget{rateClassDevice: c.Device, rateClassDatabase: c.Database} {
+		if b.PerMinute <= 0 || b.Burst < 1 {
+			return fmt.Errorf("rate_limit.%s needs a positive per_minute and a burst of at least 1", name)
+		}
+	}
+	return nil
+}
+
+// rateClass returns the rate limit class of a request path, or "" if it is not limited.
+// Pages, static assets and health checks are cheap and not limited.
+func rateClass(path string) string {
+	switch {
+	case path == "/data" || path == "/data/json":
+		return rateClassDevice
+	case strings.HasPrefix(path, "/api/"):
+		return rateClassDatabase
+	default:
+		return ""
+	}
+}
+
+// tokenBucket holds one client's remaining requests for one class
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimitStats reports how many requests were allowed and throttled per class
+type RateLimitStats struct {
+	Allowed   map[string]int64 `json:"allowed"`
+	Throttled map[string]int64 `json:"throttled"`
+	Clients   int              `json:"clients"`
+}
+
+// RateLimiter throttles requests per client with a token bucket for each rate class
+type RateLimiter struct {
+	budgets           map[string]RateBudget
+	trustForwardedFor bool
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	allowed   map[string]int64
+	throttled map[string]int64
+}
+
+// NewRateLimiter creates a rate limiter from validated configuration
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		budgets: map[string]RateBudget{
+			rateClassDevice:   cfg.Device,
+			rateClassDatabase: cfg.Database,
+		},
+		trustForwardedFor: cfg.TrustForwardedFor,
+		buckets:           make(map[string]*tokenBucket),
+		lastPrune:         time.Now(),
+		allowed:           make(map[string]int64),
+		throttled:         make(map[string]int64),
+	}
+}
+
+// Allow takes a token from the client's bucket for class. If the bucket is empty it
+// returns false and how long until a token is available.
+func (l *RateLimiter) Allow(client, class string, now time.Time) (bool, time.Duration) {
+	budget := l.budgets[class]
+	rate := budget.PerMinute / 60 // tokens per second
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) >= rateLimitIdleTimeout {
+		l.prune(now)
+	}
+
+	key := class + " " + client
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(budget.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(budget.Burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		l.throttled[class]++
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	l.allowed[class]++
+	return true, 0
+}
+
+// prune drops buckets that have not been used recently; they would be full again anyway
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= rateLimitIdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// Stats returns a snapshot of the throttling metrics
+func (l *RateLimiter) Stats() RateLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := RateLimitStats{
+		Allowed:   make(map[string]int64, len(l.allowed)),
+		Throttled: make(map[string]int64, len(l.throttled)),
+		Clients:   len(l.buckets),
+	}
+	for class := range l.budgets {
+		stats.Allowed[class] = l.allowed[class]
+		stats.Throttled[class] = l.throttled[class]
+	}
+	return stats
+}
+
+// clientID identifies who a request counts against: its IP address. Requests are
+// limited before their API key is checked, so a key can't be used to identify them.
+func (l *RateLimiter) clientID(r *http.Request) string {
+	if l.trustForwardedFor {
+		// The last address was added by our proxy; earlier ones can be forged
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			return "ip:" + strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimit is router middleware that throttles clients when rate limiting is enabled
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := rateClass(r.URL.Path)
+		if s.limiter == nil || class == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := s.limiter.clientID(r)
+		ok, wait := s.limiter.Allow(client, class, time.Now())
+		if !ok {
+			// Throttled requests are counted in /health and logged only at debug level, so
+			// a client hammering the server can't flood the log
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, http.StatusTooManyRequests, errRateLimited, "Too many requests, please slow down")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
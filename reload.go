@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 5 * time.Second
+
+// EnableConfigReload reloads the config file when it changes or the process receives
+// SIGHUP. cfg is the configuration the server was set up from.
+func (s *Server) EnableConfigReload(path string, cfg *Config) {
+	s.configPath = path
+	s.config = cfg
+}
+
+// fileVersion identifies a version of a file by its modification time and size
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// statConfig returns the config file's version, or the zero version if it doesn't exist
+func statConfig(path string) fileVersion {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}
+}
+
+// watchConfig reloads the config file whenever it changes, until the server stops. The
+// file is polled rather than watched, which works the same on every platform and for
+// files replaced by editors or config management.
+func (s *Server) watchConfig() {
+	last := statConfig(s.configPath)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			version := statConfig(s.configPath)
+			if version == last {
+				continue
+			}
+			last = version
+			s.reloadConfig("file changed")
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reloadOnHangup reloads the config file and the TLS certificate each time the process
+// receives SIGHUP, until the server stops
+func (s *Server) reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			if s.configPath != "" {
+				s.reloadConfig("SIGHUP")
+			}
+			if s.tls != nil && s.tls.reloader != nil {
+				slog.Info("Received SIGHUP, reloading TLS certificate")
+				if err := s.tls.reloader.Reload(); err != nil {
+					slog.Error("Error reloading TLS certificate, keeping the current one", "error", err)
+				}
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reloadConfig loads the config file again and applies the changes to sensors,
+// collection intervals, SMTP settings and reports. An invalid file is rejected and the
+// current configuration keeps running.
+func (s *Server) reloadConfig(trigger string) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	// A file that is missing, perhaps only while an editor replaces it, would load as
+	// the defaults and stop every configured sensor
+	if _, err := os.Stat(s.configPath); errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Config file is missing, keeping the current configuration", "path", s.configPath, "trigger", trigger)
+		return
+	}
+	cfg, err := LoadConfig(s.configPath)
+	if err != nil {
+		slog.Error("Invalid config, keeping the current configuration", "path", s.configPath, "trigger", trigger, "error", err)
+		return
+	}
+
+	old := s.config
+	started, stopped, changed := s.reloadCollectors(old.Collection, cfg.Collection)
+
+	reportsChanged := !sameJSON(old.SMTP, cfg.SMTP) || !sameJSON(old.Reports, cfg.Reports)
+	if reportsChanged {
+		s.stopReports()
+		s.smtp = cfg.SMTP
+		s.reports = cfg.Reports
+		s.startReports()
+	}
+
+	// These are wired into the HTTP server and logger when the server starts
+	for _, section := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"auth", old.Auth, cfg.Auth},
+		{"tls", old.TLS, cfg.TLS},
+		{"rate_limit", old.RateLimit, cfg.RateLimit},
+		{"logging", old.Logging, cfg.Logging},
+	} {
+		if !sameJSON(section.old, section.new) {
+			slog.Warn("Config section changed but only takes effect after a restart", "section", section.name)
+		}
+	}
+
+	s.config = cfg
+	slog.Info("Configuration reloaded", "path", s.configPath, "trigger", trigger,
+		"sensors_started", started, "sensors_stopped", stopped, "sensors_changed", changed,
+		"reports_changed", reportsChanged)
+}
+
+// reloadCollectors starts collectors for new sensors, stops those for removed ones and
+// reschedules those whose interval or jitter changed. A sensor whose URL changed is
+// replaced. Sensors that didn't change in the file keep running undisturbed, including
+// any pause or interval set through the admin API.
+func (s *Server) reloadCollectors(old, cfg CollectionConfig) (started, stopped, changed []string) {
+	previous := make(map[string]SensorConfig)
+	for _, sensor := range old.sensorsOrDefault(s.device.URL()) {
+		previous[sensor.Name] = sensor
+	}
+
+	s.collectorsMu.Lock()
+	defer s.collectorsMu.Unlock()
+
+	running := make(map[string]*Collector, len(s.collectors))
+	for _, c := range s.collectors {
+		running[c.Name] = c
+	}
+
+	var collectors []*Collector
+	for _, sensor := range cfg.sensorsOrDefault(s.device.URL()) {
+		c, ok := running[sensor.Name]
+		if ok && sameSensor(c.Device, sensor) {
+			delete(running, sensor.Name)
+			if previous[sensor.Name].interval != sensor.interval || old.jitter != cfg.jitter {
+				interval := c.Interval()
+				if previous[sensor.Name].interval != sensor.interval {
+					interval = sensor.interval
+				}
+				if err := c.SetSchedule(interval, cfg.jitter); err != nil {
+					// An interval set through the admin API may not fit the new jitter
+					c.SetSchedule(sensor.interval, cfg.jitter)
+				}
+				changed = append(changed, sensor.Name)
+			}
+			collectors = append(collectors, c)
+			continue
+		}
+
+		c = s.newCollector(sensor, cfg.jitter)
+		s.startCollector(c)
+		collectors = append(collectors, c)
+		started = append(started, sensor.Name)
+	}
+
+	for name, c := range running {
+		c.cancel()
+		stopped = append(stopped, name)
+	}
+	sort.Strings(stopped)
+	s.collectors = collectors
+	s.discovery = cfg.Discovery
+	return started, stopped, changed
+}
+
+// sameSensor reports whether a running device reads the configured sensor. Discovery
+// may have moved a sensor configured by ID, so only its ID is compared.
+func sameSensor(device *Device, sensor SensorConfig) bool {
+	if sensor.SensorID != "" || device.SensorID() != "" {
+		return sameSensorID(device.SensorID(), sensor.SensorID)
+	}
+	return device.URL() == sensor.URL
+}
+
+// sameJSON reports whether two config sections have the same settings
+func sameJSON(a, b interface{}) bool {
+	aJSON, errA := json.Marshal(a)
+	bJSON, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(aJSON) == string(bJSON)
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report periods
+const (
+	reportDaily   = "daily"
+	reportWeekly  = "weekly"
+	reportMonthly = "monthly"
+)
+
+// Report chart size, in pixels
+const (
+	reportChartWidth  = 640
+	reportChartHeight = 260
+)
+
+// reportImage is a chart embedded in a report email and referenced by Content-ID
+type reportImage struct {
+	CID  string
+	Name string
+	Data []byte
+}
+
+// Src returns the image's cid: URL for use in the report HTML
+func (i reportImage) Src() template.URL {
+	return template.URL("cid:" + i.CID)
+}
+
+// reportEmail is a rendered report ready to send
+type reportEmail struct {
+	Subject string
+	HTML    []byte
+	Images  []reportImage
+}
+
+// reportCategory is one row of the AQI category breakdown
+type reportCategory struct {
+	Name    string
+	Color   string
+	Hours   int
+	Percent float64
+}
+
+// reportRange returns the period a report sent at now covers: the previous calendar day,
+// the seven days before today, or the previous calendar month
+func reportRange(period string, now time.Time, loc *time.Location) TimeRange {
+	local := now.In(loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	switch period {
+	case reportWeekly:
+		return TimeRange{Start: today.AddDate(0, 0, -7), End: today}
+	case reportMonthly:
+		thisMonth := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, loc)
+		return TimeRange{Start: thisMonth.AddDate(0, -1, 0), End: thisMonth}
+	default:
+		return TimeRange{Start: today.AddDate(0, 0, -1), End: today}
+	}
+}
+
+// reportTemplate is the email body. Styles are inline because many mail clients ignore
+// style sheets.
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body style="font-family: Arial, sans-serif; background-color: #f5f5f5; margin: 0; padding: 20px;">
+<div style="max-width: 680px; margin: 0 auto; background: white; padding: 20px; border-radius: 8px;">
+  <h1 style="color: #333; border-bottom: 2px solid #007bff; padding-bottom: 10px; font-size: 22px;">{{.Title}}</h1>
+  <p style="color: #666;">{{.Start}} to {{.End}}{{if .Sensor}} &middot; sensor {{.Sensor}}{{end}}</p>
+
+  {{if .Stats.Count}}
+  <h2 style="color: #007bff; font-size: 18px;">Summary</h2>
+  <table style="border-collapse: collapse; width: 100%;">
+    <tr><td style="padding: 6px; border-bottom: 1px solid #eee;">Measurements</td><td style="padding: 6px; border-bottom: 1px solid #eee; text-align: right; font-weight: bold;">{{.Stats.Count}}</td></tr>
+    <tr><td style="padding: 6px; border-bottom: 1px solid #eee;">Average PM2.5 AQI</td><td style="padding: 6px; border-bottom: 1px solid #eee; text-align: right; font-weight: bold;">{{printf "%.1f" .Stats.AvgPM25AQI}} (min {{.Stats.MinPM25AQI}}, max {{.Stats.MaxPM25AQI}})</td></tr>
+    <tr><td style="padding: 6px; border-bottom: 1px solid #eee;">Average PM2.5</td><td style="padding: 6px; border-bottom: 1px solid #eee; text-align: right; font-weight: bold;">{{printf "%.1f" .MeanPM25}} µg/m³</td></tr>
+    <tr><td style="padding: 6px; border-bottom: 1px solid #eee;">Average PM10</td><td style="padding: 6px; border-bottom: 1px solid #eee; text-align: right; font-weight: bold;">{{printf "%.1f" .Stats.AvgPM100CF1}} µg/m³</td></tr>
+    <tr><td style="padding: 6px; border-bottom: 1px solid #eee;">Temperature</td><td style="padding: 6px; border-bottom: 1px solid #eee; text-align: right; font-weight: bold;">{{printf "%.1f" .Stats.AvgTemp}}°F (min {{printf "%.1f" .Stats.MinTemp}}, max {{printf "%.1f" .Stats.MaxTemp}})</td></tr>
+    <tr><td style="padding: 6px; border-bottom: 1px solid #eee;">Average humidity</td><td style="padding: 6px; border-bottom: 1px solid #eee; text-align: right; font-weight: bold;">{{printf "%.1f" .Stats.AvgHumidity}}%</td></tr>
+    <tr><td style="padding: 6px;">Average pressure</td><td style="padding: 6px; text-align: right; font-weight: bold;">{{printf "%.1f" .Stats.AvgPressure}} hPa</td></tr>
+  </table>
+
+  {{if .Categories}}
+  <h2 style="color: #007bff; font-size: 18px;">Hours by AQI Category</h2>
+  <table style="border-collapse: collapse; width: 100%;">
+    {{range .Categories}}
+    <tr>
+      <td style="padding: 6px; border-bottom: 1px solid #eee;"><span style="display: inline-block; width: 12px; height: 12px; background: {{.Color}}; margin-right: 6px;"></span>{{.Name}}</td>
+      <td style="padding: 6px; border-bottom: 1px solid #eee; text-align: right;">{{.Hours}} h</td>
+      <td style="padding: 6px; border-bottom: 1px solid #eee; text-align: right; color: #666;">{{printf "%.0f" .Percent}}%</td>
+    </tr>
+    {{end}}
+  </table>
+  {{end}}
+
+  <h2 style="color: #007bff; font-size: 18px;">Charts</h2>
+  {{range .Images}}<p><img src="{{.Src}}" alt="{{.Name}}" width="640" style="max-width: 100%;"></p>{{end}}
+  {{else}}
+  <p style="color: #666; font-style: italic;">No measurements were recorded in this period.</p>
+  {{end}}
+
+  <p style="color: #999; font-size: 12px; margin-top: 30px;">Generated {{.Generated}} by Air Quality Monitor</p>
+</div>
+</body>
+</html>
+`))
+
+// newContentID returns a unique Content-ID for an inline image
+func newContentID(name string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return name + "." + hex.EncodeToString(b) + "@air-quality-monitor"
+}
+
+// reportSamples holds a report's PM2.5 and temperature readings per sensor
+type reportSamples struct {
+	pm25      map[string][]ChartPoint
+	temp      map[string][]ChartPoint
+	pm25Sum   float64
+	pm25Count int
+}
+
+// loadReportSamples reads the measurements a report charts and averages. PM2.5 is chosen
+// by samplePM25, as for daily summaries and exposure, so the chart and the average agree.
+func loadReportSamples(database Storage, q MeasurementQuery) (*reportSamples, error) {
+	samples := &reportSamples{pm25: make(map[string][]ChartPoint), temp: make(map[string][]ChartPoint)}
+	q.Fields = []string{"observed_at", "sensor_id", "pm25_cf1", "pm25_cf1_b", "current_temp_f"}
+	err := database.QueryMeasurements(q, func(values []interface{}) error {
+		observed, err := scannedTime(values[0])
+		if err != nil {
+			return err
+		}
+		sensorID := scannedString(values[1])
+		if pm, ok := samplePM25(values[2], values[3]); ok {
+			samples.pm25[sensorID] = append(samples.pm25[sensorID], ChartPoint{Time: observed, Value: pm})
+			samples.pm25Sum += pm
+			samples.pm25Count++
+		}
+		if temp, ok := numericValue(values[4]); ok {
+			samples.temp[sensorID] = append(samples.temp[sensorID], ChartPoint{Time: observed, Value: temp})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report measurements: %w", err)
+	}
+	return samples, nil
+}
+
+// meanPM25 returns the mean of the charted PM2.5 readings
+func (s *reportSamples) meanPM25() float64 {
+	if s.pm25Count == 0 {
+		return 0
+	}
+	return s.pm25Sum / float64(s.pm25Count)
+}
+
+// reportCharts renders the PM2.5 and temperature charts for a report, with one series
+// per sensor
+func reportCharts(samples *reportSamples, loc *time.Location) ([]reportImage, error) {
+	charts := []struct {
+		name, title string
+		points      map[string][]ChartPoint
+	}{
+		{"pm25", "PM2.5 (ug/m3)", samples.pm25},
+		{"temperature", "Temperature (F)", samples.temp},
+	}
+
+	var images []reportImage
+	for _, c := range charts {
+		chart := &Chart{
+			Title:    c.title,
+			Width:    reportChartWidth,
+			Height:   reportChartHeight,
+			Location: loc,
+			MaxGap:   defaultMaxSampleGap,
+		}
+		sensors := make([]string, 0, len(c.points))
+		for sensor := range c.points {
+			sensors = append(sensors, sensor)
+		}
+		sort.Strings(sensors)
+		for _, sensor := range sensors {
+			chart.Series = append(chart.Series, ChartSeries{Label: sensor, Points: c.points[sensor]})
+		}
+
+		var buf bytes.Buffer
+		if err := chart.RenderPNG(&buf); err != nil {
+			return nil, err
+		}
+		images = append(images, reportImage{CID: newContentID(c.name), Name: c.name + ".png", Data: buf.Bytes()})
+	}
+	return images, nil
+}
+
+// reportCategories totals the hours in each AQI category from the daily summaries
+func reportCategories(database Storage, sensorID string, r TimeRange, loc *time.Location) ([]reportCategory, error) {
+	from := r.Start.In(loc).Format(summaryDateFormat)
+	to := r.End.In(loc).Format(summaryDateFormat)
+	summaries, err := database.GetDailySummaries(sensorID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var hours CategoryHours
+	for _, s := range summaries {
+		hours.Good += s.Hours.Good
+		hours.Moderate += s.Hours.Moderate
+		hours.UnhealthySensitive += s.Hours.UnhealthySensitive
+		hours.Unhealthy += s.Hours.Unhealthy
+		hours.VeryUnhealthy += s.Hours.VeryUnhealthy
+		hours.Hazardous += s.Hours.Hazardous
+	}
+	counts := []int{hours.Good, hours.Moderate, hours.UnhealthySensitive, hours.Unhealthy, hours.VeryUnhealthy, hours.Hazardous}
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return nil, nil
+	}
+
+	categories := make([]reportCategory, len(counts))
+	for i, n := range counts {
+		categories[i] = reportCategory{
+			Name:    aqiCategoryNames[i],
+			Color:   hexColor(aqiCategoryColors[i]),
+			Hours:   n,
+			Percent: float64(n) / float64(total) * 100,
+		}
+	}
+	return categories, nil
+}
+
+// buildReport renders the report for the period ending before now
+func buildReport(database Storage, cfg *ReportConfig, now time.Time) (*reportEmail, error) {
+	loc := cfg.location
+	if loc == nil {
+		loc = time.UTC
+	}
+	r := reportRange(cfg.Period, now, loc)
+	q := MeasurementQuery{Range: TimeRange{Start: r.Start.UTC(), End: r.End.UTC()}, SensorID: cfg.Sensor}
+
+	stats, err := database.GetMeasurementStats(q)
+	if err != nil {
+		return nil, err
+	}
+	categories, err := reportCategories(database, cfg.Sensor, r, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []reportImage
+	var meanPM25 float64
+	if stats.Count > 0 {
+		samples, err := loadReportSamples(database, q)
+		if err != nil {
+			return nil, err
+		}
+		meanPM25 = samples.meanPM25()
+		if images, err = reportCharts(samples, loc); err != nil {
+			return nil, err
+		}
+	}
+
+	period := strings.ToUpper(cfg.Period[:1]) + cfg.Period[1:]
+	title := fmt.Sprintf("%s Air Quality Report", period)
+	lastDay := r.End.AddDate(0, 0, -1)
+
+	var html bytes.Buffer
+	err = reportTemplate.Execute(&html, map[string]interface{}{
+		"Title":      title,
+		"Start":      r.Start.Format("Mon Jan 2, 2006"),
+		"End":        lastDay.Format("Mon Jan 2, 2006"),
+		"Sensor":     cfg.Sensor,
+		"Stats":      stats,
+		"MeanPM25":   meanPM25,
+		"Categories": categories,
+		"Images":     images,
+		"Generated":  now.In(loc).Format("Jan 2, 2006 15:04 MST"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render report: %w", err)
+	}
+
+	subject := fmt.Sprintf("%s: %s", title, r.Start.Format("Jan 2, 2006"))
+	if cfg.Period != reportDaily {
+		subject += " - " + lastDay.Format("Jan 2, 2006")
+	}
+	return &reportEmail{Subject: subject, HTML: html.Bytes(), Images: images}, nil
+}
+
+// buildMessage encodes the report as a multipart/related MIME message with the charts
+// as inline attachments
+func buildMessage(from string, to []string, email *reportEmail, now time.Time) ([]byte, error) {
+	var msg bytes.Buffer
+	related := multipart.NewWriter(&msg)
+
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/related; boundary=%q; type=\"text/html\"\r\n\r\n", related.Boundary())
+
+	htmlPart, err := related.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qp := quotedprintable.NewWriter(htmlPart)
+	if _, err := qp.Write(email.HTML); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, img := range email.Images {
+		part, err := related.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"image/png"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-ID":                {"<" + img.CID + ">"},
+			"Content-Disposition":       {fmt.Sprintf("inline; filename=%q", img.Name)},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Base64 bodies must be wrapped at 76 characters
+		encoded := base64.StdEncoding.EncodeToString(img.Data)
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+
+	if err := related.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// sendMail delivers a message through the configured SMTP server
+func sendMail(cfg SMTPConfig, to []string, msg []byte) error {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+
+	// The envelope sender is the bare address, without a display name
+	from := cfg.From
+	if parsed, err := mail.ParseAddress(cfg.From); err == nil {
+		from = parsed.Address
+	}
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	if !cfg.TLS {
+		// SendMail upgrades with STARTTLS when the server offers it
+		return smtp.SendMail(addr, auth, from, to, msg)
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: cfg.Host})
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	client, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// sendReport builds a report and emails it to its recipients
+func sendReport(database Storage, smtpCfg SMTPConfig, cfg *ReportConfig, now time.Time) error {
+	email, err := buildReport(database, cfg, now)
+	if err != nil {
+		return err
+	}
+	msg, err := buildMessage(smtpCfg.From, cfg.To, email, now)
+	if err != nil {
+		return fmt.Errorf("failed to build message: %w", err)
+	}
+	if err := sendMail(smtpCfg, cfg.To, msg); err != nil {
+		return fmt.Errorf("failed to send report: %w", err)
+	}
+	return nil
+}
+
+// runReportSchedule sends a report each time its schedule comes due, until stop is closed
+func runReportSchedule(database Storage, smtpCfg SMTPConfig, cfg ReportConfig, stop <-chan struct{}) {
+	for {
+		next := cfg.schedule.Next(time.Now().In(cfg.location))
+		if next.IsZero() {
+			slog.Warn("Report schedule never runs, disabling it", "report", cfg.Name)
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			if err := sendReport(database, smtpCfg, &cfg, next); err != nil {
+				slog.Error("Error sending report", "report", cfg.Name, "error", err)
+			} else {
+				slog.Info("Sent report", "report", cfg.Name, "to", strings.Join(cfg.To, ", "))
+			}
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// runReportCommand implements the `report` CLI command, which sends a configured report
+// immediately or writes it to a file
+func runReportCommand(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDatabasePath(), "SQLite database path or postgres:// connection URL")
+	configFile := fs.String("config", configPath(), "config file with the report and SMTP settings")
+	name := fs.String("name", "", "report to run (default the only configured report)")
+	output := fs.String("o", "", "write the message to this .eml file instead of sending it")
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	var report *ReportConfig
+	for i := range cfg.Reports {
+		if cfg.Reports[i].Name == *name || (*name == "" && len(cfg.Reports) == 1) {
+			report = &cfg.Reports[i]
+		}
+	}
+	if report == nil {
+		return fmt.Errorf("no report named %q in %s", *name, *configFile)
+	}
+
+	database, err := OpenStorage(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	now := time.Now()
+	if *output == "" {
+		if err := sendReport(database, cfg.SMTP, report, now); err != nil {
+			return err
+		}
+		fmt.Printf("Sent report %q to %s\n", report.Name, strings.Join(report.To, ", "))
+		return nil
+	}
+
+	email, err := buildReport(database, report, now)
+	if err != nil {
+		return err
+	}
+	msg, err := buildMessage(cfg.SMTP.From, report.To, email, now)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*output, msg, 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote report %q to %s\n", report.Name, *output)
+	return nil
+}
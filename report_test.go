@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/png"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reportTestDatabase returns a store with a day of readings for two sensors, and their
+// mean PM2.5. Every third reading of sensor b reads zero on channel B, which is a valid
+// reading and averaged like any other.
+func reportTestDatabase(t *testing.T, day time.Time) (*MemoryDatabase, float64) {
+	database := NewMemoryDatabase(1000)
+	var sum float64
+	var count int
+	for i := 0; i < 96; i++ {
+		for _, sensor := range []string{"a", "b"} {
+			data := testMeasurement(sensor, day.Add(time.Duration(i)*15*time.Minute), 50, float64(i%20))
+			data.Pm25Cf1B = data.Pm25Cf1 + 2
+			pm := data.Pm25Cf1 + 1
+			if sensor == "b" && i%3 == 0 {
+				data.Pm25Cf1B = 0
+				pm = data.Pm25Cf1 / 2
+			}
+			sum += pm
+			count++
+			if err := database.StoreMeasurement(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return database, sum / float64(count)
+}
+
+// parseReportMessage parses a report email, returning its HTML and its images by Content-ID
+func parseReportMessage(t *testing.T, raw []byte) (string, map[string][]byte) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("failed to parse message: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" || params["type"] != "text/html" {
+		t.Fatalf("Content-Type = %q, want multipart/related with type text/html", msg.Header.Get("Content-Type"))
+	}
+
+	var html string
+	images := make(map[string][]byte)
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for i := 0; ; i++ {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read part %d: %v", i, err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch part.Header.Get("Content-Type") {
+		case "text/html; charset=utf-8":
+			if i != 0 {
+				t.Errorf("HTML is part %d, want the root part", i)
+			}
+			decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+			if err != nil {
+				t.Fatalf("failed to decode HTML: %v", err)
+			}
+			html = string(decoded)
+		case "image/png":
+			// A received message may have had its line endings normalized to LF
+			lines := strings.Fields(string(body))
+			for _, line := range lines {
+				if len(line) > 76 {
+					t.Errorf("base64 line is %d characters long", len(line))
+				}
+			}
+			decoded, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+			if err != nil {
+				t.Fatalf("failed to decode image: %v", err)
+			}
+			cid := strings.Trim(part.Header.Get("Content-ID"), "<>")
+			images[cid] = decoded
+		default:
+			t.Errorf("unexpected part type %q", part.Header.Get("Content-Type"))
+		}
+	}
+	return html, images
+}
+
+func TestReportMessageEmbedsCharts(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	database, _ := reportTestDatabase(t, day)
+
+	cfg := &ReportConfig{Period: reportDaily, To: []string{"ops@example.com"}}
+	email, err := buildReport(database, cfg, day.AddDate(0, 0, 1).Add(6*time.Hour))
+	if err != nil {
+		t.Fatalf("buildReport: %v", err)
+	}
+	raw, err := buildMessage("Monitor <monitor@example.com>", cfg.To, email, day)
+	if err != nil {
+		t.Fatalf("buildMessage: %v", err)
+	}
+
+	html, images := parseReportMessage(t, raw)
+	refs := regexp.MustCompile(`src="cid:([^"]+)"`).FindAllStringSubmatch(html, -1)
+	if len(refs) != 2 || len(images) != 2 {
+		t.Fatalf("HTML references %d images and the message has %d, want 2 of each", len(refs), len(images))
+	}
+	for _, ref := range refs {
+		data, ok := images[ref[1]]
+		if !ok {
+			t.Errorf("HTML references cid:%s, which is not in the message", ref[1])
+			continue
+		}
+		config, err := png.DecodeConfig(bytes.NewReader(data))
+		if err != nil || config.Width != reportChartWidth || config.Height != reportChartHeight {
+			t.Errorf("image %s is not a %dx%d PNG: %v", ref[1], reportChartWidth, reportChartHeight, err)
+		}
+	}
+}
+
+func TestReportAveragesChartedPM25(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	database, want := reportTestDatabase(t, day)
+
+	samples, err := loadReportSamples(database, MeasurementQuery{Range: TimeRange{Start: day, End: day.AddDate(0, 0, 1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(samples.meanPM25()-want) > 1e-9 {
+		t.Errorf("mean PM2.5 = %g, want %g", samples.meanPM25(), want)
+	}
+
+	var sum float64
+	var count int
+	for _, points := range samples.pm25 {
+		for _, p := range points {
+			sum += p.Value
+			count++
+		}
+	}
+	if count != 192 || math.Abs(sum/float64(count)-samples.meanPM25()) > 1e-9 {
+		t.Errorf("chart has %d points averaging %g, want 192 averaging %g", count, sum/float64(count), samples.meanPM25())
+	}
+}
+
+// smtpSink accepts one SMTP session on a local port and returns the message it received
+func smtpSink(t *testing.T) (addr string, received <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan []byte, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 sink ready")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			switch command := strings.ToUpper(strings.Fields(line + " ")[0]); command {
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				messages <- data
+				text.PrintfLine("250 queued")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func TestSendReportDeliversToSMTPServer(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	database, _ := reportTestDatabase(t, day)
+
+	addr, received := smtpSink(t)
+	host, port, _ := net.SplitHostPort(addr)
+	portNumber, _ := strconv.Atoi(port)
+	smtpCfg := SMTPConfig{Host: host, Port: portNumber, From: "Monitor <monitor@example.com>"}
+
+	cfg := &ReportConfig{Period: reportDaily, To: []string{"ops@example.com"}}
+	if err := sendReport(database, smtpCfg, cfg, day.AddDate(0, 0, 1).Add(6*time.Hour)); err != nil {
+		t.Fatalf("sendReport: %v", err)
+	}
+
+	select {
+	case raw := <-received:
+		html, images := parseReportMessage(t, raw)
+		if !strings.Contains(html, "Daily Air Quality Report") || len(images) != 2 {
+			t.Errorf("delivered report has %d images and HTML %.80q", len(images), html)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message was delivered")
+	}
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -12,138 +22,199 @@ import (
 
 // Server represents the web server for serving air quality data
 type Server struct {
-	deviceURL string
+	device    *Device
 	router    *mux.Router
-	database  *Database
+	database  Storage
+	backups   *BackupConfig
+	summaries *SummaryTracker
+	smtp      SMTPConfig
+	reports   []ReportConfig
+	auth      AuthConfig
+	limiter   *RateLimiter
 	stopChan  chan struct{}
+	stopOnce  sync.Once
+	http      *http.Server
+	web       *WebAssets
+	openapi   []byte
+
+	// workers tracks the background goroutines, so storage is closed only after they
+	// have stopped using it
+	workers sync.WaitGroup
+
+	// collectors read sensors in the background once the server starts. They can be
+	// replaced when the config is reloaded.
+	collectors   []*Collector
+	collectorsMu sync.RWMutex
+
+	// discovery finds sensors configured by ID when their address changes
+	discovery DiscoveryConfig
+
+	// config is the configuration last loaded from configPath, when reloading is enabled
+	config     *Config
+	configPath string
+	reloadMu   sync.Mutex
+
+	// stopReports stops the report schedules so they can be replaced
+	stopReports func()
+
+	// HTTPS, when enabled, and the plain HTTP server redirecting to it
+	tls          *serverTLS
+	redirect     *http.Server
+	redirectAddr string
 }
 
 // NewServer creates a new server instance
-func NewServer(deviceURL string, database *Database) *Server {
+func NewServer(deviceURL string, database Storage) *Server {
+	web, err := NewWebAssets()
+	if err != nil {
+		// The assets are compiled in, so this only fails on a broken build
+		log.Fatalf("Failed to load web assets: %v", err)
+	}
+
 	s := &Server{
-		deviceURL: deviceURL,
-		router:    mux.NewRouter(),
-		database:  database,
-		stopChan:  make(chan struct{}),
+		device:   NewDevice(deviceURL),
+		router:   mux.NewRouter(),
+		database: database,
+		stopChan: make(chan struct{}),
+		web:      web,
 	}
+	s.collectors = []*Collector{NewCollector(hostName(deviceURL), s.device, defaultCollectionInterval, 0)}
 	s.setupRoutes()
 	return s
 }
 
-// setupRoutes configures the HTTP routes
+// routes returns the route table, from which both the router and the OpenAPI document
+// are built
+func (s *Server) routes() []route {
+	htmlContent := []string{"text/html"}
+	jsonContent := []string{"application/json"}
+
+	return []route{
+		{Method: "GET", Path: "/", Handler: s.web.page("home.html"), Summary: "Dashboard with the current reading", Tag: "Pages", Content: htmlContent},
+		{Method: "GET", Path: "/graphs", Handler: s.web.page("graphs.html"), Summary: "Historical graphs", Tag: "Pages", Content: htmlContent},
+		{Method: "GET", Path: "/calendar", Handler: s.web.page("calendar.html"), Summary: "Calendar of daily air quality", Tag: "Pages", Content: htmlContent},
+		{Method: "GET", Path: "/exposure", Handler: s.web.page("exposure.html"), Summary: "Exposure and exceedance report", Tag: "Pages", Content: htmlContent},
+		{Method: "GET", Path: staticPrefix + "{name}", Handler: s.web.serveStatic, Summary: "Static asset used by the pages", Tag: "Pages",
+			Params:  []routeParam{{Name: "name", In: "path", Type: "string", Description: "File name, optionally with a content hash"}},
+			Content: []string{"text/css", "text/javascript"}},
+
+		{Method: "GET", Path: "/data", Handler: s.handleGetData, Summary: "Current reading from the sensor as text", Tag: "Device", Content: []string{"text/plain"}},
+		{Method: "GET", Path: "/data/json", Handler: s.handleGetDataJSON, Summary: "Current reading from the sensor, which is also stored", Tag: "Device", Content: jsonContent},
+		{Method: "GET", Path: "/health", Handler: s.handleHealth, Summary: "Readiness checks with operational statistics; 503 when degraded", Tag: "Health", Content: jsonContent},
+		{Method: "GET", Path: "/health/live", Handler: s.handleLive, Summary: "Liveness check: the server is up", Tag: "Health", Content: jsonContent},
+		{Method: "GET", Path: "/health/ready", Handler: s.handleReady, Summary: "Readiness checks; 503 when degraded", Tag: "Health", Content: jsonContent},
+		{Method: "GET", Path: legacyAPIPrefix + "/openapi.json", Handler: s.handleOpenAPI, Summary: "This OpenAPI document", Tag: "Health", Content: jsonContent},
+		{Method: "GET", Path: "/openapi.json", API: true, Handler: s.handleOpenAPI, Summary: "This OpenAPI document", Tag: "Health", Content: jsonContent},
+
+		{Method: "GET", Path: "/measurements", API: true, Handler: s.handleGetMeasurements, Summary: "One page of stored measurements", Tag: "Measurements",
+			Params: params(timeRangeParams, []routeParam{sensorParam, fieldsParam,
+				{Name: "limit", In: "query", Type: "integer", Description: fmt.Sprintf("Measurements per page (default %d, at most %d)", defaultPageLimit, maxPageLimit)},
+				{Name: "cursor", In: "query", Type: "string", Description: "next_cursor from the previous page"},
+			}),
+			Content: jsonContent},
+		{Method: "GET", Path: "/stats", API: true, Handler: s.handleGetStats, Summary: "Measurement statistics", Tag: "Measurements",
+			Params: params(timeRangeParams, []routeParam{sensorParam,
+				{Name: "group_by", In: "query", Type: "string", Enum: []string{groupByHourOfDay, groupByDayOfWeek}, Description: "Also group the statistics by local hour or weekday"},
+			}),
+			Content: jsonContent},
+		{Method: "GET", Path: "/daily", API: true, Handler: s.handleGetDaily, Summary: "Stored daily summaries", Tag: "Measurements",
+			Params: params(timeRangeParams, []routeParam{sensorParam}), Content: jsonContent},
+		{Method: "GET", Path: "/exposure", API: true, Handler: s.handleGetExposure, Summary: "Exposure and exceedance report (default the last week)", Tag: "Reports",
+			Params: params(timeRangeParams, []routeParam{sensorParam,
+				{Name: "pm25", In: "query", Type: "number", Description: "PM2.5 threshold in µg/m³"},
+				{Name: "aqi", In: "query", Type: "integer", Description: "AQI threshold"},
+				{Name: "daily_standard", In: "query", Type: "number", Description: "24-hour PM2.5 standard in µg/m³"},
+				{Name: "max_gap", In: "query", Type: "number", Description: "Longest gap in minutes a reading is assumed to last"},
+			}),
+			Content: jsonContent},
+		{Method: "GET", Path: "/chart.{format:png|svg}", API: true, Handler: s.handleChart, Summary: "Time-series chart image", Tag: "Reports",
+			Params: params([]routeParam{{Name: "format", In: "path", Type: "string", Enum: []string{"png", "svg"}, Description: "Image format"}},
+				timeRangeParams, []routeParam{
+					{Name: "sensor", In: "query", Type: "string", Description: "Comma separated sensor IDs (default all sensors); each sensor gets its own series"},
+					{Name: "fields", In: "query", Type: "string", Description: "Comma separated numeric fields (default pm25_cf1)"},
+					{Name: "title", In: "query", Type: "string", Description: "Chart title (default the field names)"},
+					{Name: "width", In: "query", Type: "integer", Description: fmt.Sprintf("Width in pixels (default %d)", defaultChartWidth)},
+					{Name: "height", In: "query", Type: "integer", Description: fmt.Sprintf("Height in pixels (default %d)", defaultChartHeight)},
+					{Name: "theme", In: "query", Type: "string", Enum: []string{"light", "dark"}, Description: "Color theme (default light)"},
+					{Name: "bands", In: "query", Type: "string", Enum: []string{"aqi"}, Description: "Shade the AQI categories behind PM2.5 or AQI fields"},
+				}),
+			Content: []string{"image/png", "image/svg+xml"}},
+		{Method: "GET", Path: "/export", API: true, Handler: s.handleExport, Summary: "Export measurements", Tag: "Import and export",
+			Params: params(timeRangeParams, []routeParam{sensorParam, fieldsParam,
+				{Name: "format", In: "query", Type: "string", Enum: []string{"csv", "ndjson"}, Description: "File format (default csv)"},
+			}),
+			Content: []string{"text/csv", "application/x-ndjson"}},
+		{Method: "GET", Path: "/admin/collectors", API: true, Handler: s.handleListCollectors, Summary: "Status of every sensor collector", Tag: "Admin", Content: jsonContent},
+		{Method: "GET", Path: "/admin/collectors/{name}", API: true, Handler: s.handleGetCollector, Summary: "Status of a sensor collector", Tag: "Admin",
+			Params: []routeParam{collectorParam}, Content: jsonContent},
+		{Method: "POST", Path: "/admin/collectors/{name}/pause", API: true, Handler: s.handlePauseCollector, Summary: "Pause scheduled collection from a sensor", Tag: "Admin",
+			Params: []routeParam{collectorParam}, Content: jsonContent},
+		{Method: "POST", Path: "/admin/collectors/{name}/resume", API: true, Handler: s.handleResumeCollector, Summary: "Resume scheduled collection from a sensor", Tag: "Admin",
+			Params: []routeParam{collectorParam}, Content: jsonContent},
+		{Method: "POST", Path: "/admin/collectors/{name}/collect", API: true, Handler: s.handleTriggerCollection, Summary: "Read a sensor and store the measurement now", Tag: "Admin",
+			Params: []routeParam{collectorParam}, Content: jsonContent},
+		{Method: "PUT", Path: "/admin/collectors/{name}/interval", API: true, Handler: s.handleSetCollectorInterval, Summary: "Change how often a sensor is read, from a body like {\"interval\": \"2m\"}", Tag: "Admin",
+			Params: []routeParam{collectorParam}, Body: jsonContent, Content: jsonContent},
+		{Method: "POST", Path: "/import", API: true, Handler: s.handleImport, Summary: "Import PurpleAir SD card CSV logs", Tag: "Import and export",
+			Params:  []routeParam{{Name: "sensor", In: "query", Type: "string", Description: "Sensor ID for logs that don't include one"}},
+			Body:    []string{"multipart/form-data", "text/csv"},
+			Content: jsonContent},
+	}
+}
+
+// setupRoutes registers the route table. API routes are also served at their original
+// unversioned paths, marked deprecated, so existing scripts and bookmarks keep working.
 func (s *Server) setupRoutes() {
-	s.router.HandleFunc("/", s.handleHome).Methods("GET")
-	s.router.HandleFunc("/data", s.handleGetData).Methods("GET")
-	s.router.HandleFunc("/data/json", s.handleGetDataJSON).Methods("GET")
-	s.router.HandleFunc("/health", s.handleHealth).Methods("GET")
-	s.router.HandleFunc("/graphs", s.handleGraphs).Methods("GET")
-	s.router.HandleFunc("/api/measurements", s.handleGetMeasurements).Methods("GET")
-	s.router.HandleFunc("/api/stats", s.handleGetStats).Methods("GET")
-}
-
-// handleHome serves the home page
-func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
-	html := `<!DOCTYPE html>
-<html>
-<head>
-    <title>Air Quality Monitor</title>
-    <meta charset="utf-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1">
-    <style>
-        body { font-family: Arial, sans-serif; margin: 20px; background-color: #f5f5f5; }
-        .container { max-width: 800px; margin: 0 auto; background: white; padding: 20px; border-radius: 8px; box-shadow: 0 2px 4px rgba(0,0,0,0.1); }
-        .header { text-align: center; color: #333; border-bottom: 2px solid #007bff; padding-bottom: 10px; margin-bottom: 20px; }
-        .data-section { margin: 20px 0; padding: 15px; border: 1px solid #ddd; border-radius: 5px; }
-        .data-section h3 { color: #007bff; margin-top: 0; }
-        .metric { display: flex; justify-content: space-between; margin: 5px 0; padding: 5px 0; border-bottom: 1px solid #eee; }
-        .metric:last-child { border-bottom: none; }
-        .value { font-weight: bold; color: #28a745; }
-        .refresh-btn { background: #007bff; color: white; border: none; padding: 10px 20px; border-radius: 5px; cursor: pointer; margin: 10px 0; }
-        .refresh-btn:hover { background: #0056b3; }
-        .last-updated { text-align: center; color: #666; font-size: 0.9em; margin-top: 20px; }
-        .loading { text-align: center; color: #666; font-style: italic; }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <div class="header">
-            <h1>Air Quality Monitor</h1>
-            <p>Real-time air quality data from PurpleAir sensor</p>
-        </div>
-        
-        <button class="refresh-btn" onclick="location.reload()">Refresh Data</button>
-        <a href="/graphs" class="refresh-btn" style="text-decoration: none; display: inline-block; margin-left: 10px;">View Graphs</a>
-        
-        <div id="data-container">
-            <div class="loading">Loading data...</div>
-        </div>
-        
-        <div class="last-updated" id="last-updated"></div>
-    </div>
-
-    <script>
-        function updateData() {
-            fetch('/data/json')
-                .then(response => response.json())
-                .then(data => {
-                    const container = document.getElementById('data-container');
-                    let html = '';
-                    
-                    html += '<div class="data-section">';
-                    html += '<h3>Current Air Quality</h3>';
-                    html += '<div class="metric"><span>PM2.5 AQI (Channel A):</span><span class="value">' + data.pm2_5_aqi + '</span></div>';
-                    html += '<div class="metric"><span>PM2.5 AQI (Channel B):</span><span class="value">' + data.pm2_5_aqi_b + '</span></div>';
-                    html += '<div class="metric"><span>PM1.0 (CF1):</span><span class="value">' + data.pm1_0_cf_1.toFixed(2) + ' ug/m3</span></div>';
-                    html += '<div class="metric"><span>PM2.5 (CF1):</span><span class="value">' + data.pm2_5_cf_1.toFixed(2) + ' ug/m3</span></div>';
-                    html += '<div class="metric"><span>PM10.0 (CF1):</span><span class="value">' + data.pm10_0_cf_1.toFixed(2) + ' ug/m3</span></div>';
-                    html += '</div>';
-                    
-                    html += '<div class="data-section">';
-                    html += '<h3>Environmental Conditions</h3>';
-                    html += '<div class="metric"><span>Temperature:</span><span class="value">' + data.current_temp_f.toFixed(1) + ' F</span></div>';
-                    html += '<div class="metric"><span>Humidity:</span><span class="value">' + data.current_humidity + '%</span></div>';
-                    html += '<div class="metric"><span>Dew Point:</span><span class="value">' + data.current_dewpoint_f.toFixed(1) + ' F</span></div>';
-                    html += '<div class="metric"><span>Pressure:</span><span class="value">' + data.pressure.toFixed(2) + ' hPa</span></div>';
-                    html += '<div class="metric"><span>Gas (BME680):</span><span class="value">' + data.gas_680.toFixed(2) + ' kOhm</span></div>';
-                    html += '</div>';
-                    
-                    html += '<div class="data-section">';
-                    html += '<h3>System Information</h3>';
-                    html += '<div class="metric"><span>Sensor ID:</span><span class="value">' + data.SensorId + '</span></div>';
-                    html += '<div class="metric"><span>Location:</span><span class="value">' + data.Geo + '</span></div>';
-                    html += '<div class="metric"><span>Uptime:</span><span class="value">' + Math.floor(data.uptime / 3600) + 'h ' + Math.floor((data.uptime % 3600) / 60) + 'm</span></div>';
-                    html += '<div class="metric"><span>WiFi Status:</span><span class="value">' + data.wlstate + ' (RSSI: ' + data.rssi + ')</span></div>';
-                    html += '<div class="metric"><span>Memory:</span><span class="value">' + data.Mem + ' bytes</span></div>';
-                    html += '</div>';
-                    
-                    container.innerHTML = html;
-                    
-                    document.getElementById('last-updated').textContent = 
-                        'Last updated: ' + new Date().toLocaleString();
-                })
-                .catch(error => {
-                    console.error('Error fetching data:', error);
-                    document.getElementById('data-container').innerHTML = 
-                        '<div style="color: red; text-align: center; padding: 20px;">Error loading data. Please try again.</div>';
-                });
-        }
-        
-        // Load data immediately and refresh every 30 seconds
-        updateData();
-        setInterval(updateData, 30000);
-    </script>
-</body>
-</html>`
-	
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
+	routes := s.routes()
+	if err := checkRoutes(routes); err != nil {
+		log.Fatalf("Invalid route table: %v", err)
+	}
+	spec, err := buildOpenAPI(routes)
+	if err != nil {
+		log.Fatalf("Failed to build OpenAPI document: %v", err)
+	}
+	s.openapi = spec
+
+	// A route of its own at an unversioned path replaces the deprecated alias there
+	routed := make(map[string]bool)
+	for _, rt := range routes {
+		routed[rt.Method+" "+rt.fullPath()] = true
+	}
+	for _, rt := range routes {
+		s.router.HandleFunc(rt.fullPath(), rt.Handler).Methods(rt.Method)
+		if rt.API && !routed[rt.Method+" "+legacyAPIPrefix+rt.Path] {
+			s.router.HandleFunc(legacyAPIPrefix+rt.Path, deprecatedPath(rt.Handler)).Methods(rt.Method)
+		}
+	}
+	s.router.NotFoundHandler = http.HandlerFunc(notFound)
+	s.router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+
+	// Rate limiting comes first so unauthenticated clients can't make unlimited key lookups
+	s.router.Use(s.rateLimit, s.authenticate)
+}
+
+// deprecatedPath serves a route at its old unversioned path, pointing clients at the
+// versioned one
+func deprecatedPath(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		successor := apiPrefix + strings.TrimPrefix(r.URL.Path, legacyAPIPrefix)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+		next(w, r)
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document generated from the route table
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.openapi)
 }
 
 // handleGetData serves the data as formatted text
 func (s *Server) handleGetData(w http.ResponseWriter, r *http.Request) {
-	data, err := fetchAirQualityData(s.deviceURL)
+	data, err := s.device.Fetch(r.Context())
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching data: %v", err), http.StatusInternalServerError)
+		s.deviceError(w, r, s.device, err)
 		return
 	}
 
@@ -153,357 +224,638 @@ func (s *Server) handleGetData(w http.ResponseWriter, r *http.Request) {
 
 // handleGetDataJSON serves the data as JSON
 func (s *Server) handleGetDataJSON(w http.ResponseWriter, r *http.Request) {
-	data, err := fetchAirQualityData(s.deviceURL)
+	data, err := s.device.Fetch(r.Context())
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching data: %v", err), http.StatusInternalServerError)
+		s.deviceError(w, r, s.device, err)
 		return
 	}
 
 	// Store the measurement in the database
 	if s.database != nil {
-		if err := s.database.StoreMeasurement(data); err != nil {
-			log.Printf("Warning: Failed to store measurement: %v", err)
+		if err := s.storage(r).StoreMeasurement(data); err != nil {
+			slog.WarnContext(r.Context(), "Failed to store measurement", "error", err)
 		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	json.NewEncoder(w).Encode(data)
 }
 
-// handleHealth serves a health check endpoint
-func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":    "healthy",
-		"timestamp": time.Now().UTC(),
-		"service":   "air-quality-monitor",
-	})
+// deviceError reports a failure to read a device. While the circuit is open the
+// client is told when to try again.
+func (s *Server) deviceError(w http.ResponseWriter, r *http.Request, device *Device, err error) {
+	if errors.Is(err, errCircuitOpen) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(device.RetryAfter().Seconds()))))
+		writeError(w, r, http.StatusServiceUnavailable, errDeviceUnavailable, "The sensor is not responding; try again later")
+		return
+	}
+	writeError(w, r, http.StatusBadGateway, errDeviceUnavailable, fmt.Sprintf("Error fetching data: %v", err))
 }
 
-// handleGraphs serves the graphs page
-func (s *Server) handleGraphs(w http.ResponseWriter, r *http.Request) {
-	html := `<!DOCTYPE html>
-<html>
-<head>
-    <title>Air Quality Graphs</title>
-    <meta charset="utf-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1">
-    <script src="https://cdn.jsdelivr.net/npm/chart.js"></script>
-    <style>
-        body { font-family: Arial, sans-serif; margin: 20px; background-color: #f5f5f5; }
-        .container { max-width: 1200px; margin: 0 auto; background: white; padding: 20px; border-radius: 8px; box-shadow: 0 2px 4px rgba(0,0,0,0.1); }
-        .header { text-align: center; color: #333; border-bottom: 2px solid #007bff; padding-bottom: 10px; margin-bottom: 20px; }
-        .chart-container { margin: 20px 0; padding: 15px; border: 1px solid #ddd; border-radius: 5px; }
-        .chart-container h3 { color: #007bff; margin-top: 0; }
-        .controls { margin: 20px 0; text-align: center; }
-        .controls select, .controls button { margin: 0 10px; padding: 8px 16px; border: 1px solid #ddd; border-radius: 4px; }
-        .stats { display: grid; grid-template-columns: repeat(auto-fit, minmax(200px, 1fr)); gap: 15px; margin: 20px 0; }
-        .stat-card { background: #f8f9fa; padding: 15px; border-radius: 5px; text-align: center; }
-        .stat-value { font-size: 24px; font-weight: bold; color: #007bff; }
-        .stat-label { color: #666; font-size: 14px; }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <div class="header">
-            <h1>Air Quality Graphs</h1>
-            <p>Historical air quality data from PurpleAir sensor</p>
-        </div>
-        
-        <div class="controls">
-            <label for="timeRange">Time Range:</label>
-            <select id="timeRange" onchange="loadData()">
-                <option value="1">Last Hour</option>
-                <option value="6">Last 6 Hours</option>
-                <option value="24" selected>Last 24 Hours</option>
-                <option value="168">Last Week</option>
-            </select>
-            <button onclick="loadData()">Refresh</button>
-        </div>
-        
-        <div id="stats" class="stats">
-            <div class="stat-card">
-                <div class="stat-value" id="avgPM25">-</div>
-                <div class="stat-label">Avg PM2.5 AQI</div>
-            </div>
-            <div class="stat-card">
-                <div class="stat-value" id="avgTemp">-</div>
-                <div class="stat-label">Avg Temperature (°F)</div>
-            </div>
-            <div class="stat-card">
-                <div class="stat-value" id="avgHumidity">-</div>
-                <div class="stat-label">Avg Humidity (%)</div>
-            </div>
-            <div class="stat-card">
-                <div class="stat-value" id="dataPoints">-</div>
-                <div class="stat-label">Data Points</div>
-            </div>
-        </div>
-        
-        <div class="chart-container">
-            <h3>PM2.5 Air Quality Index</h3>
-            <canvas id="pm25Chart" width="400" height="200"></canvas>
-        </div>
-        
-        <div class="chart-container">
-            <h3>Temperature and Humidity</h3>
-            <canvas id="tempHumidityChart" width="400" height="200"></canvas>
-        </div>
-        
-        <div class="chart-container">
-            <h3>PM2.5 Concentration (μg/m³)</h3>
-            <canvas id="pm25ConcentrationChart" width="400" height="200"></canvas>
-        </div>
-        
-        <div class="chart-container">
-            <h3>System Metrics</h3>
-            <canvas id="systemChart" width="400" height="200"></canvas>
-        </div>
-    </div>
-
-    <script>
-        let pm25Chart, tempHumidityChart, pm25ConcentrationChart, systemChart;
-        
-        function initCharts() {
-            const ctx1 = document.getElementById('pm25Chart').getContext('2d');
-            const ctx2 = document.getElementById('tempHumidityChart').getContext('2d');
-            const ctx3 = document.getElementById('pm25ConcentrationChart').getContext('2d');
-            const ctx4 = document.getElementById('systemChart').getContext('2d');
-            
-            pm25Chart = new Chart(ctx1, {
-                type: 'line',
-                data: { labels: [], datasets: [] },
-                options: {
-                    responsive: true,
-                    scales: { y: { beginAtZero: true } }
-                }
-            });
-            
-            tempHumidityChart = new Chart(ctx2, {
-                type: 'line',
-                data: { labels: [], datasets: [] },
-                options: {
-                    responsive: true,
-                    scales: { y: { beginAtZero: true } }
-                }
-            });
-            
-            pm25ConcentrationChart = new Chart(ctx3, {
-                type: 'line',
-                data: { labels: [], datasets: [] },
-                options: {
-                    responsive: true,
-                    scales: { y: { beginAtZero: true } }
-                }
-            });
-            
-            systemChart = new Chart(ctx4, {
-                type: 'line',
-                data: { labels: [], datasets: [] },
-                options: {
-                    responsive: true,
-                    scales: { y: { beginAtZero: true } }
-                }
-            });
-        }
-        
-        function loadData() {
-            const hours = document.getElementById('timeRange').value;
-            
-            // Load measurements
-            fetch('/api/measurements?hours=' + hours)
-                .then(response => response.json())
-                .then(data => {
-                    updateCharts(data);
-                })
-                .catch(error => {
-                    console.error('Error loading measurements:', error);
-                });
-            
-            // Load stats
-            fetch('/api/stats?hours=' + hours)
-                .then(response => response.json())
-                .then(data => {
-                    updateStats(data);
-                })
-                .catch(error => {
-                    console.error('Error loading stats:', error);
-                });
-        }
-        
-        function updateCharts(measurements) {
-            const labels = measurements.map(m => new Date(m.timestamp).toLocaleTimeString());
-            const pm25Data = measurements.map(m => m.pm25_aqi);
-            const pm25BData = measurements.map(m => m.pm25_aqi_b);
-            const tempData = measurements.map(m => m.temperature);
-            const humidityData = measurements.map(m => m.humidity);
-            const pm25ConcentrationData = measurements.map(m => m.pm25_cf1);
-            const pm25BConcentrationData = measurements.map(m => m.pm25_cf1_b);
-            const memoryData = measurements.map(m => m.memory);
-            const rssiData = measurements.map(m => m.rssi);
-            
-            // Update PM2.5 AQI chart
-            pm25Chart.data.labels = labels;
-            pm25Chart.data.datasets = [
-                { label: 'PM2.5 AQI (Channel A)', data: pm25Data, borderColor: 'rgb(75, 192, 192)', backgroundColor: 'rgba(75, 192, 192, 0.2)' },
-                { label: 'PM2.5 AQI (Channel B)', data: pm25BData, borderColor: 'rgb(255, 99, 132)', backgroundColor: 'rgba(255, 99, 132, 0.2)' }
-            ];
-            pm25Chart.update();
-            
-            // Update Temperature and Humidity chart
-            tempHumidityChart.data.labels = labels;
-            tempHumidityChart.data.datasets = [
-                { label: 'Temperature (°F)', data: tempData, borderColor: 'rgb(255, 159, 64)', backgroundColor: 'rgba(255, 159, 64, 0.2)', yAxisID: 'y' },
-                { label: 'Humidity (%)', data: humidityData, borderColor: 'rgb(153, 102, 255)', backgroundColor: 'rgba(153, 102, 255, 0.2)', yAxisID: 'y1' }
-            ];
-            tempHumidityChart.options.scales.y = { type: 'linear', display: true, position: 'left' };
-            tempHumidityChart.options.scales.y1 = { type: 'linear', display: true, position: 'right', grid: { drawOnChartArea: false } };
-            tempHumidityChart.update();
-            
-            // Update PM2.5 Concentration chart
-            pm25ConcentrationChart.data.labels = labels;
-            pm25ConcentrationChart.data.datasets = [
-                { label: 'PM2.5 CF1 (Channel A)', data: pm25ConcentrationData, borderColor: 'rgb(54, 162, 235)', backgroundColor: 'rgba(54, 162, 235, 0.2)' },
-                { label: 'PM2.5 CF1 (Channel B)', data: pm25BConcentrationData, borderColor: 'rgb(255, 205, 86)', backgroundColor: 'rgba(255, 205, 86, 0.2)' }
-            ];
-            pm25ConcentrationChart.update();
-            
-            // Update System chart
-            systemChart.data.labels = labels;
-            systemChart.data.datasets = [
-                { label: 'Memory (bytes)', data: memoryData, borderColor: 'rgb(201, 203, 207)', backgroundColor: 'rgba(201, 203, 207, 0.2)' },
-                { label: 'RSSI (dBm)', data: rssiData, borderColor: 'rgb(255, 99, 132)', backgroundColor: 'rgba(255, 99, 132, 0.2)' }
-            ];
-            systemChart.update();
-        }
-        
-        function updateStats(stats) {
-            document.getElementById('avgPM25').textContent = stats.avg_pm25_aqi ? stats.avg_pm25_aqi.toFixed(1) : '-';
-            document.getElementById('avgTemp').textContent = stats.avg_temp ? stats.avg_temp.toFixed(1) : '-';
-            document.getElementById('avgHumidity').textContent = stats.avg_humidity ? stats.avg_humidity.toFixed(1) : '-';
-            document.getElementById('dataPoints').textContent = stats.count || '-';
-        }
-        
-        // Initialize charts and load data
-        initCharts();
-        loadData();
-        
-        // Auto-refresh every 5 minutes
-        setInterval(loadData, 300000);
-    </script>
-</body>
-</html>`
-	
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
+// devices returns the devices the server reads from: the live data device and each
+// sensor collected from
+func (s *Server) devices() []*Device {
+	devices := []*Device{s.device}
+	for _, c := range s.collectorList() {
+		if c.Device != s.device {
+			devices = append(devices, c.Device)
+		}
+	}
+	return devices
 }
 
-// handleGetMeasurements serves measurement data for graphing
+// handleGetMeasurements serves one page of measurement data for graphing. The response
+// is streamed so memory use does not grow with the page size.
 func (s *Server) handleGetMeasurements(w http.ResponseWriter, r *http.Request) {
 	if s.database == nil {
-		http.Error(w, "Database not available", http.StatusInternalServerError)
+		databaseUnavailable(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	q, err := parseMeasurementQuery(query, 24)
+	if err != nil {
+		badParameter(w, r, err)
+		return
+	}
+	limit, cursor, err := parsePageParams(query)
+	if err != nil {
+		badParameter(w, r, err)
 		return
 	}
 
-	hours := 24 // default to 24 hours
-	if h := r.URL.Query().Get("hours"); h != "" {
-		if parsed, err := fmt.Sscanf(h, "%d", &hours); err != nil || parsed != 1 {
-			hours = 24
+	// Fetch one extra row to learn whether another page follows
+	q.After = cursor
+	q.Limit = limit + 1
+
+	w.Header().Set("Content-Type", "application/json")
+
+	bw := bufio.NewWriter(w)
+	var last MeasurementCursor
+	count, more := 0, false
+
+	// row writes one measurement of the page, remembering its cursor
+	row := func(cursor MeasurementCursor, encode func() error) error {
+		if count == limit {
+			more = true
+			return nil
+		}
+		if count > 0 {
+			bw.WriteByte(',')
 		}
+		count++
+		last = cursor
+		return encode()
 	}
 
-	measurements, err := s.database.GetRecentMeasurements(hours)
+	bw.WriteString(`{"measurements":[`)
+	if query.Get("fields") == "" {
+		enc := json.NewEncoder(bw)
+		err = s.storage(r).EachMeasurement(q, func(m Measurement) error {
+			return row(MeasurementCursor{ObservedAt: m.Timestamp, ID: m.ID}, func() error {
+				return enc.Encode(m)
+			})
+		})
+	} else {
+		err = eachMeasurementFields(s.storage(r), q, bw, row)
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching measurements: %v", err), http.StatusInternalServerError)
+		// Headers are already sent, so the best we can do is end the body early
+		slog.ErrorContext(r.Context(), "Error streaming measurements", "error", err)
+		bw.Flush()
 		return
 	}
+	bw.WriteString("]")
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	json.NewEncoder(w).Encode(measurements)
+	if more {
+		next := last.Encode()
+		nextLink, _ := json.Marshal(nextPageURL(r, q.Range, next))
+		nextCursor, _ := json.Marshal(next)
+		fmt.Fprintf(bw, `,"next_cursor":%s,"next":%s`, nextCursor, nextLink)
+	}
+	bw.WriteString("}\n")
+	bw.Flush()
 }
 
-// handleGetStats serves measurement statistics
+// eachMeasurementFields streams the query's fields for each measurement as a JSON object,
+// selecting the cursor columns after them so pages can continue where one ends
+func eachMeasurementFields(database Storage, q MeasurementQuery, w io.Writer, row func(MeasurementCursor, func() error) error) error {
+	fields := q.Fields
+	q.Fields = append(fields[:len(fields):len(fields)], "observed_at", "id")
+
+	out := &ndjsonExportWriter{w: w}
+	out.WriteHeader(fields)
+	return database.QueryMeasurements(q, func(values []interface{}) error {
+		observedAt, err := scannedTime(values[len(fields)])
+		if err != nil {
+			return err
+		}
+		id, _ := numericValue(values[len(fields)+1])
+		return row(MeasurementCursor{ObservedAt: observedAt, ID: int64(id)}, func() error {
+			return out.WriteRow(values[:len(fields)])
+		})
+	})
+}
+
+// nextPageURL returns the request URL with the cursor for the next page. The time range
+// is pinned to absolute bounds so a relative "hours" range doesn't slide between pages.
+func nextPageURL(r *http.Request, timeRange TimeRange, cursor string) string {
+	query := r.URL.Query()
+	query.Del("hours")
+	query.Del("tz")
+	query.Set("start", timeRange.Start.Format(time.RFC3339Nano))
+	query.Set("end", timeRange.End.Format(time.RFC3339Nano))
+	query.Set("cursor", cursor)
+	return r.URL.Path + "?" + query.Encode()
+}
+
+// handleGetStats serves measurement statistics, optionally grouped by hour of day or
+// day of week
 func (s *Server) handleGetStats(w http.ResponseWriter, r *http.Request) {
 	if s.database == nil {
-		http.Error(w, "Database not available", http.StatusInternalServerError)
+		databaseUnavailable(w, r)
 		return
 	}
 
-	hours := 24 // default to 24 hours
-	if h := r.URL.Query().Get("hours"); h != "" {
-		if parsed, err := fmt.Sscanf(h, "%d", &hours); parsed != 1 || err != nil {
-			hours = 24
-		}
+	q, err := parseMeasurementQuery(r.URL.Query(), 24)
+	if err != nil {
+		badParameter(w, r, err)
+		return
 	}
 
-	stats, err := s.database.GetMeasurementStats(hours)
+	groupBy, err := parseStatsGroupBy(r.URL.Query().Get("group_by"))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching stats: %v", err), http.StatusInternalServerError)
+		badParameter(w, r, err)
+		return
+	}
+	loc, err := parseLocation(r.URL.Query())
+	if err != nil {
+		badParameter(w, r, err)
+		return
+	}
+
+	stats, err := computeStats(s.storage(r), q, groupBy, loc)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errInternal, fmt.Sprintf("Error fetching stats: %v", err))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	json.NewEncoder(w).Encode(stats)
 }
 
-// startDataCollection starts the background data collection service
-func (s *Server) startDataCollection() {
-	log.Printf("Starting background data collection service...")
-	
-	// Collect data immediately
-	s.collectAndStoreData()
-	
-	// Set up ticker for periodic collection (every 5 minutes)
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
-	
-	for {
-		select {
-		case <-ticker.C:
-			s.collectAndStoreData()
-		case <-s.stopChan:
-			log.Printf("Stopping background data collection service...")
-			return
-		}
+// summaryLocation returns the time zone daily summaries are computed in
+func (s *Server) summaryLocation() *time.Location {
+	if s.summaries == nil {
+		return time.UTC
 	}
+	return s.summaries.loc
 }
 
-// collectAndStoreData fetches data from the sensor and stores it in the database
-func (s *Server) collectAndStoreData() {
+// handleGetDaily serves the stored daily summaries for a range of dates. Dates are
+// interpreted in the summary time zone unless tz is given.
+func (s *Server) handleGetDaily(w http.ResponseWriter, r *http.Request) {
 	if s.database == nil {
-		log.Printf("Warning: Database not available, skipping data collection")
+		databaseUnavailable(w, r)
 		return
 	}
-	
-	data, err := fetchAirQualityData(s.deviceURL)
+
+	loc := s.summaryLocation()
+	query := r.URL.Query()
+	if query.Get("tz") == "" {
+		query.Set("tz", loc.String())
+	}
+	from, to, err := parseSummaryDates(query, loc)
 	if err != nil {
-		log.Printf("Error collecting data: %v", err)
+		badParameter(w, r, err)
 		return
 	}
-	
-	if err := s.database.StoreMeasurement(data); err != nil {
-		log.Printf("Error storing measurement: %v", err)
+
+	summaries, err := s.storage(r).GetDailySummaries(query.Get("sensor"), from, to)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errInternal, fmt.Sprintf("Error fetching daily summaries: %v", err))
 		return
 	}
-	
-	log.Printf("Data collected and stored: PM2.5 AQI=%d, Temp=%.1f°F, Humidity=%d%%", 
-		data.Pm25Aqi, data.CurrentTempF, data.CurrentHumidity)
+	if summaries == nil {
+		summaries = []DailySummary{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"timezone":  loc.String(),
+		"from":      from,
+		"to":        to,
+		"summaries": summaries,
+	})
+}
+
+// handleGetExposure serves an exposure and exceedance report, covering the last week
+// unless a range is given
+func (s *Server) handleGetExposure(w http.ResponseWriter, r *http.Request) {
+	if s.database == nil {
+		databaseUnavailable(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	q, err := parseMeasurementQuery(query, 7*24)
+	if err != nil {
+		badParameter(w, r, err)
+		return
+	}
+	thresholds, err := parseExposureThresholds(query)
+	if err != nil {
+		badParameter(w, r, err)
+		return
+	}
+	loc, err := parseLocation(query)
+	if err != nil {
+		badParameter(w, r, err)
+		return
+	}
+
+	report, err := computeExposure(s.storage(r), q, thresholds, loc)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errInternal, fmt.Sprintf("Error computing exposure: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleChart renders a time-series chart as a PNG or SVG image that can be embedded in
+// chat messages, emails and wiki pages
+func (s *Server) handleChart(w http.ResponseWriter, r *http.Request) {
+	if s.database == nil {
+		databaseUnavailable(w, r)
+		return
+	}
+
+	req, err := parseChartRequest(r.URL.Query())
+	if err != nil {
+		badParameter(w, r, err)
+		return
+	}
+	chart, err := req.build(s.storage(r))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errInternal, fmt.Sprintf("Error building chart: %v", err))
+		return
+	}
+
+	// Render before writing so a failure can still be reported
+	var buf bytes.Buffer
+	contentType := "image/png"
+	if mux.Vars(r)["format"] == "svg" {
+		contentType = "image/svg+xml"
+		err = chart.RenderSVG(&buf)
+	} else {
+		err = chart.RenderPNG(&buf)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errInternal, fmt.Sprintf("Error rendering chart: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	buf.WriteTo(w)
+}
+
+// handleExport streams measurements for a time range as CSV or NDJSON
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if s.database == nil {
+		databaseUnavailable(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	q, err := parseMeasurementQuery(query, 24)
+	if err != nil {
+		badParameter(w, r, err)
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		writeError(w, r, http.StatusBadRequest, errInvalidParameter, fmt.Sprintf("unsupported export format: %s", format))
+		return
+	}
+
+	contentType, _ := exportContentType(format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(q.Range, format)))
+
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	// Headers are already sent once rows start streaming, so errors can only be logged
+	if _, err := exportMeasurements(s.storage(r), w, q, format, flush); err != nil {
+		slog.ErrorContext(r.Context(), "Error exporting measurements", "error", err)
+	}
+}
+
+// handleImport accepts PurpleAir SD card CSV logs, either as multipart "file" uploads
+// or as a raw CSV request body, and reports how many rows were inserted or skipped
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if s.database == nil {
+		databaseUnavailable(w, r)
+		return
+	}
+
+	sensorID := r.URL.Query().Get("sensor")
+	var result ImportResult
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			writeError(w, r, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("Invalid upload: %v", err))
+			return
+		}
+		files := r.MultipartForm.File["file"]
+		if len(files) == 0 {
+			writeError(w, r, http.StatusBadRequest, errInvalidRequest, "No files uploaded in the \"file\" field")
+			return
+		}
+		for _, header := range files {
+			f, err := header.Open()
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("Error reading upload: %v", err))
+				return
+			}
+			err = importSDCardCSV(s.storage(r), f, header.Filename, sensorID, &result)
+			f.Close()
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("Error importing data: %v", err))
+				return
+			}
+		}
+	} else {
+		if err := importSDCardCSV(s.storage(r), r.Body, "upload", sensorID, &result); err != nil {
+			writeError(w, r, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("Error importing data: %v", err))
+			return
+		}
+	}
+
+	slog.InfoContext(r.Context(), "Imported SD card data", "rows", result.Rows, "files", result.Files,
+		"inserted", result.Inserted, "skipped", result.Skipped, "invalid", result.Invalid)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// startDataCollection runs every collector until the server stops
+func (s *Server) startDataCollection() {
+	for _, c := range s.collectorList() {
+		s.startCollector(c)
+	}
+}
+
+// startCollector runs a collector until the server stops or the collector is replaced
+func (s *Server) startCollector(c *Collector) {
+	stop, cancel := s.stopScope()
+	c.cancel = cancel
+	s.background(func() { c.Run(s.database, stop) })
+}
+
+// newCollector creates the collector for a configured sensor
+func (s *Server) newCollector(sensor SensorConfig, jitter time.Duration) *Collector {
+	// Share the live data device's circuit breaker when it is also collected
+	device := s.device
+	switch {
+	case sensor.SensorID != "":
+		device = NewSensorDevice(sensor.URL, sensor.SensorID)
+	case sensor.URL != s.device.URL():
+		device = NewDevice(sensor.URL)
+	}
+	return NewCollector(sensor.Name, device, sensor.interval, jitter)
+}
+
+// EnableCollection sets the sensors collected from and how often. Without it the
+// server collects from its device every five minutes.
+func (s *Server) EnableCollection(cfg CollectionConfig) {
+	var collectors []*Collector
+	for _, sensor := range cfg.sensorsOrDefault(s.device.URL()) {
+		collectors = append(collectors, s.newCollector(sensor, cfg.jitter))
+	}
+	s.collectorsMu.Lock()
+	s.collectors = collectors
+	s.discovery = cfg.Discovery
+	s.collectorsMu.Unlock()
+}
+
+// EnableBackups schedules periodic backups of a SQLite database while the server runs
+func (s *Server) EnableBackups(cfg *BackupConfig) {
+	s.backups = cfg
+}
+
+// EnableSummaries keeps daily summaries up to date while the server runs
+func (s *Server) EnableSummaries(tracker *SummaryTracker) {
+	s.summaries = tracker
+}
+
+// EnableReports schedules email reports while the server runs
+func (s *Server) EnableReports(smtpCfg SMTPConfig, reports []ReportConfig) {
+	s.smtp = smtpCfg
+	s.reports = reports
+}
+
+// EnableAuth sets the API key and cross-origin access rules
+func (s *Server) EnableAuth(cfg AuthConfig) {
+	s.auth = cfg
+	if cfg.Enabled {
+		slog.Info("API key authentication enabled", "public_read", cfg.PublicRead)
+	}
+}
+
+// EnableRateLimit throttles clients that make too many requests
+func (s *Server) EnableRateLimit(cfg RateLimitConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	s.limiter = NewRateLimiter(cfg)
+	slog.Info("Rate limiting enabled",
+		"device_per_minute", cfg.Device.PerMinute, "device_burst", cfg.Device.Burst,
+		"database_per_minute", cfg.Database.PerMinute, "database_burst", cfg.Database.Burst)
+}
+
+// EnableTLS serves HTTPS with certificates from the configured source, and optionally
+// redirects plain HTTP to it
+func (s *Server) EnableTLS(cfg TLSConfig) error {
+	if cfg.Mode == tlsModeOff {
+		return nil
+	}
+	t, err := newServerTLS(cfg)
+	if err != nil {
+		return err
+	}
+	s.tls = t
+	s.redirectAddr = cfg.RedirectAddr
+	slog.Info("Serving HTTPS", "tls_mode", cfg.Mode)
+	return nil
+}
+
+// startReports schedules the email reports until the server stops or they are replaced
+func (s *Server) startReports() {
+	stop, cancel := s.stopScope()
+	s.stopReports = cancel
+	for _, report := range s.reports {
+		slog.Info("Scheduling report", "report", report.Name, "period", report.Period, "schedule", report.Schedule, "to", strings.Join(report.To, ", "))
+		report := report
+		s.background(func() { runReportSchedule(s.database, s.smtp, report, stop) })
+	}
+}
+
+// background runs fn in a goroutine that Shutdown waits for before closing storage
+func (s *Server) background(fn func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn()
+	}()
+}
+
+// stopScope returns a channel that is closed when the server stops or cancel is called,
+// for background work that can be stopped on its own
+func (s *Server) stopScope() (<-chan struct{}, func()) {
+	stop := make(chan struct{})
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() { close(stop) })
+	}
+	go func() {
+		select {
+		case <-s.stopChan:
+			cancel()
+		case <-stop:
+		}
+	}()
+	return stop, cancel
+}
+
+// startBackups periodically backs up the database until the server stops
+func (s *Server) startBackups() {
+	database, ok := sqliteDatabase(s.database)
+	if !ok {
+		slog.Warn("Scheduled backups are only supported for SQLite databases")
+		return
+	}
+
+	slog.Info("Scheduling database backups", "dir", s.backups.Dir, "interval", s.backups.Interval.String(), "keep", s.backups.Keep)
+	ticker := time.NewTicker(s.backups.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			path, err := createBackup(database, s.backups.Dir, s.backups.Keep)
+			if err != nil {
+				slog.Error("Error backing up database", "error", err)
+				continue
+			}
+			slog.Info("Database backed up", "path", path)
+		case <-s.stopChan:
+			return
+		}
+	}
 }
 
 // Stop stops the server and background services
 func (s *Server) Stop() {
-	close(s.stopChan)
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+	})
 }
 
-// Start starts the HTTP server
+// Shutdown stops accepting requests, waits for in-flight ones to finish, stops the
+// background services and waits for them, then closes the database, flushing any queued
+// writes
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	if s.http != nil {
+		err = s.http.Shutdown(ctx)
+	}
+	if s.redirect != nil {
+		s.redirect.Shutdown(ctx)
+	}
+	s.Stop()
+
+	// A collection or report in progress still needs the database
+	stopped := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		slog.Warn("Background tasks did not stop in time, closing the database anyway")
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	if s.database != nil {
+		if closeErr := s.database.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Start starts the HTTP server. It returns nil once Shutdown has been called.
 func (s *Server) Start(addr string) error {
-	log.Printf("Starting server on %s", addr)
-	
-	// Start background data collection in a goroutine
-	go s.startDataCollection()
+	slog.Info("Starting server", "addr", addr)
 	
-	return http.ListenAndServe(addr, s.router)
+	// Start background data collection
+	s.startDataCollection()
+	s.background(s.runDiscovery)
+
+	if s.backups != nil {
+		s.background(s.startBackups)
+	}
+	if s.summaries != nil {
+		s.background(func() { s.summaries.Run(defaultSummaryInterval, s.stopChan) })
+	}
+	s.startReports()
+	if s.configPath != "" {
+		s.background(s.watchConfig)
+	}
+	if s.configPath != "" || (s.tls != nil && s.tls.reloader != nil) {
+		s.background(s.reloadOnHangup)
+	}
+
+	s.http = &http.Server{Addr: addr, Handler: logRequests(corsMiddleware(s.auth.CORSOrigins, s.router))}
+	if s.tls == nil {
+		if err := s.http.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	}
+
+	if s.redirectAddr != "" {
+		handler := redirectHandler(addr)
+		if s.tls.acme != nil {
+			// Answer ACME HTTP-01 challenges and redirect everything else
+			handler = s.tls.acme.HTTPHandler(handler)
+		}
+		s.redirect = &http.Server{Addr: s.redirectAddr, Handler: handler}
+		go func() {
+			slog.Info("Redirecting HTTP to HTTPS", "addr", s.redirect.Addr)
+			if err := s.redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("HTTP redirect server error", "error", err)
+			}
+		}()
+	}
+
+	s.http.TLSConfig = s.tls.config
+	if err := s.http.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closeCheckingStorage records writes made after it was closed
+type closeCheckingStorage struct {
+	*MemoryDatabase
+	mu          sync.Mutex
+	closed      bool
+	lateWrites  int
+	storedCount int
+}
+
+func (c *closeCheckingStorage) StoreMeasurement(data *AirQualityData) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		c.lateWrites++
+	}
+	c.storedCount++
+	return c.MemoryDatabase.StoreMeasurement(data)
+}
+
+func (c *closeCheckingStorage) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func TestShutdownWaitsForCollection(t *testing.T) {
+	fetching := make(chan struct{}, 1)
+	sensor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case fetching <- struct{}{}:
+		default:
+		}
+		// Shutdown starts while the reading is on its way
+		time.Sleep(300 * time.Millisecond)
+		sensorHandler("aa:aa:aa:aa:aa:aa", "Kitchen").ServeHTTP(w, r)
+	}))
+	defer sensor.Close()
+
+	storage := &closeCheckingStorage{MemoryDatabase: NewMemoryDatabase(10)}
+	s := NewServer(sensor.URL+"/json", storage)
+	s.startDataCollection()
+	<-fetching
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.storedCount != 1 || storage.lateWrites != 0 {
+		t.Errorf("stored %d measurements, %d after the database was closed; want 1 before", storage.storedCount, storage.lateWrites)
+	}
+}
+
+func TestMeasurementsSelectsFields(t *testing.T) {
+	database, err := NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	backends := map[string]Storage{"sqlite": database, "memory": NewMemoryDatabase(10)}
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+			for i := 0; i < 3; i++ {
+				if err := storage.StoreMeasurement(testMeasurement("aa:aa:aa:aa:aa:aa", base.Add(time.Duration(i)*time.Minute), 10, float64(i+1))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := NewServer("http://127.0.0.1:1/json", storage)
+
+			var pm25 []interface{}
+			url := apiPrefix + "/measurements?fields=pm25_cf1&limit=2&start=2024-03-01T00:00:00Z&end=2024-03-02T00:00:00Z"
+			for pages := 0; url != ""; pages++ {
+				if pages == 3 {
+					t.Fatal("paging did not end")
+				}
+				rec := httptest.NewRecorder()
+				s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+				var page struct {
+					Measurements []map[string]interface{} `json:"measurements"`
+					Next         string                   `json:"next"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+					t.Fatalf("GET %s = %d %s: %v", url, rec.Code, rec.Body, err)
+				}
+				for _, m := range page.Measurements {
+					if len(m) != 1 {
+						t.Fatalf("measurement %v has fields other than pm25_cf1", m)
+					}
+					pm25 = append(pm25, m["pm25_cf1"])
+				}
+				url = page.Next
+			}
+			if want := []interface{}{1.0, 2.0, 3.0}; !reflect.DeepEqual(pm25, want) {
+				t.Errorf("pm25_cf1 = %v, want %v", pm25, want)
+			}
+		})
+	}
+}
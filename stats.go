@@ -0,0 +1,519 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// numericMeasurementFields lists the measurement columns that hold numbers, in output order
+var numericMeasurementFields = []string{
+	"lat", "lon", "uptime", "rssi",
+	"current_temp_f", "current_humidity", "current_dewpoint_f", "pressure", "gas_680",
+	"pm25_aqi", "pm10_cf1", "pm25_cf1", "pm100_cf1", "pm10_atm", "pm25_atm", "pm100_atm",
+	"pm25_aqi_b", "pm10_cf1_b", "pm25_cf1_b", "pm100_cf1_b", "pm10_atm_b", "pm25_atm_b", "pm100_atm_b",
+	"mem", "memfrag", "memfb", "memcs", "adc", "httpsuccess", "httpsends", "pa_latency",
+	"status_0", "status_1", "status_2", "status_3", "status_4",
+}
+
+// Stats groupings accepted by the group_by parameter
+const (
+	groupByHourOfDay = "hour_of_day"
+	groupByDayOfWeek = "day_of_week"
+)
+
+// FieldStats summarizes the values of one measurement field. StdDev is the population
+// standard deviation; percentiles interpolate between the nearest ranks, and are
+// estimated when there are more than maxExactSamples values.
+type FieldStats struct {
+	Count     int     `json:"count"`
+	Mean      float64 `json:"mean"`
+	Min       float64 `json:"min"`
+	Max       float64 `json:"max"`
+	StdDev    float64 `json:"stddev"`
+	P50       float64 `json:"p50"`
+	P95       float64 `json:"p95"`
+	P99       float64 `json:"p99"`
+	Estimated bool    `json:"percentiles_estimated,omitempty"`
+}
+
+// StatsGroup holds the field statistics for one hour of the day or day of the week
+type StatsGroup struct {
+	Key    int                   `json:"key"`
+	Label  string                `json:"label"`
+	Count  int                   `json:"count"`
+	Fields map[string]FieldStats `json:"fields"`
+}
+
+// StatsReport is the /api/stats response: the summary fields used by the graphs page,
+// statistics for every numeric field, and optional groups
+type StatsReport struct {
+	*MeasurementStats
+	Fields  map[string]FieldStats `json:"fields"`
+	GroupBy string                `json:"group_by,omitempty"`
+	Groups  []StatsGroup          `json:"groups,omitempty"`
+}
+
+// statsBucket is the length of the buckets the database aggregates grouped stats in.
+// Every time zone's offset is a multiple of it, so each bucket falls within one local hour.
+const statsBucket = 15 * time.Minute
+
+// maxExactSamples is how many values of a field are kept for exact percentiles. Beyond
+// that percentiles are estimated, so a stats request uses the same memory for any range.
+const maxExactSamples = 1024
+
+// statsPercentiles are the percentiles reported for each field
+var statsPercentiles = []float64{50, 95, 99}
+
+// FieldAggregate holds the count and range of one field's values, and the sum and sum
+// of squares of the values less an offset
+type FieldAggregate struct {
+	Count      int
+	Sum        float64
+	SumSquares float64
+	Min        float64
+	Max        float64
+}
+
+// add includes a value in the aggregate
+func (a *FieldAggregate) add(v, offset float64) {
+	d := v - offset
+	a.merge(FieldAggregate{Count: 1, Sum: d, SumSquares: d * d, Min: v, Max: v})
+}
+
+// merge includes another aggregate's values, which must use the same offset
+func (a *FieldAggregate) merge(b FieldAggregate) {
+	if b.Count == 0 {
+		return
+	}
+	if a.Count == 0 || b.Min < a.Min {
+		a.Min = b.Min
+	}
+	if a.Count == 0 || b.Max > a.Max {
+		a.Max = b.Max
+	}
+	a.Count += b.Count
+	a.Sum += b.Sum
+	a.SumSquares += b.SumSquares
+}
+
+// stats returns the count, mean, range and population standard deviation, given the
+// offset the sums are relative to
+func (a FieldAggregate) stats(offset float64) FieldStats {
+	if a.Count == 0 {
+		return FieldStats{}
+	}
+	n := float64(a.Count)
+	shifted := a.Sum / n
+	return FieldStats{
+		Count:  a.Count,
+		Mean:   offset + shifted,
+		Min:    a.Min,
+		Max:    a.Max,
+		StdDev: math.Sqrt(math.Max(0, a.SumSquares/n-shifted*shifted)),
+	}
+}
+
+// aggregateSQL builds a query for the row count and each field's non-NULL count, sum and
+// sum of squares less its offset, minimum and maximum, grouped by bucketExpr when it is set
+func aggregateSQL(fields []string, offsets []float64, bucketExpr, where string) string {
+	columns := []string{"COUNT(*)"}
+	if bucketExpr != "" {
+		columns = append([]string{bucketExpr + " AS bucket"}, columns...)
+	}
+	for i, field := range fields {
+		// Integer sums of squares could overflow
+		v := "CAST(" + field + " AS DOUBLE PRECISION)"
+		d := "(" + v + " - CAST(" + strconv.FormatFloat(offsets[i], 'g', -1, 64) + " AS DOUBLE PRECISION))"
+		columns = append(columns, "COUNT("+field+")", "SUM("+d+")", "SUM("+d+" * "+d+")", "MIN("+v+")", "MAX("+v+")")
+	}
+
+	query := "SELECT " + strings.Join(columns, ", ") + " FROM measurements " + where
+	if bucketExpr != "" {
+		query += " GROUP BY bucket ORDER BY bucket"
+	}
+	return query
+}
+
+// scanAggregates reads the rows of an aggregateSQL query and passes each to fn
+func scanAggregates(rows *sql.Rows, fields int, bucket time.Duration, fn func(start time.Time, count int, aggregates []FieldAggregate) error) error {
+	offset := 0
+	if bucket > 0 {
+		offset = 1
+	}
+	return scanRows(rows, offset+1+5*fields, func(values []interface{}) error {
+		var start time.Time
+		if bucket > 0 {
+			key, _ := numericValue(values[0])
+			start = time.Unix(int64(key)*int64(bucket/time.Second), 0).UTC()
+		}
+		count, _ := numericValue(values[offset])
+
+		aggregates := make([]FieldAggregate, fields)
+		for i := range aggregates {
+			v := values[offset+1+5*i:]
+			n, _ := numericValue(v[0])
+			aggregates[i].Count = int(n)
+			aggregates[i].Sum, _ = numericValue(v[1])
+			aggregates[i].SumSquares, _ = numericValue(v[2])
+			aggregates[i].Min, _ = numericValue(v[3])
+			aggregates[i].Max, _ = numericValue(v[4])
+		}
+		return fn(start, int(count), aggregates)
+	})
+}
+
+// quantileSketch tracks the statsPercentiles of a stream of values. Up to
+// maxExactSamples values are kept, giving exact percentiles; past that each percentile
+// is estimated with the P² algorithm in constant memory.
+type quantileSketch struct {
+	values    []float64
+	estimates []*p2Estimator
+}
+
+// add includes a value in the sketch
+func (s *quantileSketch) add(v float64) {
+	if s.estimates == nil && len(s.values) < maxExactSamples {
+		s.values = append(s.values, v)
+		return
+	}
+	if s.estimates == nil {
+		sort.Float64s(s.values)
+		for _, p := range statsPercentiles {
+			s.estimates = append(s.estimates, newP2Estimator(p/100, s.values))
+		}
+		s.values = nil
+	}
+	for _, e := range s.estimates {
+		e.add(v)
+	}
+}
+
+// percentiles returns the statsPercentiles of the values added, and whether they are
+// estimates
+func (s *quantileSketch) percentiles() ([]float64, bool) {
+	result := make([]float64, len(statsPercentiles))
+	if s.estimates != nil {
+		for i, e := range s.estimates {
+			result[i] = e.value()
+		}
+		return result, true
+	}
+	if len(s.values) == 0 {
+		return result, false
+	}
+	sort.Float64s(s.values)
+	for i, p := range statsPercentiles {
+		result[i] = percentile(s.values, p)
+	}
+	return result, false
+}
+
+// p2Estimator estimates one quantile of a stream with five markers, following Jain and
+// Chlamtac's P² algorithm. The markers start at the matching ranks of a sorted sample.
+type p2Estimator struct {
+	heights   [5]float64
+	positions [5]float64
+	desired   [5]float64
+	increment [5]float64
+}
+
+// newP2Estimator starts an estimator for quantile p (0-1) from sorted values, of which
+// there must be at least five
+func newP2Estimator(p float64, sorted []float64) *p2Estimator {
+	e := &p2Estimator{increment: [5]float64{0, p / 2, p, (1 + p) / 2, 1}}
+	last := float64(len(sorted) - 1)
+	for i, f := range e.increment {
+		rank := math.Round(f * last)
+		if i > 0 && rank <= e.positions[i-1] {
+			rank = e.positions[i-1] + 1
+		}
+		e.positions[i] = rank
+		e.desired[i] = f * last
+	}
+	for i := 4; i > 0 && e.positions[i] > last; i-- {
+		e.positions[i] = last
+		if e.positions[i-1] >= last {
+			e.positions[i-1] = last - 1
+		}
+	}
+	for i, rank := range e.positions {
+		e.heights[i] = sorted[int(rank)]
+	}
+	return e
+}
+
+// add includes a value in the estimate
+func (e *p2Estimator) add(v float64) {
+	var k int
+	switch {
+	case v < e.heights[0]:
+		e.heights[0] = v
+		k = 0
+	case v >= e.heights[4]:
+		e.heights[4] = v
+		k = 3
+	default:
+		for k = 0; k < 3 && v >= e.heights[k+1]; k++ {
+		}
+	}
+
+	for i := k + 1; i < 5; i++ {
+		e.positions[i]++
+	}
+	for i := range e.desired {
+		e.desired[i] += e.increment[i]
+	}
+
+	for i := 1; i <= 3; i++ {
+		d := e.desired[i] - e.positions[i]
+		if (d >= 1 && e.positions[i+1]-e.positions[i] > 1) || (d <= -1 && e.positions[i-1]-e.positions[i] < -1) {
+			step := math.Copysign(1, d)
+			height := e.parabolic(i, step)
+			if height <= e.heights[i-1] || height >= e.heights[i+1] {
+				height = e.linear(i, step)
+			}
+			e.heights[i] = height
+			e.positions[i] += step
+		}
+	}
+}
+
+// parabolic predicts marker i's height after moving it one position by step
+func (e *p2Estimator) parabolic(i int, step float64) float64 {
+	q, n := e.heights, e.positions
+	return q[i] + step/(n[i+1]-n[i-1])*((n[i]-n[i-1]+step)*(q[i+1]-q[i])/(n[i+1]-n[i])+
+		(n[i+1]-n[i]-step)*(q[i]-q[i-1])/(n[i]-n[i-1]))
+}
+
+// linear moves marker i's height toward its neighbour in the direction of step
+func (e *p2Estimator) linear(i int, step float64) float64 {
+	j := i + int(step)
+	return e.heights[i] + step*(e.heights[j]-e.heights[i])/(e.positions[j]-e.positions[i])
+}
+
+// value returns the estimated quantile
+func (e *p2Estimator) value() float64 {
+	return e.heights[2]
+}
+
+// fieldSamples accumulates the statistics of every numeric field for one group
+type fieldSamples struct {
+	count      int
+	offsets    []float64
+	aggregates []FieldAggregate
+	quantiles  []quantileSketch
+}
+
+// newFieldSamples returns empty samples for every numeric field, whose aggregates will
+// be relative to offsets
+func newFieldSamples(offsets []float64) *fieldSamples {
+	return &fieldSamples{
+		offsets:    offsets,
+		aggregates: make([]FieldAggregate, len(numericMeasurementFields)),
+		quantiles:  make([]quantileSketch, len(numericMeasurementFields)),
+	}
+}
+
+// merge includes the database aggregates of some of the group's rows
+func (s *fieldSamples) merge(count int, aggregates []FieldAggregate) {
+	s.count += count
+	for i, a := range aggregates {
+		s.aggregates[i].merge(a)
+	}
+}
+
+// summarize computes the statistics for each field
+func (s *fieldSamples) summarize() map[string]FieldStats {
+	fields := make(map[string]FieldStats, len(numericMeasurementFields))
+	for i, name := range numericMeasurementFields {
+		stats := s.aggregates[i].stats(s.offsets[i])
+		if stats.Count > 0 {
+			values, estimated := s.quantiles[i].percentiles()
+			stats.P50, stats.P95, stats.P99 = values[0], values[1], values[2]
+			stats.Estimated = estimated
+		}
+		fields[name] = stats
+	}
+	return fields
+}
+
+// percentile returns the pth percentile of sorted values using linear interpolation
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// numericValue converts a scanned column value to a float, reporting false for NULLs
+// and non-numeric values
+func numericValue(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case int64:
+		return float64(val), true
+	case float64:
+		return val, true
+	case int:
+		return float64(val), true
+	default:
+		return 0, false
+	}
+}
+
+// scannedTime converts a scanned observed_at value to a time
+func scannedTime(v interface{}) (time.Time, error) {
+	switch val := v.(type) {
+	case time.Time:
+		return val, nil
+	case string:
+		return time.Parse(sqliteTimeFormat, val)
+	case []byte:
+		return time.Parse(sqliteTimeFormat, string(val))
+	default:
+		return time.Time{}, fmt.Errorf("unexpected observed_at value %v", v)
+	}
+}
+
+// scannedString converts a scanned text column value to a string
+func scannedString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	default:
+		return ""
+	}
+}
+
+// statsGroupKey returns the group for an observation time, with its label
+func statsGroupKey(groupBy string, t time.Time) (int, string) {
+	if groupBy == groupByHourOfDay {
+		return t.Hour(), fmt.Sprintf("%02d:00", t.Hour())
+	}
+	return int(t.Weekday()), t.Weekday().String()
+}
+
+// parseStatsGroupBy validates the group_by parameter
+func parseStatsGroupBy(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch value {
+	case "":
+		return "", nil
+	case groupByHourOfDay, groupByDayOfWeek:
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid group_by %q: expected %s or %s", value, groupByHourOfDay, groupByDayOfWeek)
+	}
+}
+
+// computeStats builds a StatsReport for the measurements matching q. Groups use the
+// observation time in loc. Counts, means, ranges and standard deviations are aggregated
+// by the database; the values are then streamed through for percentiles.
+func computeStats(database Storage, q MeasurementQuery, groupBy string, loc *time.Location) (*StatsReport, error) {
+	summary, err := database.GetMeasurementStats(q)
+	if err != nil {
+		return nil, err
+	}
+
+	// The means found first are the offsets for the sums of squares, which would lose
+	// their precision for large values such as uptime
+	offsets := make([]float64, len(numericMeasurementFields))
+	err = database.AggregateMeasurements(q, numericMeasurementFields, offsets, 0, func(_ time.Time, _ int, aggregates []FieldAggregate) error {
+		for i, a := range aggregates {
+			if a.Count > 0 {
+				offsets[i] = a.Sum / float64(a.Count)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute stats: %w", err)
+	}
+
+	all := newFieldSamples(offsets)
+	groups := make(map[int]*fieldSamples)
+	labels := make(map[int]string)
+	group := func(t time.Time) *fieldSamples {
+		key, label := statsGroupKey(groupBy, t.In(loc))
+		if groups[key] == nil {
+			groups[key] = newFieldSamples(offsets)
+			labels[key] = label
+		}
+		return groups[key]
+	}
+
+	var bucket time.Duration
+	if groupBy != "" {
+		bucket = statsBucket
+	}
+	err = database.AggregateMeasurements(q, numericMeasurementFields, offsets, bucket, func(start time.Time, count int, aggregates []FieldAggregate) error {
+		all.merge(count, aggregates)
+		if groupBy != "" {
+			group(start).merge(count, aggregates)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute stats: %w", err)
+	}
+
+	if all.count > 0 {
+		q.Fields = append([]string{"observed_at"}, numericMeasurementFields...)
+		err = database.QueryMeasurements(q, func(values []interface{}) error {
+			var g *fieldSamples
+			if groupBy != "" {
+				observed, err := scannedTime(values[0])
+				if err != nil {
+					return err
+				}
+				g = group(observed)
+			}
+
+			for i, v := range values[1:] {
+				f, ok := numericValue(v)
+				if !ok {
+					continue
+				}
+				all.quantiles[i].add(f)
+				if g != nil {
+					g.quantiles[i].add(f)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute percentiles: %w", err)
+		}
+	}
+
+	report := &StatsReport{
+		MeasurementStats: summary,
+		Fields:           all.summarize(),
+		GroupBy:          groupBy,
+	}
+
+	keys := make([]int, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	for _, key := range keys {
+		report.Groups = append(report.Groups, StatsGroup{
+			Key:    key,
+			Label:  labels[key],
+			Count:  groups[key].count,
+			Fields: groups[key].summarize(),
+		})
+	}
+
+	return report, nil
+}
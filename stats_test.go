@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// closeTo reports whether a and b agree to within tolerance, relative to their size
+func closeTo(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+// exactStats computes FieldStats directly from values
+func exactStats(values []float64) FieldStats {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	var sum, squares float64
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := sum / float64(len(sorted))
+	for _, v := range sorted {
+		squares += (v - mean) * (v - mean)
+	}
+	return FieldStats{
+		Count:  len(sorted),
+		Mean:   mean,
+		Min:    sorted[0],
+		Max:    sorted[len(sorted)-1],
+		StdDev: math.Sqrt(squares / float64(len(sorted))),
+		P50:    percentile(sorted, 50),
+		P95:    percentile(sorted, 95),
+		P99:    percentile(sorted, 99),
+	}
+}
+
+// checkFieldStats compares computed statistics with the exact ones
+func checkFieldStats(t *testing.T, name string, got, want FieldStats) {
+	t.Helper()
+	if got.Count != want.Count || got.Estimated || !closeTo(got.Mean, want.Mean, 1e-9) || got.Min != want.Min || got.Max != want.Max ||
+		!closeTo(got.StdDev, want.StdDev, 1e-6) || !closeTo(got.P50, want.P50, 1e-9) || !closeTo(got.P95, want.P95, 1e-9) || !closeTo(got.P99, want.P99, 1e-9) {
+		t.Errorf("%s = %+v, want %+v", name, got, want)
+	}
+}
+
+func TestComputeStatsMatchesExactValues(t *testing.T) {
+	sqlite, err := NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	memory := NewMemoryDatabase(1000)
+
+	// India is 5:30 ahead of UTC, so local hours don't line up with UTC hours
+	loc, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip("time zone data is not available")
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	var batch []*AirQualityData
+	all := map[string][]float64{}
+	byHour := map[int][]float64{}
+	for i := 0; i < 500; i++ {
+		observed := base.Add(time.Duration(i*7) * time.Minute)
+		data := testMeasurement("a", observed, rng.Intn(300), math.Round(rng.ExpFloat64()*200)/10)
+		data.Uptime = 5_000_000_000 + i
+		batch = append(batch, data)
+		all["pm25_cf1"] = append(all["pm25_cf1"], data.Pm25Cf1)
+		all["pm25_aqi"] = append(all["pm25_aqi"], float64(data.Pm25Aqi))
+		all["uptime"] = append(all["uptime"], float64(data.Uptime))
+		byHour[observed.In(loc).Hour()] = append(byHour[observed.In(loc).Hour()], data.Pm25Cf1)
+	}
+
+	for name, storage := range map[string]Storage{"sqlite": sqlite, "memory": memory} {
+		if err := storage.StoreMeasurements(batch); err != nil {
+			t.Fatal(err)
+		}
+		report, err := computeStats(storage, MeasurementQuery{}, groupByHourOfDay, loc)
+		if err != nil {
+			t.Fatalf("%s: computeStats: %v", name, err)
+		}
+
+		for field, values := range all {
+			checkFieldStats(t, name+" "+field, report.Fields[field], exactStats(values))
+		}
+		if len(report.Groups) != len(byHour) {
+			t.Fatalf("%s: %d groups, want %d", name, len(report.Groups), len(byHour))
+		}
+		for _, group := range report.Groups {
+			if group.Count != len(byHour[group.Key]) {
+				t.Errorf("%s: hour %d has %d measurements, want %d", name, group.Key, group.Count, len(byHour[group.Key]))
+			}
+			checkFieldStats(t, name+" "+group.Label+" pm25_cf1", group.Fields["pm25_cf1"], exactStats(byHour[group.Key]))
+		}
+	}
+}
+
+func TestComputeStatsEmpty(t *testing.T) {
+	report, err := computeStats(NewMemoryDatabase(10), MeasurementQuery{}, groupByDayOfWeek, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Count != 0 || report.Fields["pm25_cf1"] != (FieldStats{}) || len(report.Groups) != 0 {
+		t.Errorf("empty report = %+v", report)
+	}
+}
+
+func TestQuantileSketchEstimatesLargeStreams(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for name, next := range map[string]func() float64{
+		"uniform":     func() float64 { return rng.Float64() * 500 },
+		"exponential": func() float64 { return rng.ExpFloat64() * 12 },
+		"normal":      func() float64 { return 70 + rng.NormFloat64()*8 },
+	} {
+		var sketch quantileSketch
+		values := make([]float64, 200000)
+		for i := range values {
+			values[i] = next()
+			sketch.add(values[i])
+		}
+		if len(sketch.values) != 0 {
+			t.Errorf("%s: sketch kept %d values", name, len(sketch.values))
+		}
+
+		got, estimated := sketch.percentiles()
+		want := exactStats(values)
+		if !estimated {
+			t.Errorf("%s: percentiles of %d values were not marked as estimated", name, len(values))
+		}
+		spread := want.Max - want.Min
+		for i, exact := range []float64{want.P50, want.P95, want.P99} {
+			if math.Abs(got[i]-exact) > 0.01*spread {
+				t.Errorf("%s: p%g = %g, want %g within 1%% of the range", name, statsPercentiles[i], got[i], exact)
+			}
+		}
+	}
+}
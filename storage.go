@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Storage is implemented by each measurement storage backend
+type Storage interface {
+	// StoreMeasurement stores a measurement, updating any existing row for the same
+	// sensor and observation time
+	StoreMeasurement(data *AirQualityData) error
+
+	// StoreMeasurements stores a batch of measurements in a single transaction, with
+	// the same upsert behavior as StoreMeasurement
+	StoreMeasurements(batch []*AirQualityData) error
+
+	// ImportMeasurements stores historical measurements, skipping ones already stored,
+	// and returns the number of rows inserted and skipped
+	ImportMeasurements(records []*AirQualityData) (int, int, error)
+
+	// EachMeasurement calls fn for each measurement matching the query, in
+	// (observed_at, id) order
+	EachMeasurement(q MeasurementQuery, fn func(m Measurement) error) error
+
+	// GetMeasurementStats returns summary statistics for the measurements matching the query
+	GetMeasurementStats(q MeasurementQuery) (*MeasurementStats, error)
+
+	// AggregateMeasurements calls fn with the row count and the aggregates of each of
+	// fields for the measurements matching the query. Sums are of each value less the
+	// field's offset, which keeps sums of squares precise when it is near the mean. With
+	// a bucket length the rows are aggregated per bucket, aligned to the Unix epoch, in
+	// bucket order; otherwise fn is called once with a zero start.
+	AggregateMeasurements(q MeasurementQuery, fields []string, offsets []float64, bucket time.Duration, fn func(start time.Time, count int, aggregates []FieldAggregate) error) error
+
+	// QueryMeasurements streams the query's fields for each matching measurement in
+	// observation order, calling fn once per row
+	QueryMeasurements(q MeasurementQuery, fn func(values []interface{}) error) error
+
+	// StoreDailySummary stores a daily summary, replacing any earlier one for the same
+	// sensor and date
+	StoreDailySummary(summary *DailySummary) error
+
+	// GetDailySummaries returns daily summaries ordered by date and sensor. from is
+	// inclusive and to exclusive (YYYY-MM-DD); empty values and sensorID don't filter.
+	GetDailySummaries(sensorID, from, to string) ([]DailySummary, error)
+
+	// CreateAPIKey stores a new API key, setting its ID. Names must be unique.
+	CreateAPIKey(key *APIKey) error
+
+	// GetAPIKey returns the API key with the given hash, or nil if there is none
+	GetAPIKey(hash string) (*APIKey, error)
+
+	// ListAPIKeys returns every API key ordered by name
+	ListAPIKeys() ([]APIKey, error)
+
+	// DeleteAPIKey removes the API key with the given name, reporting whether it existed
+	DeleteAPIKey(name string) (bool, error)
+
+	// TouchAPIKey records when an API key was last used
+	TouchAPIKey(id int64, usedAt time.Time) error
+
+	// CheckHealth verifies the backend is reachable and accepts writes
+	CheckHealth() error
+
+	// Close releases the backend's resources
+	Close() error
+}
+
+// isPostgresDSN reports whether dsn is a PostgreSQL connection URL rather than a SQLite path
+func isPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// isMemoryDSN reports whether dsn selects the in-memory store
+func isMemoryDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "memory://")
+}
+
+// OpenStorage opens the backend for dsn: a postgres:// URL selects PostgreSQL/TimescaleDB,
+// memory:// the in-memory store, and anything else is treated as a SQLite database path
+func OpenStorage(dsn string) (Storage, error) {
+	if isMemoryDSN(dsn) {
+		return NewMemoryDatabase(memoryCapacityFromEnv()), nil
+	}
+	if isPostgresDSN(dsn) {
+		database, err := NewPostgresDatabase(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return database, nil
+	}
+
+	database, err := NewDatabase(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return database, nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// summaryDateFormat is the format of DailySummary.Date
+const summaryDateFormat = "2006-01-02"
+
+// defaultSummaryInterval is how often days touched by new measurements are re-summarized
+const defaultSummaryInterval = time.Minute
+
+// minDayCompleteness is the Completeness, in percent, a day needs for its mean to be
+// compared with the 24-hour standard: the EPA's 75%, or 18 of 24 hours
+const minDayCompleteness = 75.0
+
+// CategoryHours counts the hours of a day whose mean PM2.5 fell in each AQI category
+type CategoryHours struct {
+	Good               int `json:"good"`
+	Moderate           int `json:"moderate"`
+	UnhealthySensitive int `json:"unhealthy_sensitive"`
+	Unhealthy          int `json:"unhealthy"`
+	VeryUnhealthy      int `json:"very_unhealthy"`
+	Hazardous          int `json:"hazardous"`
+}
+
+// add counts one hour in the given AQI category
+func (c *CategoryHours) add(category int) {
+	switch category {
+	case AQIGood:
+		c.Good++
+	case AQIModerate:
+		c.Moderate++
+	case AQIUnhealthySensitive:
+		c.UnhealthySensitive++
+	case AQIUnhealthy:
+		c.Unhealthy++
+	case AQIVeryUnhealthy:
+		c.VeryUnhealthy++
+	default:
+		c.Hazardous++
+	}
+}
+
+// DailySummary aggregates one sensor's measurements over one calendar day. PM2.5 is the
+// mean of the channel A and B CF=1 readings; the daily mean averages the hourly means.
+type DailySummary struct {
+	SensorID      string        `json:"sensor_id"`
+	Date          string        `json:"date"`
+	Samples       int           `json:"samples"`
+	HoursWithData int           `json:"hours_with_data"`
+	Completeness  float64       `json:"completeness"`
+	MeanPM25      float64       `json:"mean_pm25"`
+	AQI           int           `json:"aqi"`
+	Category      string        `json:"category"`
+	MaxHourlyAQI  int           `json:"max_hourly_aqi"`
+	Hours         CategoryHours `json:"hours"`
+	MinTemp       *float64      `json:"min_temp"`
+	MaxTemp       *float64      `json:"max_temp"`
+	ComputedAt    time.Time     `json:"computed_at"`
+}
+
+// summaryLocationFromEnv returns the time zone whose calendar days are summarized, from
+// SUMMARY_TZ (default UTC)
+func summaryLocationFromEnv() (*time.Location, error) {
+	tz := os.Getenv("SUMMARY_TZ")
+	if tz == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SUMMARY_TZ %q", tz)
+	}
+	return loc, nil
+}
+
+// samplePM25 returns the PM2.5 concentration for a reading: the mean of both channels, or
+// channel A alone when channel B didn't report
+func samplePM25(a, b interface{}) (float64, bool) {
+	pmA, okA := numericValue(a)
+	pmB, okB := numericValue(b)
+	switch {
+	case okA && okB:
+		return (pmA + pmB) / 2, true
+	case okA:
+		return pmA, true
+	default:
+		return pmB, okB
+	}
+}
+
+// computeDailySummary summarizes one sensor's measurements for the day starting at
+// dayStart. It returns nil when the sensor has no measurements that day.
+func computeDailySummary(database Storage, sensorID string, dayStart time.Time) (*DailySummary, error) {
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	q := MeasurementQuery{
+		Range:    TimeRange{Start: dayStart.UTC(), End: dayEnd.UTC()},
+		SensorID: sensorID,
+		Fields:   []string{"observed_at", "pm25_cf1", "pm25_cf1_b", "current_temp_f"},
+	}
+
+	// Days are 23 or 25 hours long when daylight saving time changes
+	hoursInDay := int(dayEnd.Sub(dayStart).Hours())
+	hourSums := make([]float64, hoursInDay)
+	hourCounts := make([]int, hoursInDay)
+
+	summary := &DailySummary{SensorID: sensorID, Date: dayStart.Format(summaryDateFormat)}
+	err := database.QueryMeasurements(q, func(values []interface{}) error {
+		observed, err := scannedTime(values[0])
+		if err != nil {
+			return err
+		}
+		summary.Samples++
+
+		if temp, ok := numericValue(values[3]); ok {
+			if summary.MinTemp == nil || temp < *summary.MinTemp {
+				summary.MinTemp = &temp
+			}
+			if summary.MaxTemp == nil || temp > *summary.MaxTemp {
+				summary.MaxTemp = &temp
+			}
+		}
+
+		pm, ok := samplePM25(values[1], values[2])
+		if !ok {
+			return nil
+		}
+		hour := int(observed.Sub(dayStart).Hours())
+		if hour >= 0 && hour < hoursInDay {
+			hourSums[hour] += pm
+			hourCounts[hour]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize %s for %s: %w", summary.Date, sensorID, err)
+	}
+	if summary.Samples == 0 {
+		return nil, nil
+	}
+
+	var meanSum float64
+	for hour, count := range hourCounts {
+		if count == 0 {
+			continue
+		}
+		hourly := hourSums[hour] / float64(count)
+		meanSum += hourly
+		summary.HoursWithData++
+
+		aqi := PM25AQI(hourly)
+		if aqi > summary.MaxHourlyAQI {
+			summary.MaxHourlyAQI = aqi
+		}
+		summary.Hours.add(AQICategory(aqi))
+	}
+
+	if summary.HoursWithData > 0 {
+		summary.MeanPM25 = meanSum / float64(summary.HoursWithData)
+	}
+	summary.AQI = PM25AQI(summary.MeanPM25)
+	summary.Category = AQICategoryName(summary.AQI)
+	summary.Completeness = float64(summary.HoursWithData) / float64(hoursInDay) * 100
+	summary.ComputedAt = time.Now().UTC()
+	return summary, nil
+}
+
+// summaryDay identifies a sensor's calendar day
+type summaryDay struct {
+	sensorID string
+	date     string
+}
+
+// SummaryTracker wraps a Storage and records which sensor days receive measurements, so
+// that their daily summaries can be recomputed, including days that receive late data
+// from imports or a device catching up after an outage
+type SummaryTracker struct {
+	Storage
+
+	loc   *time.Location
+	mu    sync.Mutex
+	dirty map[summaryDay]bool
+}
+
+// NewSummaryTracker wraps storage, summarizing calendar days in loc
+func NewSummaryTracker(storage Storage, loc *time.Location) *SummaryTracker {
+	return &SummaryTracker{Storage: storage, loc: loc, dirty: make(map[summaryDay]bool)}
+}
+
+// markDirty records that the day containing observedAt needs to be re-summarized
+func (t *SummaryTracker) markDirty(sensorID string, observedAt time.Time) {
+	day := summaryDay{sensorID: sensorID, date: observedAt.In(t.loc).Format(summaryDateFormat)}
+
+	t.mu.Lock()
+	t.dirty[day] = true
+	t.mu.Unlock()
+}
+
+// StoreMeasurement stores a measurement and marks its day for re-summarizing
+func (t *SummaryTracker) StoreMeasurement(data *AirQualityData) error {
+	if err := t.Storage.StoreMeasurement(data); err != nil {
+		return err
+	}
+	t.markDirty(data.SensorId, observedAt(data))
+	return nil
+}
+
+// StoreMeasurements stores a batch and marks its days for re-summarizing
+func (t *SummaryTracker) StoreMeasurements(batch []*AirQualityData) error {
+	if err := t.Storage.StoreMeasurements(batch); err != nil {
+		return err
+	}
+	for _, data := range batch {
+		t.markDirty(data.SensorId, observedAt(data))
+	}
+	return nil
+}
+
+// ImportMeasurements imports historical measurements and marks their days for
+// re-summarizing
+func (t *SummaryTracker) ImportMeasurements(records []*AirQualityData) (int, int, error) {
+	inserted, skipped, err := t.Storage.ImportMeasurements(records)
+	if inserted > 0 {
+		for _, data := range records {
+			if observed, err := data.ObservedAt(); err == nil {
+				t.markDirty(data.SensorId, observed)
+			}
+		}
+	}
+	return inserted, skipped, err
+}
+
+// MarkRange marks every sensor day with measurements in q's range for re-summarizing
+func (t *SummaryTracker) MarkRange(q MeasurementQuery) error {
+	q.Fields = []string{"observed_at", "sensor_id"}
+	return t.Storage.QueryMeasurements(q, func(values []interface{}) error {
+		observed, err := scannedTime(values[0])
+		if err != nil {
+			return err
+		}
+		t.markDirty(scannedString(values[1]), observed)
+		return nil
+	})
+}
+
+// Flush recomputes the summary of every day marked since the last flush. Days that
+// fail are marked again so the next flush retries them.
+func (t *SummaryTracker) Flush() error {
+	t.mu.Lock()
+	days := t.dirty
+	t.dirty = make(map[summaryDay]bool)
+	t.mu.Unlock()
+
+	var firstErr error
+	for day := range days {
+		if err := t.summarize(day); err != nil {
+			slog.Error("Error updating daily summary", "error", err)
+			t.mu.Lock()
+			t.dirty[day] = true
+			t.mu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// summarize recomputes and stores the summary for one sensor day
+func (t *SummaryTracker) summarize(day summaryDay) error {
+	dayStart, err := time.ParseInLocation(summaryDateFormat, day.date, t.loc)
+	if err != nil {
+		return err
+	}
+
+	summary, err := computeDailySummary(t.Storage, day.sensorID, dayStart)
+	if err != nil || summary == nil {
+		return err
+	}
+	return t.Storage.StoreDailySummary(summary)
+}
+
+// Run flushes dirty days every interval until stop is closed. When no summaries exist
+// yet, every day already in the database is summarized first.
+func (t *SummaryTracker) Run(interval time.Duration, stop <-chan struct{}) {
+	summaries, err := t.Storage.GetDailySummaries("", "", "")
+	if err != nil {
+		slog.Error("Error reading daily summaries", "error", err)
+	} else if len(summaries) == 0 {
+		if err := t.MarkRange(MeasurementQuery{}); err != nil {
+			slog.Error("Error finding days to summarize", "error", err)
+		}
+	}
+	t.Flush()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.Flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Unwrap returns the storage backend behind the tracker
+func (t *SummaryTracker) Unwrap() Storage {
+	return t.Storage
+}
+
+// Close summarizes any remaining dirty days and closes the wrapped backend
+func (t *SummaryTracker) Close() error {
+	t.Flush()
+	return t.Storage.Close()
+}
+
+// parseSummaryDates reads the start/end/tz/hours parameters as an inclusive-exclusive
+// range of dates in loc, defaulting to the last year
+func parseSummaryDates(query url.Values, loc *time.Location) (string, string, error) {
+	timeRange, err := parseTimeRange(query, 366*24)
+	if err != nil {
+		return "", "", err
+	}
+
+	from := timeRange.Start.In(loc).Format(summaryDateFormat)
+	// A range ending part way through a day still includes that day
+	end := timeRange.End.In(loc)
+	to := end.Format(summaryDateFormat)
+	if y, m, d := end.Date(); !end.Equal(time.Date(y, m, d, 0, 0, 0, 0, loc)) {
+		to = end.AddDate(0, 0, 1).Format(summaryDateFormat)
+	}
+	return from, to, nil
+}
+
+// runSummarizeCommand implements the `summarize` CLI command, which rebuilds the daily
+// summaries for a range of measurements
+func runSummarizeCommand(args []string) error {
+	fs := flag.NewFlagSet("summarize", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDatabasePath(), "SQLite database path or postgres:// connection URL")
+	start := fs.String("start", "", "first day to summarize (RFC 3339 or YYYY-MM-DD, default all)")
+	end := fs.String("end", "", "end of the range, exclusive (RFC 3339 or YYYY-MM-DD, default now)")
+	sensorID := fs.String("sensor", "", "only summarize this sensor")
+	fs.Parse(args)
+
+	loc, err := summaryLocationFromEnv()
+	if err != nil {
+		return err
+	}
+
+	var q MeasurementQuery
+	q.SensorID = *sensorID
+	if q.Range.Start, err = parseTimeParam(*start, time.Time{}, loc); err != nil {
+		return err
+	}
+	if q.Range.End, err = parseTimeParam(*end, time.Time{}, loc); err != nil {
+		return err
+	}
+
+	database, err := OpenStorage(*dbPath)
+	if err != nil {
+		return err
+	}
+	tracker := NewSummaryTracker(database, loc)
+	defer tracker.Close()
+
+	if err := tracker.MarkRange(q); err != nil {
+		return fmt.Errorf("failed to find days to summarize: %w", err)
+	}
+
+	tracker.mu.Lock()
+	days := len(tracker.dirty)
+	tracker.mu.Unlock()
+
+	if err := tracker.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("Summarized %d sensor days\n", days)
+	return nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS modes selected by the tls.mode setting
+const (
+	tlsModeOff        = ""
+	tlsModeFiles      = "files"
+	tlsModeSelfSigned = "self-signed"
+	tlsModeACME       = "acme"
+)
+
+const (
+	// defaultSelfSignedDir is where self-signed certificates are kept between restarts
+	defaultSelfSignedDir = "tls"
+
+	// defaultACMECacheDir is where ACME account keys and certificates are cached
+	defaultACMECacheDir = "acme-cache"
+
+	// selfSignedValidity is how long a generated certificate is valid for
+	selfSignedValidity = 365 * 24 * time.Hour
+
+	// selfSignedRenewBefore regenerates a self-signed certificate this close to expiry
+	selfSignedRenewBefore = 30 * 24 * time.Hour
+)
+
+// TLSConfig configures HTTPS
+type TLSConfig struct {
+	// Mode is "files" for a configured certificate and key, "self-signed" to generate
+	// a certificate for LAN use, "acme" to obtain one automatically, or empty for HTTP
+	Mode string `json:"mode"`
+
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// SelfSignedDir holds the generated certificate, so clients that have trusted it
+	// keep working across restarts
+	SelfSignedDir string `json:"self_signed_dir"`
+
+	// Hosts are extra host names and IP addresses for the self-signed certificate,
+	// besides the machine's own
+	Hosts []string `json:"hosts"`
+
+	ACME ACMEConfig `json:"acme"`
+
+	// RedirectAddr, such as ":80", serves redirects from HTTP to HTTPS. In ACME mode it
+	// also answers HTTP-01 challenges.
+	RedirectAddr string `json:"redirect_addr"`
+}
+
+// ACMEConfig configures automatic certificates from an ACME CA such as Let's Encrypt
+type ACMEConfig struct {
+	Domains []string `json:"domains"`
+	Email   string   `json:"email"`
+
+	// DirectoryURL defaults to Let's Encrypt; point it at Pebble or a staging CA to test
+	DirectoryURL string `json:"directory_url"`
+
+	CacheDir string `json:"cache_dir"`
+
+	// CAFile is a PEM bundle trusted for the ACME server's own HTTPS, for private CAs
+	// such as Pebble
+	CAFile string `json:"ca_file"`
+}
+
+// validate checks the TLS settings and fills in defaults
+func (c *TLSConfig) validate() error {
+	switch c.Mode {
+	case tlsModeOff:
+		if c.RedirectAddr != "" {
+			return fmt.Errorf("tls.redirect_addr needs a tls.mode")
+		}
+	case tlsModeFiles:
+		if c.CertFile == "" || c.KeyFile == "" {
+			return fmt.Errorf("tls mode %q needs cert_file and key_file", c.Mode)
+		}
+	case tlsModeSelfSigned:
+		if c.SelfSignedDir == "" {
+			c.SelfSignedDir = defaultSelfSignedDir
+		}
+	case tlsModeACME:
+		if len(c.ACME.Domains) == 0 {
+			return fmt.Errorf("tls mode %q needs acme.domains", c.Mode)
+		}
+		if c.ACME.DirectoryURL == "" {
+			c.ACME.DirectoryURL = autocert.DefaultACMEDirectory
+		}
+		if c.ACME.CacheDir == "" {
+			c.ACME.CacheDir = defaultACMECacheDir
+		}
+	default:
+		return fmt.Errorf("invalid tls mode %q: expected %s, %s or %s", c.Mode, tlsModeFiles, tlsModeSelfSigned, tlsModeACME)
+	}
+	return nil
+}
+
+// certReloader serves a certificate that can be replaced while the server runs
+type certReloader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	load func() (*tls.Certificate, error)
+}
+
+// newCertReloader loads the first certificate with load
+func newCertReloader(load func() (*tls.Certificate, error)) (*certReloader, error) {
+	c := &certReloader{load: load}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate again, keeping the current one if that fails
+func (c *certReloader) Reload() error {
+	cert, err := c.load()
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	cert.Leaf = leaf
+	slog.Info("Loaded TLS certificate", "names", strings.Join(certificateNames(leaf), ", "), "expires", leaf.NotAfter.Format(time.RFC3339))
+
+	c.mu.Lock()
+	c.cert = cert
+	c.mu.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// certificateNames lists the names and addresses a certificate is valid for
+func certificateNames(cert *x509.Certificate) []string {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// loadKeyPair returns a loader for a certificate and key in PEM files
+func loadKeyPair(certFile, keyFile string) func() (*tls.Certificate, error) {
+	return func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate: %w", err)
+		}
+		return &cert, nil
+	}
+}
+
+// selfSignedHosts returns the names a self-signed certificate covers: localhost, the
+// machine's host name and addresses, and any configured hosts
+func selfSignedHosts(extra []string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		hosts = append(hosts, name)
+		if !strings.Contains(name, ".") {
+			hosts = append(hosts, name+".local")
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				hosts = append(hosts, ipNet.IP.String())
+			}
+		}
+	}
+	hosts = append(hosts, extra...)
+
+	seen := make(map[string]bool)
+	var unique []string
+	for _, h := range hosts {
+		if !seen[h] {
+			seen[h] = true
+			unique = append(unique, h)
+		}
+	}
+	return unique
+}
+
+// loadSelfSigned returns a loader for a self-signed certificate in dir, generating a new
+// one when there is none, it is close to expiry, or it doesn't cover every host
+func loadSelfSigned(dir string, hosts []string) func() (*tls.Certificate, error) {
+	certFile := filepath.Join(dir, "self-signed.crt")
+	keyFile := filepath.Join(dir, "self-signed.key")
+
+	return func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err == nil && selfSignedUsable(&cert, hosts) {
+			return &cert, nil
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Replacing unreadable self-signed certificate", "error", err)
+		}
+
+		if err := generateSelfSigned(certFile, keyFile, hosts); err != nil {
+			return nil, err
+		}
+		return loadKeyPair(certFile, keyFile)()
+	}
+}
+
+// selfSignedUsable reports whether a stored self-signed certificate can still be used
+func selfSignedUsable(cert *tls.Certificate, hosts []string) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || time.Until(leaf.NotAfter) < selfSignedRenewBefore {
+		return false
+	}
+	for _, h := range hosts {
+		if leaf.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// generateSelfSigned writes a new self-signed certificate and key for hosts
+func generateSelfSigned(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"Air Quality Monitor"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		// Marking it as its own CA lets clients trust it directly
+		IsCA: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode key: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+
+	fingerprint := sha256.Sum256(der)
+	slog.Info("Generated self-signed certificate", "path", certFile, "sha256_fingerprint", hex.EncodeToString(fingerprint[:]))
+	return nil
+}
+
+// newACMEManager creates the autocert manager for the configured domains
+func newACMEManager(cfg ACMEConfig) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if cfg.CAFile != "" {
+		pemData, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+			Timeout:   30 * time.Second,
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		Email:      cfg.Email,
+		Client:     client,
+	}, nil
+}
+
+// serverTLS holds the TLS setup for a running server
+type serverTLS struct {
+	config   *tls.Config
+	reloader *certReloader
+	acme     *autocert.Manager
+}
+
+// newServerTLS prepares the certificates for a TLS mode
+func newServerTLS(cfg TLSConfig) (*serverTLS, error) {
+	t := &serverTLS{}
+	var err error
+
+	switch cfg.Mode {
+	case tlsModeFiles:
+		t.reloader, err = newCertReloader(loadKeyPair(cfg.CertFile, cfg.KeyFile))
+	case tlsModeSelfSigned:
+		t.reloader, err = newCertReloader(loadSelfSigned(cfg.SelfSignedDir, selfSignedHosts(cfg.Hosts)))
+	case tlsModeACME:
+		t.acme, err = newACMEManager(cfg.ACME)
+	default:
+		return nil, fmt.Errorf("invalid tls mode %q", cfg.Mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if t.acme != nil {
+		// The manager's config also answers TLS-ALPN-01 challenges
+		t.config = t.acme.TLSConfig()
+	} else {
+		t.config = &tls.Config{GetCertificate: t.reloader.GetCertificate}
+	}
+	t.config.MinVersion = tls.VersionTLS12
+	return t, nil
+}
+
+// redirectHandler returns a handler that redirects requests to the same URL over HTTPS
+// on the port in httpsAddr
+func redirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// serveTLS accepts TLS connections with config on a local port until the test ends,
+// completing each handshake
+func serveTLS(t *testing.T, config *tls.Config) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// servedSerial connects to addr and returns the serial number of the certificate it serves
+func servedSerial(t *testing.T, addr string) *big.Int {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber
+}
+
+// fileSerial returns the serial number of the certificate in a PEM file
+func fileSerial(t *testing.T, certFile, keyFile string) *big.Int {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber
+}
+
+func TestSelfSignedCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "self-signed.crt")
+	keyFile := filepath.Join(dir, "self-signed.key")
+	hosts := []string{"localhost", "127.0.0.1"}
+
+	reloader, err := newCertReloader(loadSelfSigned(dir, hosts))
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	addr := serveTLS(t, &tls.Config{GetCertificate: reloader.GetCertificate})
+	first := servedSerial(t, addr)
+	if first.Cmp(fileSerial(t, certFile, keyFile)) != 0 {
+		t.Fatalf("served certificate is not the one written to %s", certFile)
+	}
+
+	// A usable certificate is kept, so clients that trust it keep working
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if served := servedSerial(t, addr); served.Cmp(first) != 0 {
+		t.Errorf("reloading replaced a usable certificate")
+	}
+
+	// A certificate missing a host is replaced
+	reloader.load = loadSelfSigned(dir, append(hosts, "sensor.lan"))
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	served := servedSerial(t, addr)
+	if served.Cmp(first) == 0 || served.Cmp(fileSerial(t, certFile, keyFile)) != 0 {
+		t.Errorf("certificate was not regenerated for a new host")
+	}
+	if err := reloader.cert.Leaf.VerifyHostname("sensor.lan"); err != nil {
+		t.Errorf("regenerated certificate: %v", err)
+	}
+
+	// So is one that can't be read
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if regenerated := servedSerial(t, addr); regenerated.Cmp(served) == 0 {
+		t.Errorf("an unreadable certificate was not replaced")
+	}
+}
+
+func TestCertificateReloadsOnHangup(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	if err := generateSelfSigned(certFile, keyFile, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	first := fileSerial(t, certFile, keyFile)
+
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Catching SIGHUP here keeps a signal sent before the server listens from ending the test
+	caught := make(chan os.Signal, 10)
+	signal.Notify(caught, syscall.SIGHUP)
+	defer signal.Stop(caught)
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Skipf("can't send SIGHUP: %v", err)
+	}
+
+	serverTLS, err := newServerTLS(TLSConfig{Mode: tlsModeFiles, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("newServerTLS: %v", err)
+	}
+	s := &Server{tls: serverTLS, stopChan: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		s.reloadOnHangup()
+		close(done)
+	}()
+	defer func() {
+		close(s.stopChan)
+		<-done
+	}()
+
+	addr := serveTLS(t, serverTLS.config)
+	if served := servedSerial(t, addr); served.Cmp(first) != 0 {
+		t.Fatalf("served certificate is not the configured one")
+	}
+
+	// A renewed certificate is served after SIGHUP, without restarting
+	if err := generateSelfSigned(certFile, keyFile, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	renewed := fileSerial(t, certFile, keyFile)
+	waitForSerial(t, process, addr, renewed)
+
+	// A broken certificate is rejected and the current one kept
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	process.Signal(syscall.SIGHUP)
+	time.Sleep(100 * time.Millisecond)
+	if served := servedSerial(t, addr); served.Cmp(renewed) != 0 {
+		t.Errorf("a broken certificate replaced the current one")
+	}
+}
+
+// waitForSerial sends SIGHUP until addr serves the certificate with serial. The server
+// may not be listening for the signal yet, so one might be missed.
+func waitForSerial(t *testing.T, process *os.Process, addr string, serial *big.Int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		process.Signal(syscall.SIGHUP)
+		time.Sleep(50 * time.Millisecond)
+		if servedSerial(t, addr).Cmp(serial) == 0 {
+			return
+		}
+	}
+	t.Fatal("the renewed certificate was not served after SIGHUP")
+}
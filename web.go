@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// webFiles holds the page templates and static assets, so the web interface works
+// without internet access or files next to the binary
+//
+//go:embed web/templates/*.html web/static/*
+var webFiles embed.FS
+
+// staticPrefix is the URL path static assets are served under
+const staticPrefix = "/static/"
+
+// webAsset is a static file with its content hash
+type webAsset struct {
+	name       string
+	data       []byte
+	hash       string
+	hashedName string
+}
+
+// WebAssets serves the embedded pages and static files. Pages link to assets by a
+// name that includes a hash of the content, so browsers can cache them indefinitely
+// and still pick up changes after an upgrade.
+type WebAssets struct {
+	templates *template.Template
+	assets    map[string]*webAsset
+	hashed    map[string]*webAsset
+	modTime   time.Time
+}
+
+// NewWebAssets loads the embedded templates and hashes the static files
+func NewWebAssets() (*WebAssets, error) {
+	w := &WebAssets{
+		assets:  make(map[string]*webAsset),
+		hashed:  make(map[string]*webAsset),
+		modTime: time.Now(),
+	}
+
+	static, err := fs.Sub(webFiles, "web/static")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open static assets: %w", err)
+	}
+	err = fs.WalkDir(static, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(static, name)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])[:12]
+		ext := path.Ext(name)
+		asset := &webAsset{
+			name:       name,
+			data:       data,
+			hash:       hash,
+			hashedName: strings.TrimSuffix(name, ext) + "." + hash + ext,
+		}
+		w.assets[name] = asset
+		w.hashed[asset.hashedName] = asset
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load static assets: %w", err)
+	}
+
+	funcs := template.FuncMap{"asset": w.assetURL}
+	w.templates, err = template.New("").Funcs(funcs).ParseFS(webFiles, "web/templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %w", err)
+	}
+	return w, nil
+}
+
+// assetURL returns the content-hashed URL of a static file. Templates call it as
+// {{asset "graphs.js"}}; an unknown name fails the page rather than linking to nothing.
+func (w *WebAssets) assetURL(name string) (string, error) {
+	asset, ok := w.assets[name]
+	if !ok {
+		return "", fmt.Errorf("unknown asset %q", name)
+	}
+	return staticPrefix + asset.hashedName, nil
+}
+
+// page returns a handler that renders a page template. Pages are small and change with
+// every upgrade, so browsers revalidate them on each load.
+func (w *WebAssets) page(name string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		// Render before writing so a template error can still be reported
+		var buf bytes.Buffer
+		if err := w.templates.ExecuteTemplate(&buf, name, nil); err != nil {
+			slog.ErrorContext(r.Context(), "Error rendering page", "page", name, "error", err)
+			writeError(rw, r, http.StatusInternalServerError, errInternal, "Error rendering page")
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Header().Set("Cache-Control", "no-cache")
+		buf.WriteTo(rw)
+	}
+}
+
+// serveStatic serves a static file. Hashed names never change content and are cached
+// for a year; plain names are revalidated with an ETag.
+func (w *WebAssets) serveStatic(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if asset, ok := w.hashed[name]; ok {
+		rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		http.ServeContent(rw, r, asset.name, w.modTime, bytes.NewReader(asset.data))
+		return
+	}
+
+	asset, ok := w.assets[name]
+	if !ok {
+		notFound(rw, r)
+		return
+	}
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("ETag", `"`+asset.hash+`"`)
+	http.ServeContent(rw, r, asset.name, w.modTime, bytes.NewReader(asset.data))
+}
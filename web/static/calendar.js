@@ -0,0 +1,112 @@
+const categories = [
+    { name: 'Good', color: '#00e400' },
+    { name: 'Moderate', color: '#ffff00' },
+    { name: 'Unhealthy for Sensitive Groups', color: '#ff7e00' },
+    { name: 'Unhealthy', color: '#ff0000' },
+    { name: 'Very Unhealthy', color: '#8f3f97' },
+    { name: 'Hazardous', color: '#7e0023' }
+];
+const monthNames = ['Jan', 'Feb', 'Mar', 'Apr', 'May', 'Jun', 'Jul', 'Aug', 'Sep', 'Oct', 'Nov', 'Dec'];
+let summaries = [];
+
+function categoryColor(name) {
+    const category = categories.find(c => c.name === name);
+    return category ? category.color : '#ebedf0';
+}
+
+function initControls() {
+    const select = document.getElementById('year');
+    const current = new Date().getFullYear();
+    for (let year = current; year >= current - 10; year--) {
+        select.add(new Option(year, year));
+    }
+    document.getElementById('legend').innerHTML = categories
+        .map(c => '<div><span style="background:' + c.color + '"></span>' + c.name + '</div>')
+        .join('') + '<div><span style="background:#ebedf0"></span>No data</div>';
+}
+
+function loadData() {
+    const year = parseInt(document.getElementById('year').value);
+    fetch('/api/v1/daily?start=' + year + '-01-01&end=' + (year + 1) + '-01-01')
+        .then(response => response.json())
+        .then(data => {
+            summaries = data.summaries;
+            const sensorSelect = document.getElementById('sensor');
+            const selected = sensorSelect.value;
+            const sensors = [...new Set(summaries.map(s => s.sensor_id))];
+            sensorSelect.innerHTML = '';
+            sensors.forEach(id => sensorSelect.add(new Option(id, id)));
+            if (sensors.includes(selected)) {
+                sensorSelect.value = selected;
+            }
+            render();
+        })
+        .catch(error => {
+            console.error('Error loading daily summaries:', error);
+        });
+}
+
+function render() {
+    const year = parseInt(document.getElementById('year').value);
+    const sensor = document.getElementById('sensor').value;
+    const byDate = {};
+    summaries.filter(s => s.sensor_id === sensor).forEach(s => { byDate[s.date] = s; });
+
+    const grid = document.getElementById('grid');
+    const months = document.getElementById('months');
+    grid.innerHTML = '<div class="weekdays"><span></span><span>Mon</span><span></span><span>Wed</span><span></span><span>Fri</span><span></span></div>';
+    months.innerHTML = '';
+
+    const day = new Date(Date.UTC(year, 0, 1));
+    let week = document.createElement('div');
+    week.className = 'week';
+    for (let i = 0; i < day.getUTCDay(); i++) {
+        week.appendChild(Object.assign(document.createElement('div'), { className: 'day empty' }));
+    }
+    let label = addMonthLabel(months);
+
+    while (day.getUTCFullYear() === year) {
+        if (day.getUTCDay() === 0 && week.children.length > 0) {
+            grid.appendChild(week);
+            week = document.createElement('div');
+            week.className = 'week';
+            label = addMonthLabel(months);
+        }
+        if (day.getUTCDate() === 1) {
+            label.textContent = monthNames[day.getUTCMonth()];
+        }
+
+        const date = day.toISOString().slice(0, 10);
+        const summary = byDate[date];
+        const cell = document.createElement('div');
+        cell.className = 'day';
+        if (summary) {
+            cell.style.background = categoryColor(summary.category);
+        }
+        cell.onmouseenter = () => showDetails(date, summary);
+        week.appendChild(cell);
+
+        day.setUTCDate(day.getUTCDate() + 1);
+    }
+    grid.appendChild(week);
+}
+
+function addMonthLabel(months) {
+    const label = document.createElement('span');
+    months.appendChild(label);
+    return label;
+}
+
+function showDetails(date, summary) {
+    const details = document.getElementById('details');
+    if (!summary) {
+        details.textContent = date + ': no data';
+        return;
+    }
+    details.textContent = date + ': AQI ' + summary.aqi + ' (' + summary.category + '), mean PM2.5 ' +
+        summary.mean_pm25.toFixed(1) + ' µg/m³, max hourly AQI ' + summary.max_hourly_aqi +
+        ', ' + summary.completeness.toFixed(0) + '% complete';
+}
+
+initControls();
+loadData();
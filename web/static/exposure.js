@@ -0,0 +1,74 @@
+const tz = Intl.DateTimeFormat().resolvedOptions().timeZone;
+
+function initControls() {
+    const end = new Date();
+    const start = new Date(end.getTime() - 7 * 24 * 3600 * 1000);
+    document.getElementById('start').value = localDate(start);
+    document.getElementById('end').value = localDate(end);
+}
+
+function localDate(d) {
+    return d.getFullYear() + '-' + String(d.getMonth() + 1).padStart(2, '0') + '-' + String(d.getDate()).padStart(2, '0');
+}
+
+function loadReport() {
+    // The end date is inclusive on the page and exclusive in the API
+    const end = new Date(document.getElementById('end').value + 'T00:00:00');
+    end.setDate(end.getDate() + 1);
+    const params = new URLSearchParams({
+        start: document.getElementById('start').value,
+        end: localDate(end),
+        tz: tz,
+        pm25: document.getElementById('pm25').value,
+        aqi: document.getElementById('aqi').value,
+        daily_standard: document.getElementById('standard').value
+    });
+    fetch('/api/v1/exposure?' + params)
+        .then(response => response.ok ? response.json() : response.json().then(body => { throw new Error(body.error.message); }))
+        .then(renderReport)
+        .catch(error => {
+            document.getElementById('report').innerHTML = '<div class="empty"></div>';
+            document.querySelector('#report .empty').textContent = error.message;
+        });
+}
+
+function card(value, label) {
+    return '<div class="stat-card"><div class="stat-value">' + value + '</div><div class="stat-label">' + label + '</div></div>';
+}
+
+function escapeHTML(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
+
+function renderReport(report) {
+    const container = document.getElementById('report');
+    if (report.sensors.length === 0) {
+        container.innerHTML = '<div class="empty">No measurements in this range</div>';
+        return;
+    }
+    const t = report.thresholds;
+    container.innerHTML = report.sensors.map(s => {
+        const longest = s.longest_exceedance
+            ? s.longest_exceedance.hours.toFixed(1) + ' h'
+            : 'None';
+        const longestLabel = s.longest_exceedance
+            ? 'Longest exceedance (from ' + new Date(s.longest_exceedance.start).toLocaleString() + ')'
+            : 'Longest exceedance';
+        const days = s.exceedance_days.length
+            ? 'Days above the 24-hour standard: ' + s.exceedance_days.map(d => d.date + ' (' + d.mean_pm25.toFixed(1) + ' µg/m³)').join(', ')
+            : 'No days above the 24-hour standard';
+        return '<div class="sensor"><h3>Sensor ' + escapeHTML(s.sensor_id) + '</h3><div class="stats">' +
+            card(s.hours_above_pm25.toFixed(1) + ' h', 'Above ' + t.pm25 + ' µg/m³ PM2.5') +
+            card(s.hours_above_aqi.toFixed(1) + ' h', 'Above AQI ' + t.aqi) +
+            card(s.days_above_standard, 'Days above ' + t.daily_standard + ' µg/m³ (24-hour)') +
+            card(s.cumulative_exposure.toFixed(0), 'Cumulative exposure (µg/m³·h)') +
+            card(longest, longestLabel) +
+            card(s.hours_covered.toFixed(1) + ' h', 'Hours with data') +
+            '</div><div class="days">' + days + '</div></div>';
+    }).join('');
+}
+
+initControls();
+loadReport();
@@ -0,0 +1,78 @@
+let pm25Chart, tempHumidityChart, pm25ConcentrationChart, systemChart;
+
+function initCharts() {
+    pm25Chart = new LineChart(document.getElementById('pm25Chart'), { beginAtZero: true });
+    tempHumidityChart = new LineChart(document.getElementById('tempHumidityChart'));
+    pm25ConcentrationChart = new LineChart(document.getElementById('pm25ConcentrationChart'), { beginAtZero: true });
+    systemChart = new LineChart(document.getElementById('systemChart'));
+}
+
+function loadData() {
+    const hours = document.getElementById('timeRange').value;
+
+    // Load measurements, following next links until every page is in
+    loadMeasurements('/api/v1/measurements?hours=' + hours, [])
+        .then(measurements => {
+            updateCharts(measurements);
+        })
+        .catch(error => {
+            console.error('Error loading measurements:', error);
+        });
+
+    // Load stats
+    fetch('/api/v1/stats?hours=' + hours)
+        .then(response => response.json())
+        .then(data => {
+            updateStats(data);
+        })
+        .catch(error => {
+            console.error('Error loading stats:', error);
+        });
+}
+
+function loadMeasurements(url, measurements) {
+    return fetch(url)
+        .then(response => response.json())
+        .then(page => {
+            measurements = measurements.concat(page.measurements);
+            return page.next ? loadMeasurements(page.next, measurements) : measurements;
+        });
+}
+
+function updateCharts(measurements) {
+    const series = field => measurements.map(m => ({ x: new Date(m.timestamp).getTime(), y: m[field] }));
+
+    pm25Chart.setData([
+        { label: 'PM2.5 AQI (Channel A)', data: series('pm25_aqi'), color: 'rgb(75, 192, 192)' },
+        { label: 'PM2.5 AQI (Channel B)', data: series('pm25_aqi_b'), color: 'rgb(255, 99, 132)' }
+    ]);
+
+    tempHumidityChart.setData([
+        { label: 'Temperature (°F)', data: series('temperature'), color: 'rgb(255, 159, 64)' },
+        { label: 'Humidity (%)', data: series('humidity'), color: 'rgb(153, 102, 255)', axis: 'right' }
+    ]);
+
+    pm25ConcentrationChart.setData([
+        { label: 'PM2.5 CF1 (Channel A)', data: series('pm25_cf1'), color: 'rgb(54, 162, 235)' },
+        { label: 'PM2.5 CF1 (Channel B)', data: series('pm25_cf1_b'), color: 'rgb(255, 205, 86)' }
+    ]);
+
+    systemChart.setData([
+        { label: 'Memory (bytes)', data: series('memory'), color: 'rgb(201, 203, 207)' },
+        { label: 'RSSI (dBm)', data: series('rssi'), color: 'rgb(255, 99, 132)', axis: 'right' }
+    ]);
+}
+
+function updateStats(stats) {
+    document.getElementById('avgPM25').textContent = stats.avg_pm25_aqi ? stats.avg_pm25_aqi.toFixed(1) : '-';
+    document.getElementById('avgTemp').textContent = stats.avg_temp ? stats.avg_temp.toFixed(1) : '-';
+    document.getElementById('avgHumidity').textContent = stats.avg_humidity ? stats.avg_humidity.toFixed(1) : '-';
+    document.getElementById('dataPoints').textContent = stats.count || '-';
+}
+
+// Initialize charts and load data
+initCharts();
+loadData();
+
+// Auto-refresh every 5 minutes
+setInterval(loadData, 300000);
@@ -0,0 +1,49 @@
+function updateData() {
+    fetch('/data/json')
+        .then(response => response.json())
+        .then(data => {
+            const container = document.getElementById('data-container');
+            let html = '';
+
+            html += '<div class="data-section">';
+            html += '<h3>Current Air Quality</h3>';
+            html += '<div class="metric"><span>PM2.5 AQI (Channel A):</span><span class="value">' + data.pm2_5_aqi + '</span></div>';
+            html += '<div class="metric"><span>PM2.5 AQI (Channel B):</span><span class="value">' + data.pm2_5_aqi_b + '</span></div>';
+            html += '<div class="metric"><span>PM1.0 (CF1):</span><span class="value">' + data.pm1_0_cf_1.toFixed(2) + ' ug/m3</span></div>';
+            html += '<div class="metric"><span>PM2.5 (CF1):</span><span class="value">' + data.pm2_5_cf_1.toFixed(2) + ' ug/m3</span></div>';
+            html += '<div class="metric"><span>PM10.0 (CF1):</span><span class="value">' + data.pm10_0_cf_1.toFixed(2) + ' ug/m3</span></div>';
+            html += '</div>';
+
+            html += '<div class="data-section">';
+            html += '<h3>Environmental Conditions</h3>';
+            html += '<div class="metric"><span>Temperature:</span><span class="value">' + data.current_temp_f.toFixed(1) + ' F</span></div>';
+            html += '<div class="metric"><span>Humidity:</span><span class="value">' + data.current_humidity + '%</span></div>';
+            html += '<div class="metric"><span>Dew Point:</span><span class="value">' + data.current_dewpoint_f.toFixed(1) + ' F</span></div>';
+            html += '<div class="metric"><span>Pressure:</span><span class="value">' + data.pressure.toFixed(2) + ' hPa</span></div>';
+            html += '<div class="metric"><span>Gas (BME680):</span><span class="value">' + data.gas_680.toFixed(2) + ' kOhm</span></div>';
+            html += '</div>';
+
+            html += '<div class="data-section">';
+            html += '<h3>System Information</h3>';
+            html += '<div class="metric"><span>Sensor ID:</span><span class="value">' + data.SensorId + '</span></div>';
+            html += '<div class="metric"><span>Location:</span><span class="value">' + data.Geo + '</span></div>';
+            html += '<div class="metric"><span>Uptime:</span><span class="value">' + Math.floor(data.uptime / 3600) + 'h ' + Math.floor((data.uptime % 3600) / 60) + 'm</span></div>';
+            html += '<div class="metric"><span>WiFi Status:</span><span class="value">' + data.wlstate + ' (RSSI: ' + data.rssi + ')</span></div>';
+            html += '<div class="metric"><span>Memory:</span><span class="value">' + data.Mem + ' bytes</span></div>';
+            html += '</div>';
+
+            container.innerHTML = html;
+
+            document.getElementById('last-updated').textContent =
+                'Last updated: ' + new Date().toLocaleString();
+        })
+        .catch(error => {
+            console.error('Error fetching data:', error);
+            document.getElementById('data-container').innerHTML =
+                '<div style="color: red; text-align: center; padding: 20px;">Error loading data. Please try again.</div>';
+        });
+}
+
+// Load data immediately and refresh every 30 seconds
+updateData();
+setInterval(updateData, 30000);
@@ -0,0 +1,308 @@
+// LineChart draws time-series line charts on a canvas. It is bundled with the server so
+// the graphs work on networks without internet access.
+//
+// Datasets are {label, color, data: [{x, y}], axis} where x is a time in milliseconds, y
+// is a number or null for a gap, and axis is 'left' (default) or 'right'.
+class LineChart {
+    constructor(canvas, options) {
+        this.canvas = canvas;
+        this.options = Object.assign({
+            aspectRatio: 2,
+            beginAtZero: false,
+            // Lines break where points are further apart, so missing data is visible
+            maxGap: 15 * 60 * 1000
+        }, options);
+        this.datasets = [];
+        this.hoverX = null;
+
+        canvas.style.width = '100%';
+        canvas.addEventListener('mousemove', event => {
+            this.hoverX = event.offsetX;
+            this.draw();
+        });
+        canvas.addEventListener('mouseleave', () => {
+            this.hoverX = null;
+            this.draw();
+        });
+        window.addEventListener('resize', () => this.draw());
+    }
+
+    setData(datasets) {
+        this.datasets = datasets;
+        this.draw();
+    }
+
+    draw() {
+        const canvas = this.canvas;
+        const width = canvas.clientWidth;
+        const height = Math.round(width / this.options.aspectRatio);
+        const ratio = window.devicePixelRatio || 1;
+        canvas.style.height = height + 'px';
+        canvas.width = width * ratio;
+        canvas.height = height * ratio;
+
+        const ctx = canvas.getContext('2d');
+        ctx.setTransform(ratio, 0, 0, ratio, 0, 0);
+        ctx.clearRect(0, 0, width, height);
+        ctx.font = '12px Arial, sans-serif';
+        ctx.lineJoin = 'round';
+
+        const hasRight = this.datasets.some(d => d.axis === 'right');
+        const plot = { left: 55, top: 30, right: width - (hasRight ? 55 : 15), bottom: height - 30 };
+        this.drawLegend(ctx, plot);
+
+        const xRange = this.range(this.datasets, p => p.x);
+        if (!xRange || plot.right <= plot.left || plot.bottom <= plot.top) {
+            ctx.fillStyle = '#999';
+            ctx.textAlign = 'center';
+            ctx.fillText('No data', width / 2, height / 2);
+            return;
+        }
+        if (xRange.min === xRange.max) {
+            xRange.min -= 30 * 60 * 1000;
+            xRange.max += 30 * 60 * 1000;
+        }
+
+        const xPos = x => plot.left + (x - xRange.min) / (xRange.max - xRange.min) * (plot.right - plot.left);
+        const axes = {};
+        ['left', 'right'].forEach(side => {
+            const datasets = this.datasets.filter(d => (d.axis || 'left') === side);
+            const yRange = this.range(datasets, p => p.y);
+            if (!yRange) {
+                return;
+            }
+            if (this.options.beginAtZero) {
+                yRange.min = Math.min(0, yRange.min);
+                yRange.max = Math.max(0, yRange.max);
+            }
+            const ticks = LineChart.niceTicks(yRange.min, yRange.max, 5);
+            const min = ticks[0];
+            const max = ticks[ticks.length - 1];
+            axes[side] = {
+                ticks: ticks,
+                pos: y => plot.bottom - (y - min) / (max - min) * (plot.bottom - plot.top)
+            };
+        });
+
+        this.drawAxes(ctx, plot, xRange, xPos, axes);
+
+        this.datasets.forEach(dataset => {
+            const axis = axes[dataset.axis || 'left'];
+            if (!axis) {
+                return;
+            }
+            ctx.strokeStyle = dataset.color;
+            ctx.lineWidth = 2;
+            ctx.beginPath();
+            let previous = null;
+            dataset.data.forEach(p => {
+                if (p.y === null || p.y === undefined) {
+                    previous = null;
+                    return;
+                }
+                if (previous === null || p.x - previous.x > this.options.maxGap) {
+                    ctx.moveTo(xPos(p.x), axis.pos(p.y));
+                } else {
+                    ctx.lineTo(xPos(p.x), axis.pos(p.y));
+                }
+                previous = p;
+            });
+            ctx.stroke();
+        });
+
+        if (this.hoverX !== null && this.hoverX >= plot.left && this.hoverX <= plot.right) {
+            const x = xRange.min + (this.hoverX - plot.left) / (plot.right - plot.left) * (xRange.max - xRange.min);
+            this.drawTooltip(ctx, plot, x, xPos, axes);
+        }
+    }
+
+    range(datasets, value) {
+        let min = Infinity;
+        let max = -Infinity;
+        datasets.forEach(d => d.data.forEach(p => {
+            if (p.y === null || p.y === undefined) {
+                return;
+            }
+            min = Math.min(min, value(p));
+            max = Math.max(max, value(p));
+        }));
+        return min === Infinity ? null : { min: min, max: max };
+    }
+
+    drawLegend(ctx, plot) {
+        let x = plot.left;
+        ctx.textAlign = 'left';
+        ctx.textBaseline = 'middle';
+        this.datasets.forEach(d => {
+            ctx.fillStyle = d.color;
+            ctx.fillRect(x, 8, 14, 8);
+            ctx.fillStyle = '#333';
+            ctx.fillText(d.label, x + 18, 12);
+            x += 18 + ctx.measureText(d.label).width + 20;
+        });
+    }
+
+    drawAxes(ctx, plot, xRange, xPos, axes) {
+        ctx.lineWidth = 1;
+        ctx.textBaseline = 'middle';
+
+        Object.keys(axes).forEach(side => {
+            const axis = axes[side];
+            ctx.textAlign = side === 'left' ? 'right' : 'left';
+            axis.ticks.forEach(tick => {
+                const y = axis.pos(tick);
+                if (side === 'left' || !axes.left) {
+                    ctx.strokeStyle = '#e6e6e6';
+                    ctx.beginPath();
+                    ctx.moveTo(plot.left, y);
+                    ctx.lineTo(plot.right, y);
+                    ctx.stroke();
+                }
+                ctx.fillStyle = '#666';
+                ctx.fillText(LineChart.formatNumber(tick), side === 'left' ? plot.left - 6 : plot.right + 6, y);
+            });
+        });
+
+        const ticks = LineChart.timeTicks(xRange.min, xRange.max, Math.max(2, Math.floor((plot.right - plot.left) / 110)));
+        ctx.textAlign = 'center';
+        ticks.forEach(tick => {
+            const x = xPos(tick.time);
+            ctx.strokeStyle = '#e6e6e6';
+            ctx.beginPath();
+            ctx.moveTo(x, plot.top);
+            ctx.lineTo(x, plot.bottom);
+            ctx.stroke();
+            ctx.fillStyle = '#666';
+            ctx.fillText(tick.label, x, plot.bottom + 15);
+        });
+
+        ctx.strokeStyle = '#999';
+        ctx.beginPath();
+        ctx.moveTo(plot.left, plot.top);
+        ctx.lineTo(plot.left, plot.bottom);
+        ctx.lineTo(plot.right, plot.bottom);
+        ctx.stroke();
+    }
+
+    drawTooltip(ctx, plot, x, xPos, axes) {
+        // Show the reading nearest the cursor from each dataset
+        let time = null;
+        const rows = [];
+        this.datasets.forEach(d => {
+            const p = LineChart.nearest(d.data, x);
+            if (!p || !axes[d.axis || 'left']) {
+                return;
+            }
+            if (time === null || Math.abs(p.x - x) < Math.abs(time - x)) {
+                time = p.x;
+            }
+            rows.push({ color: d.color, text: d.label + ': ' + LineChart.formatNumber(p.y) });
+        });
+        if (time === null) {
+            return;
+        }
+
+        const lineX = xPos(time);
+        ctx.strokeStyle = '#999';
+        ctx.beginPath();
+        ctx.moveTo(lineX, plot.top);
+        ctx.lineTo(lineX, plot.bottom);
+        ctx.stroke();
+
+        const title = new Date(time).toLocaleString();
+        const boxWidth = Math.max(ctx.measureText(title).width, ...rows.map(r => ctx.measureText(r.text).width + 16)) + 16;
+        const boxHeight = 24 + rows.length * 16;
+        let boxX = lineX + 10;
+        if (boxX + boxWidth > plot.right) {
+            boxX = lineX - 10 - boxWidth;
+        }
+        const boxY = plot.top + 5;
+
+        ctx.fillStyle = 'rgba(0, 0, 0, 0.8)';
+        ctx.fillRect(boxX, boxY, boxWidth, boxHeight);
+        ctx.textAlign = 'left';
+        ctx.fillStyle = 'white';
+        ctx.fillText(title, boxX + 8, boxY + 12);
+        rows.forEach((row, i) => {
+            const y = boxY + 28 + i * 16;
+            ctx.fillStyle = row.color;
+            ctx.fillRect(boxX + 8, y - 5, 10, 10);
+            ctx.fillStyle = 'white';
+            ctx.fillText(row.text, boxX + 24, y);
+        });
+    }
+
+    // nearest returns the point with a value closest in time to x, from points sorted by time
+    static nearest(points, x) {
+        let lo = 0;
+        let hi = points.length - 1;
+        while (lo < hi) {
+            const mid = (lo + hi) >> 1;
+            if (points[mid].x < x) {
+                lo = mid + 1;
+            } else {
+                hi = mid;
+            }
+        }
+        let best = null;
+        for (let i = Math.max(0, lo - 1); i <= Math.min(points.length - 1, lo); i++) {
+            const p = points[i];
+            if (p.y !== null && p.y !== undefined && (best === null || Math.abs(p.x - x) < Math.abs(best.x - x))) {
+                best = p;
+            }
+        }
+        return best;
+    }
+
+    // niceTicks returns evenly spaced, round tick values covering [min, max]
+    static niceTicks(min, max, count) {
+        if (min === max) {
+            min -= 1;
+            max += 1;
+        }
+        const raw = (max - min) / count;
+        const magnitude = Math.pow(10, Math.floor(Math.log10(raw)));
+        const step = [1, 2, 2.5, 5, 10].map(f => f * magnitude).find(s => raw <= s);
+        const ticks = [];
+        for (let v = Math.floor(min / step) * step; v <= Math.ceil(max / step) * step + step / 2; v += step) {
+            ticks.push(Math.round(v / step) * step);
+        }
+        return ticks;
+    }
+
+    // timeTicks returns tick times between min and max on round local times
+    static timeTicks(min, max, count) {
+        const minute = 60 * 1000;
+        const hour = 60 * minute;
+        const day = 24 * hour;
+        const steps = [minute, 5 * minute, 15 * minute, 30 * minute, hour, 3 * hour, 6 * hour, 12 * hour,
+            day, 2 * day, 7 * day, 14 * day, 28 * day];
+        const span = max - min;
+        const step = steps.find(s => span / s <= count) || steps[steps.length - 1];
+
+        const start = new Date(min);
+        start.setHours(0, 0, 0, 0);
+        const ticks = [];
+        for (let t = start.getTime(); t <= max; t += step) {
+            if (t < min) {
+                continue;
+            }
+            const d = new Date(t);
+            let label;
+            if (step >= day) {
+                label = d.toLocaleDateString([], { month: 'short', day: 'numeric' });
+            } else if (span > day) {
+                label = d.toLocaleDateString([], { month: 'short', day: 'numeric' }) + ' ' +
+                    d.toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+            } else {
+                label = d.toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+            }
+            ticks.push({ time: t, label: label });
+        }
+        return ticks;
+    }
+
+    static formatNumber(v) {
+        return Math.abs(v) >= 1000 ? Math.round(v).toLocaleString() : String(Math.round(v * 100) / 100);
+    }
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultWriteBatchSize is the largest number of measurements written per transaction
+	defaultWriteBatchSize = 50
+
+	// defaultWriteFlushInterval bounds how long a measurement waits in the queue
+	defaultWriteFlushInterval = time.Second
+
+	// defaultWriteQueueCapacity is the number of pending measurements before writers block
+	defaultWriteQueueCapacity = 1000
+)
+
+// WriteQueueStats reports the state of the write queue
+type WriteQueueStats struct {
+	Depth              int     `json:"depth"`
+	Capacity           int     `json:"capacity"`
+	Written            int64   `json:"written"`
+	Failed             int64   `json:"failed"`
+	Batches            int64   `json:"batches"`
+	LastBatchSize      int     `json:"last_batch_size"`
+	LastFlushLatencyMs float64 `json:"last_flush_latency_ms"`
+	MaxFlushLatencyMs  float64 `json:"max_flush_latency_ms"`
+}
+
+// WriteQueue wraps a Storage so that StoreMeasurement calls return immediately and are
+// written in batched transactions by a single background writer. All other Storage
+// methods go straight to the wrapped backend.
+type WriteQueue struct {
+	Storage
+
+	pending       chan *AirQualityData
+	batchSize     int
+	flushInterval time.Duration
+	done          chan struct{}
+
+	// closeMu lets Close wait for in-progress sends before closing pending
+	closeMu sync.RWMutex
+	closed  bool
+
+	mu    sync.Mutex
+	stats WriteQueueStats
+}
+
+// NewWriteQueue starts a background writer for storage
+func NewWriteQueue(storage Storage, batchSize int, flushInterval time.Duration) *WriteQueue {
+	if batchSize <= 0 {
+		batchSize = defaultWriteBatchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultWriteFlushInterval
+	}
+
+	q := &WriteQueue{
+		Storage:       storage,
+		pending:       make(chan *AirQualityData, defaultWriteQueueCapacity),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+	q.stats.Capacity = defaultWriteQueueCapacity
+
+	go q.run()
+	return q
+}
+
+// StoreMeasurement queues a measurement for the next batch. It only blocks when the
+// queue is full.
+func (q *WriteQueue) StoreMeasurement(data *AirQualityData) error {
+	q.closeMu.RLock()
+	defer q.closeMu.RUnlock()
+
+	if q.closed {
+		return fmt.Errorf("write queue is closed")
+	}
+	q.pending <- data
+	return nil
+}
+
+// run collects queued measurements and flushes them when a batch fills up or the flush
+// interval passes
+func (q *WriteQueue) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*AirQualityData, 0, q.batchSize)
+	for {
+		select {
+		case data, ok := <-q.pending:
+			if !ok {
+				q.flush(batch)
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) >= q.batchSize {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// flush writes a batch in one transaction and records its latency
+func (q *WriteQueue) flush(batch []*AirQualityData) {
+	if len(batch) == 0 {
+		return
+	}
+
+	start := time.Now()
+	err := q.Storage.StoreMeasurements(batch)
+	latency := float64(time.Since(start).Microseconds()) / 1000
+
+	q.mu.Lock()
+	q.stats.Batches++
+	q.stats.LastBatchSize = len(batch)
+	q.stats.LastFlushLatencyMs = latency
+	if latency > q.stats.MaxFlushLatencyMs {
+		q.stats.MaxFlushLatencyMs = latency
+	}
+	if err != nil {
+		q.stats.Failed += int64(len(batch))
+	} else {
+		q.stats.Written += int64(len(batch))
+	}
+	q.mu.Unlock()
+
+	if err != nil {
+		slog.Error("Error writing queued measurements", "count", len(batch), "error", err)
+	}
+}
+
+// Stats returns a snapshot of the queue metrics
+func (q *WriteQueue) Stats() WriteQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := q.stats
+	stats.Depth = len(q.pending)
+	return stats
+}
+
+// Unwrap returns the storage backend behind the queue
+func (q *WriteQueue) Unwrap() Storage {
+	return q.Storage
+}
+
+// Close flushes every queued measurement and then closes the wrapped backend. Stores
+// attempted after Close return an error.
+func (q *WriteQueue) Close() error {
+	q.closeMu.Lock()
+	if q.closed {
+		q.closeMu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.pending)
+	q.closeMu.Unlock()
+
+	<-q.done
+	return q.Storage.Close()
+}
+
+// sqliteDatabase returns the SQLite backend behind storage and any wrappers around it,
+// if there is one
+func sqliteDatabase(storage Storage) (*Database, bool) {
+	for {
+		wrapper, ok := storage.(interface{ Unwrap() Storage })
+		if !ok {
+			break
+		}
+		storage = wrapper.Unwrap()
+	}
+	database, ok := storage.(*Database)
+	return database, ok
+}